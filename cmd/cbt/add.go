@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type addFlags struct {
+	layer           string
+	chown           string
+	chmod           string
+	noSetuid        bool
+	maxArchiveBytes int64
+	message         string
+}
+
+func init() {
+	var opts addFlags
+	var addCmd = &cobra.Command{
+		Use:     "add",
+		Aliases: []string{"copy-in"},
+		Short:   "Copy files from the host into a layer of a working container.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleAddCmd(c, args, opts)
+		},
+		Args: cobra.MinimumNArgs(3),
+		Example: `cbt add $CONTAINER ./dist /app/
+cbt add $CONTAINER --layer deps --chown 1000:1000 'vendor/*.tar.gz' /opt/vendor/`,
+	}
+
+	flags := addCmd.Flags()
+	flags.StringVar(&opts.layer, "layer", "", "Layer to add the files to")
+	flags.StringVar(&opts.chown, "chown", "", "Owner of the added files as uid[:gid], requires root")
+	flags.StringVar(&opts.chmod, "chmod", "", "Octal permissions of the added files")
+	flags.BoolVar(&opts.noSetuid, "no-setuid", false, "Clear setuid and setgid bits of the added files")
+	flags.Int64Var(&opts.maxArchiveBytes, "max-archive-size", 0, "Maximum extracted size of each source archive in bytes, 0 for no limit")
+	flags.StringVarP(&opts.message, "message", "m", "", "Comment recorded in the image history")
+
+	rootCmd.AddCommand(addCmd)
+}
+
+func handleAddCmd(c *cobra.Command, args []string, opts addFlags) error {
+	b, err := builder.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	addOptions := builder.AddOptions{
+		Sources:         args[1 : len(args)-1],
+		Dest:            args[len(args)-1],
+		Layer:           opts.layer,
+		UID:             -1,
+		GID:             -1,
+		NoSetuid:        opts.noSetuid,
+		MaxArchiveBytes: opts.maxArchiveBytes,
+		CreatedBy:       createdBy(c, args[1:]),
+		Comment:         opts.message,
+	}
+
+	if c.Flag("chown").Changed {
+		addOptions.UID, addOptions.GID, err = parseChown(opts.chown)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Flag("chmod").Changed {
+		mode, err := strconv.ParseUint(opts.chmod, 8, 32)
+		if err != nil {
+			return fmt.Errorf("parsing chmod %q: %w", opts.chmod, err)
+		}
+		fileMode := os.FileMode(mode)
+		addOptions.Mode = &fileMode
+	}
+
+	name, err := b.Add(addOptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.Save()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(name)
+
+	return nil
+}
+
+func parseChown(chown string) (int, int, error) {
+	user, group, found := strings.Cut(chown, ":")
+
+	uid, err := strconv.Atoi(user)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing chown %q: numeric uid expected", chown)
+	}
+
+	if !found {
+		return uid, uid, nil
+	}
+
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsing chown %q: numeric gid expected", chown)
+	}
+
+	return uid, gid, nil
+}
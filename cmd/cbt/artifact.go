@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+var artifactCmd = &cobra.Command{
+	Use:   "artifact",
+	Short: "Store arbitrary files as OCI artifacts.",
+	RunE: func(c *cobra.Command, args []string) error {
+		return c.Help()
+	},
+}
+
+type artifactPushFlags struct {
+	artifactType       string
+	files              []string
+	annotations        []string
+	subject            string
+	archiveCompression string
+}
+
+type artifactPullFlags struct {
+	output string
+}
+
+func init() {
+	var pushOpts artifactPushFlags
+	var pushCmd = &cobra.Command{
+		Use:   "push",
+		Short: "Write files as an artifact.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleArtifactPushCmd(c, args, pushOpts)
+		},
+		Args: cobra.ExactArgs(1),
+		Example: `cbt artifact push --artifact-type application/vnd.cncf.helm.config.v1+json \
+  --file mychart-0.1.0.tgz:application/vnd.cncf.helm.chart.content.v1.tar+gzip \
+  oci-layout:/tmp/charts:mychart:0.1.0
+cbt artifact push --artifact-type application/spdx+json --file sbom.spdx.json \
+  --subject oci-layout:/tmp/app:app:1 oci-layout:/tmp/app`,
+	}
+
+	flags := pushCmd.Flags()
+	flags.StringVar(&pushOpts.artifactType, "artifact-type", "", "Media type of the artifact")
+	flags.StringArrayVar(&pushOpts.files, "file", nil, "File to add as path[:mediatype]; repeat for more files")
+	flags.StringArrayVar(&pushOpts.annotations, "annotation", nil, "Manifest annotation as key=value")
+	flags.StringVar(&pushOpts.subject, "subject", "", "Image to attach the artifact to")
+	flags.StringVar(&pushOpts.archiveCompression, "archive-compression", "none", "Compression of oci-archive output (none, gzip, zstd)")
+	pushCmd.MarkFlagRequired("artifact-type")
+
+	var pullOpts artifactPullFlags
+	var pullCmd = &cobra.Command{
+		Use:   "pull",
+		Short: "Write the files of an artifact to a directory.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleArtifactPullCmd(c, args, pullOpts)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `cbt artifact pull -o charts/ oci-layout:/tmp/charts:mychart:0.1.0`,
+	}
+
+	pullCmd.Flags().StringVarP(&pullOpts.output, "output", "o", ".", "Directory to write the files to")
+
+	artifactCmd.AddCommand(pushCmd, pullCmd)
+	rootCmd.AddCommand(artifactCmd)
+}
+
+func handleArtifactPushCmd(c *cobra.Command, args []string, opts artifactPushFlags) error {
+	archiveCompression, err := archive.ParseCompression(opts.archiveCompression)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := parseAnnotations(opts.annotations)
+	if err != nil {
+		return err
+	}
+
+	var files []builder.ArtifactFile
+	for _, file := range opts.files {
+		files = append(files, builder.ParseArtifactFile(file))
+	}
+
+	descriptor, err := builder.PushArtifact(builder.PushArtifactOptions{
+		Target:             args[0],
+		ArtifactType:       opts.artifactType,
+		Files:              files,
+		Annotations:        annotations,
+		Subject:            opts.subject,
+		ArchiveCompression: archiveCompression,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(descriptor.Digest)
+
+	return nil
+}
+
+func handleArtifactPullCmd(c *cobra.Command, args []string, opts artifactPullFlags) error {
+	written, err := builder.PullArtifact(builder.PullArtifactOptions{
+		Source: args[0],
+		Output: opts.output,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range written {
+		fmt.Println(path)
+	}
+
+	return nil
+}
+
+func parseAnnotations(annotations []string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	for _, annotation := range annotations {
+		key, value, found := strings.Cut(annotation, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("parsing annotation %q: key=value expected", annotation)
+		}
+		parsed[key] = value
+	}
+	return parsed, nil
+}
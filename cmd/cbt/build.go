@@ -1,15 +1,23 @@
 package main
 
 import (
-	"errors"
+	"runtime"
 
 	"github.com/spf13/cobra"
 
+	"github.com/pkorzh/container-build-tool/internal/archive"
 	"github.com/pkorzh/container-build-tool/internal/builder"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
 )
 
 type buildFlags struct {
-	layers []string
+	layers             []string
+	archiveCompression string
+	compression        string
+	jobs               int
+	squash             bool
+	squashAll          bool
+	format             string
 }
 
 func init() {
@@ -25,6 +33,13 @@ func init() {
 
 	flags := buildCmd.Flags()
 	flags.StringSliceVar(&opts.layers, "layers", []string{}, "Layers to add to the image")
+	flags.StringVar(&opts.compression, "compression", "gzip", "Compression of new layers (none, gzip, zstd)")
+	flags.IntVar(&opts.jobs, "jobs", runtime.NumCPU(), "Number of layers to copy or compress concurrently")
+	flags.StringVar(&opts.archiveCompression, "archive-compression", "none", "Compression of oci-archive output (none, gzip, zstd)")
+	flags.BoolVar(&opts.squash, "squash", false, "Squash the layers of the working container into one layer")
+	flags.BoolVar(&opts.squashAll, "squash-all", false, "Squash all layers, including the base image ones, into one layer")
+	flags.StringVar(&opts.format, "format", "oci", "Manifest format of the image (oci, docker)")
+	buildCmd.MarkFlagsMutuallyExclusive("squash", "squash-all")
 
 	rootCmd.AddCommand(buildCmd)
 }
@@ -34,14 +49,32 @@ func handleBuildCmd(c *cobra.Command, args []string, opts buildFlags) error {
 	if err != nil {
 		return err
 	}
+	defer b.Close()
 
-	if !c.Flag("layers").Changed {
-		return errors.New("layers must be specified")
+	archiveCompression, err := archive.ParseCompression(opts.archiveCompression)
+	if err != nil {
+		return err
+	}
+
+	compression, err := archive.ParseCompression(opts.compression)
+	if err != nil {
+		return err
+	}
+
+	format, err := manifest.ParseFormat(opts.format)
+	if err != nil {
+		return err
 	}
 
 	buildOptions := builder.BuildOptions{
-		Target: args[1],
-		Layers: opts.layers,
+		Target:             args[1],
+		Layers:             opts.layers,
+		ArchiveCompression: archiveCompression,
+		Compression:        compression,
+		Jobs:               opts.jobs,
+		Squash:             opts.squash,
+		SquashAll:          opts.squashAll,
+		Format:             format,
 	}
 
 	err = b.Build(buildOptions)
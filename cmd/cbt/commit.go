@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type commitFlags struct {
+	lowerLayers []string
+	upperLayer  string
+	snapshot    string
+	layer       string
+	message     string
+}
+
+func init() {
+	var opts commitFlags
+	var commitCmd = &cobra.Command{
+		Use:   "commit",
+		Short: "Capture the changes of a working container as a new layer.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleCommitCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(1),
+		Example: `cbt commit $CONTAINER -l root -u deps
+cbt commit $CONTAINER -l root --snapshot /tmp/rootfs --layer app`,
+	}
+
+	flags := commitCmd.Flags()
+	flags.StringSliceVarP(&opts.lowerLayers, "lower-layers", "l", []string{"root"}, "Lower layers to compare against")
+	flags.StringVarP(&opts.upperLayer, "upper-layer", "u", "", "Upper layer holding the changes")
+	flags.StringVar(&opts.snapshot, "snapshot", "", "Directory with a full copy of the filesystem to compare instead of an upper layer")
+	flags.StringVar(&opts.layer, "layer", "", "Name of the new layer")
+	flags.StringVarP(&opts.message, "message", "m", "", "Comment recorded in the image history")
+
+	rootCmd.AddCommand(commitCmd)
+}
+
+func handleCommitCmd(c *cobra.Command, args []string, opts commitFlags) error {
+	b, err := builder.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	name, err := b.Commit(builder.CommitOptions{
+		ChangesOptions: builder.ChangesOptions{
+			UpperLayer:  opts.upperLayer,
+			LowerLayers: opts.lowerLayers,
+			Snapshot:    opts.snapshot,
+		},
+		Layer:     opts.layer,
+		CreatedBy: createdBy(c, nil),
+		Comment:   opts.message,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.Save()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(name)
+
+	return nil
+}
@@ -18,6 +18,7 @@ type configFlags struct {
 	ports      []string
 	os         string
 	arch       string
+	message    string
 }
 
 func init() {
@@ -40,6 +41,7 @@ func init() {
 	flags.StringSliceVar(&opts.ports, "ports", []string{}, "Ports")
 	flags.StringVar(&opts.os, "os", runtime.GOOS, "OS")
 	flags.StringVar(&opts.arch, "arch", runtime.GOARCH, "Architecture")
+	flags.StringVarP(&opts.message, "message", "m", "", "Comment recorded in the image history")
 
 	rootCmd.AddCommand(configCmd)
 }
@@ -49,6 +51,7 @@ func handleConfigCmd(c *cobra.Command, args []string, opts configFlags) error {
 	if err != nil {
 		return err
 	}
+	defer builder.Close()
 
 	if c.Flag("workingdir").Changed {
 		builder.SetWorkingDir(opts.workingDir)
@@ -92,6 +95,14 @@ func handleConfigCmd(c *cobra.Command, args []string, opts configFlags) error {
 		builder.SetArch(opts.arch)
 	}
 
+	// Only config changes are recorded; a comment alone isn't one.
+	for _, name := range []string{"workingdir", "user", "cmd", "entrypoint", "ports", "os", "arch"} {
+		if c.Flag(name).Changed {
+			builder.AddHistory(createdBy(c, nil), opts.message)
+			break
+		}
+	}
+
 	err = builder.Save()
 	if err != nil {
 		return err
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type containersFlags struct {
+	quiet bool
+}
+
+func init() {
+	var opts containersFlags
+	var containersCmd = &cobra.Command{
+		Use:   "containers",
+		Short: "List working containers.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleContainersCmd(c, args, opts)
+		},
+		Args: cobra.NoArgs,
+	}
+
+	flags := containersCmd.Flags()
+	flags.BoolVarP(&opts.quiet, "quiet", "q", false, "Only print container IDs")
+
+	rootCmd.AddCommand(containersCmd)
+}
+
+func handleContainersCmd(c *cobra.Command, args []string, opts containersFlags) error {
+	builders, unreadable, err := builder.List()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range unreadable {
+		fmt.Fprintf(os.Stderr, "warning: can't read working container %s: %v\n", u.ID, u.Err)
+	}
+
+	if opts.quiet {
+		for _, b := range builders {
+			fmt.Println(b.WorkDirID)
+		}
+		for _, u := range unreadable {
+			fmt.Println(u.ID)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tBASE IMAGE\tLAYERS\tCREATED")
+	for _, b := range builders {
+		layers := strings.Join(b.Layers, ",")
+		if layers == "" {
+			layers = "-"
+		}
+
+		created := "-"
+		if !b.Created.IsZero() {
+			created = b.Created.Local().Format(time.DateTime)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.WorkDirID[:min(12, len(b.WorkDirID))], b.Name, b.FromImage, layers, created)
+	}
+	for _, u := range unreadable {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.ID[:min(12, len(u.ID))], "-", "-", "-", "-")
+	}
+
+	return w.Flush()
+}
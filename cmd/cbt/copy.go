@@ -0,0 +1,69 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/builder"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
+)
+
+type copyFlags struct {
+	archiveCompression string
+	format             string
+	platform           string
+	jobs               int
+}
+
+func init() {
+	var opts copyFlags
+	var copyCmd = &cobra.Command{
+		Use:   "copy",
+		Short: "Copy an image, converting its manifest format if asked to.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleCopyCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(2),
+		Example: `cbt copy oci-archive:/tmp/app.tar:app:1 oci-layout:/tmp/app:app:1
+cbt copy --format docker oci-layout:/tmp/app:app:1 oci-archive:/tmp/app-docker.tar:app:1`,
+	}
+
+	flags := copyCmd.Flags()
+	flags.StringVar(&opts.format, "format", "", "Manifest format of the copy (oci, docker); the source format by default")
+	flags.StringVar(&opts.platform, "platform", "", "Platform of the image to use out of a multi-platform image, as os/arch[/variant]; linux on the host architecture by default")
+	flags.IntVar(&opts.jobs, "jobs", runtime.NumCPU(), "Number of layers to copy concurrently")
+	flags.StringVar(&opts.archiveCompression, "archive-compression", "none", "Compression of oci-archive output (none, gzip, zstd)")
+
+	rootCmd.AddCommand(copyCmd)
+}
+
+func handleCopyCmd(c *cobra.Command, args []string, opts copyFlags) error {
+	archiveCompression, err := archive.ParseCompression(opts.archiveCompression)
+	if err != nil {
+		return err
+	}
+
+	var format manifest.Format
+	if opts.format != "" {
+		format, err = manifest.ParseFormat(opts.format)
+		if err != nil {
+			return err
+		}
+	}
+
+	platform, err := parsePlatform(opts.platform)
+	if err != nil {
+		return err
+	}
+
+	return builder.Copy(builder.CopyOptions{
+		Source:             args[0],
+		Target:             args[1],
+		ArchiveCompression: archiveCompression,
+		Jobs:               opts.jobs,
+		Format:             format,
+		Platform:           platform,
+	})
+}
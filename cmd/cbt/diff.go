@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+	"github.com/pkorzh/container-build-tool/internal/changes"
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type diffFlags struct {
+	lowerLayers []string
+	upperLayer  string
+	snapshot    string
+	format      string
+}
+
+func init() {
+	var opts diffFlags
+	var diffCmd = &cobra.Command{
+		Use:   "diff",
+		Short: "Show filesystem changes of a working container or between two images.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleDiffCmd(c, args, opts)
+		},
+		Args: cobra.RangeArgs(1, 2),
+		Example: `cbt diff $CONTAINER -l root -u deps
+cbt diff --format json oci-layout:/tmp/app:app:1 oci-layout:/tmp/app:app:2`,
+	}
+
+	flags := diffCmd.Flags()
+	flags.StringSliceVarP(&opts.lowerLayers, "lower-layers", "l", []string{"root"}, "Lower layers to compare against")
+	flags.StringVarP(&opts.upperLayer, "upper-layer", "u", "", "Upper layer holding the changes")
+	flags.StringVar(&opts.snapshot, "snapshot", "", "Directory with a full copy of the filesystem to compare instead of an upper layer")
+	flags.StringVar(&opts.format, "format", "text", "Output format (text, json)")
+
+	rootCmd.AddCommand(diffCmd)
+}
+
+func handleDiffCmd(c *cobra.Command, args []string, opts diffFlags) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("unknown format: %s", opts.format)
+	}
+
+	if len(args) == 2 {
+		return diffImages(args[0], args[1], opts.format)
+	}
+
+	b, err := builder.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	_, diff, err := b.Changes(builder.ChangesOptions{
+		UpperLayer:  opts.upperLayer,
+		LowerLayers: opts.lowerLayers,
+		Snapshot:    opts.snapshot,
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.format == "json" {
+		return printJSON(struct {
+			Files []changes.Change `json:"files"`
+		}{diff})
+	}
+
+	printChanges(os.Stdout, diff, "")
+
+	return nil
+}
+
+func diffImages(oldName, newName, format string) error {
+	oldRef, err := image.ParseReference(oldName)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	newRef, err := image.ParseReference(newName)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	oldReader, err := oldRef.NewImageReader(types.ImageReaderOptions{})
+	if err != nil {
+		return fmt.Errorf("creating image reader: %w", err)
+	}
+	defer oldReader.Close()
+
+	newReader, err := newRef.NewImageReader(types.ImageReaderOptions{})
+	if err != nil {
+		return fmt.Errorf("creating image reader: %w", err)
+	}
+	defer newReader.Close()
+
+	diff, err := changes.CompareImages(oldReader, newReader)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		return printJSON(diff)
+	}
+
+	fmt.Println("Layers:")
+	for _, layer := range diff.Layers {
+		if layer.Same {
+			fmt.Printf("  %d %s\n", layer.Index, layer.New)
+		} else {
+			fmt.Printf("  %d %s -> %s\n", layer.Index, orNone(string(layer.Old)), orNone(string(layer.New)))
+		}
+	}
+
+	fmt.Println("Config:")
+	for _, config := range diff.Config {
+		fmt.Printf("  %s: %s -> %s\n", config.Field, jsonString(config.Old), jsonString(config.New))
+	}
+
+	fmt.Println("History:")
+	for _, history := range diff.History {
+		fmt.Printf("  %d: %s -> %s\n", history.Index, historyString(history.Old), historyString(history.New))
+	}
+
+	fmt.Println("Files:")
+	printChanges(os.Stdout, diff.Files, "  ")
+
+	return nil
+}
+
+func printChanges(w io.Writer, diff []changes.Change, indent string) {
+	for _, change := range diff {
+		var details []string
+
+		switch change.Kind {
+		case changes.Added:
+			if !change.New.Mode.IsDir() {
+				details = append(details, fmt.Sprintf("%d bytes", change.New.Size))
+			}
+		case changes.Modified:
+			if change.Old.Size != change.New.Size {
+				details = append(details, fmt.Sprintf("size %d -> %d", change.Old.Size, change.New.Size))
+			}
+			if change.Old.Mode != change.New.Mode {
+				details = append(details, fmt.Sprintf("mode %s -> %s", change.Old.Mode, change.New.Mode))
+			}
+			if change.Old.UID != change.New.UID || change.Old.GID != change.New.GID {
+				details = append(details, fmt.Sprintf("owner %d:%d -> %d:%d", change.Old.UID, change.Old.GID, change.New.UID, change.New.GID))
+			}
+			if change.Old.Link != change.New.Link {
+				details = append(details, fmt.Sprintf("link %s -> %s", change.Old.Link, change.New.Link))
+			}
+		}
+
+		if change.Opaque {
+			details = append(details, "opaque")
+		}
+
+		line := fmt.Sprintf("%s%c /%s", indent, strings.ToUpper(change.Kind.String())[0], change.Path)
+		if len(details) > 0 {
+			line += "  " + strings.Join(details, ", ")
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func jsonString(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func historyString(h *imgspecv1.History) string {
+	if h == nil {
+		return "<none>"
+	}
+	return jsonString(h.CreatedBy)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type exportFlags struct {
+	format      string
+	compression string
+}
+
+func init() {
+	var opts exportFlags
+	var exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Write the merged root filesystem of an image or working container.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleExportCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(2),
+		Example: `cbt export oci-layout:/tmp/app:app:1 rootfs.tar.gz
+cbt export --format dir $CONTAINER /tmp/rootfs
+cbt export --format ext4 oci-layout:/tmp/app:app:1 rootfs.img
+cbt export oci-archive:/tmp/app.tar - | tar -t`,
+	}
+
+	flags := exportCmd.Flags()
+	flags.StringVar(&opts.format, "format", "", "Output format (tar, dir, squashfs, ext4); picked from the output path by default")
+	flags.StringVar(&opts.compression, "compression", "", "Compression of tar output (none, gzip, zstd); picked from the file extension by default")
+
+	rootCmd.AddCommand(exportCmd)
+}
+
+func handleExportCmd(c *cobra.Command, args []string, opts exportFlags) error {
+	output := args[1]
+
+	format := builder.ExportFormat(opts.format)
+	if format == "" {
+		format = builder.ExportTar
+		if fi, err := os.Stat(output); strings.HasSuffix(output, "/") || (err == nil && fi.IsDir()) {
+			format = builder.ExportDir
+		}
+		switch filepath.Ext(output) {
+		case ".sqfs", ".squashfs":
+			format = builder.ExportSquashfs
+		case ".ext4":
+			format = builder.ExportExt4
+		}
+	}
+
+	compression := builder.CompressionForPath(output)
+	if c.Flag("compression").Changed {
+		var err error
+		compression, err = archive.ParseCompression(opts.compression)
+		if err != nil {
+			return err
+		}
+	}
+
+	return builder.Export(builder.ExportOptions{
+		Source:      args[0],
+		Output:      output,
+		Format:      format,
+		Compression: compression,
+	})
+}
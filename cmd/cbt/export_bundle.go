@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type exportBundleFlags struct {
+	rootless bool
+}
+
+func init() {
+	var opts exportBundleFlags
+	var exportBundleCmd = &cobra.Command{
+		Use:   "export-bundle",
+		Short: "Unpack an image or working container into an OCI runtime bundle.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleExportBundleCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(2),
+		Example: `cbt export-bundle oci-layout:/tmp/app:app:1 /tmp/bundle && runc run -b /tmp/bundle app
+cbt export-bundle --rootless $CONTAINER /tmp/bundle`,
+	}
+
+	flags := exportBundleCmd.Flags()
+	flags.BoolVar(&opts.rootless, "rootless", os.Geteuid() != 0, "Generate a config for running without root")
+
+	rootCmd.AddCommand(exportBundleCmd)
+}
+
+func handleExportBundleCmd(c *cobra.Command, args []string, opts exportBundleFlags) error {
+	return builder.ExportBundle(builder.ExportBundleOptions{
+		Source:   args[0],
+		Dir:      args[1],
+		Rootless: opts.rootless,
+	})
+}
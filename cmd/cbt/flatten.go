@@ -0,0 +1,64 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type flattenFlags struct {
+	archiveCompression string
+	compression        string
+	platform           string
+	jobs               int
+}
+
+func init() {
+	var opts flattenFlags
+	var flattenCmd = &cobra.Command{
+		Use:   "flatten",
+		Short: "Write an image with all of its layers merged into one.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleFlattenCmd(c, args, opts)
+		},
+		Args:    cobra.ExactArgs(2),
+		Example: `cbt flatten oci-layout:/tmp/app:app:1 oci-archive:/tmp/app-flat.tar:app:1`,
+	}
+
+	flags := flattenCmd.Flags()
+	flags.StringVar(&opts.compression, "compression", "gzip", "Compression of the flattened layer (none, gzip, zstd)")
+	flags.StringVar(&opts.platform, "platform", "", "Platform of the image to use out of a multi-platform image, as os/arch[/variant]; linux on the host architecture by default")
+	flags.IntVar(&opts.jobs, "jobs", runtime.NumCPU(), "Number of threads to compress the layer with")
+	flags.StringVar(&opts.archiveCompression, "archive-compression", "none", "Compression of oci-archive output (none, gzip, zstd)")
+
+	rootCmd.AddCommand(flattenCmd)
+}
+
+func handleFlattenCmd(c *cobra.Command, args []string, opts flattenFlags) error {
+	archiveCompression, err := archive.ParseCompression(opts.archiveCompression)
+	if err != nil {
+		return err
+	}
+
+	compression, err := archive.ParseCompression(opts.compression)
+	if err != nil {
+		return err
+	}
+
+	platform, err := parsePlatform(opts.platform)
+	if err != nil {
+		return err
+	}
+
+	return builder.Flatten(builder.FlattenOptions{
+		Source:             args[0],
+		Target:             args[1],
+		ArchiveCompression: archiveCompression,
+		Compression:        compression,
+		Jobs:               opts.jobs,
+		Platform:           platform,
+	})
+}
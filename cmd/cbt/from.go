@@ -2,30 +2,45 @@ package main
 
 import (
 	"errors"
+	"fmt"
 
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
 
 	"github.com/pkorzh/container-build-tool/internal/builder"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
 )
 
+type fromFlags struct {
+	name     string
+	platform string
+}
+
 func init() {
+	var opts fromFlags
 	var fromCmd = &cobra.Command{
 		Use:           "from",
 		Short:         "Create a working container based on an image.",
 		SilenceErrors: true,
 		SilenceUsage:  true,
 		RunE: func(c *cobra.Command, args []string) error {
-			return handleFromCmd(c, args)
+			return handleFromCmd(c, args, opts)
 		},
 		Example: `cbt from oci-archive:/tmp/centos.tar
 cbt from oci-layout:/tmp/centos:latest
-cbt from oci-layout:/tmp/nodejs:nodejs:latest`,
+cbt from oci-layout:/tmp/nodejs:nodejs:latest
+cbt from --name app oci-layout:/tmp/nodejs:nodejs:latest
+cbt from --platform linux/arm/v7 oci-layout:/tmp/nodejs:nodejs:latest`,
 	}
 
+	flags := fromCmd.Flags()
+	flags.StringVar(&opts.name, "name", "", "Name of the working container")
+	flags.StringVar(&opts.platform, "platform", "", "Platform of the image to use out of a multi-platform image, as os/arch[/variant]; linux on the host architecture by default")
+
 	rootCmd.AddCommand(fromCmd)
 }
 
-func handleFromCmd(c *cobra.Command, args []string) error {
+func handleFromCmd(c *cobra.Command, args []string, opts fromFlags) error {
 	if len(args) == 0 {
 		return errors.New("an image name must be specified")
 	}
@@ -34,19 +49,39 @@ func handleFromCmd(c *cobra.Command, args []string) error {
 		return errors.New("too many arguments specified")
 	}
 
+	platform, err := parsePlatform(opts.platform)
+	if err != nil {
+		return err
+	}
+
 	builderOptions := builder.BuilderOptions{
 		FromImage: args[0],
+		Name:      opts.name,
+		Platform:  platform,
 	}
 
 	builder, err := builder.New(builderOptions)
 	if err != nil {
 		return err
 	}
+	defer builder.Close()
+
+	fmt.Println(builder.Name)
 
-	err = builder.Save()
+	return nil
+}
+
+// parsePlatform parses a --platform flag; an empty one leaves the platform
+// to the default.
+func parsePlatform(s string) (*imgspecv1.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	platform, err := manifest.ParsePlatform(s)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &platform, nil
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type historyFlags struct {
+	noTrunc bool
+	format  string
+}
+
+type historyRow struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"createdBy,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"emptyLayer,omitempty"`
+	Layer      string     `json:"layer,omitempty"`
+	Size       int64      `json:"size"`
+}
+
+func init() {
+	var opts historyFlags
+	var historyCmd = &cobra.Command{
+		Use:   "history",
+		Short: "Show the history of an image.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleHistoryCmd(c, args, opts)
+		},
+		Args:    cobra.ExactArgs(1),
+		Example: `cbt history oci-layout:/tmp/app:app:1`,
+	}
+
+	flags := historyCmd.Flags()
+	flags.BoolVar(&opts.noTrunc, "no-trunc", false, "Don't truncate output")
+	flags.StringVar(&opts.format, "format", "text", "Output format (text, json)")
+
+	rootCmd.AddCommand(historyCmd)
+}
+
+func handleHistoryCmd(c *cobra.Command, args []string, opts historyFlags) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("unknown format: %s", opts.format)
+	}
+
+	ref, err := image.ParseReference(args[0])
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	reader, err := ref.NewImageReader(types.ImageReaderOptions{})
+	if err != nil {
+		return fmt.Errorf("creating image reader: %w", err)
+	}
+	defer reader.Close()
+
+	img, err := reader.GetImage()
+	if err != nil {
+		return fmt.Errorf("getting image: %w", err)
+	}
+
+	manifest, err := reader.GetManifest()
+	if err != nil {
+		return fmt.Errorf("getting manifest: %w", err)
+	}
+
+	rows := historyRows(img.History, manifest.Layers)
+
+	if opts.format == "json" {
+		return printJSON(rows)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT")
+	for i := len(rows) - 1; i >= 0; i-- {
+		row := rows[i]
+
+		layer := row.Layer
+		if layer == "" {
+			layer = "<missing>"
+		} else if !opts.noTrunc {
+			layer = shortDigest(layer)
+		}
+
+		created := "<missing>"
+		if row.Created != nil {
+			created = row.Created.Local().Format(time.DateTime)
+		}
+
+		createdBy := row.CreatedBy
+		if runes := []rune(createdBy); !opts.noTrunc && len(runes) > 45 {
+			createdBy = string(runes[:44]) + "…"
+		}
+
+		size := "0B"
+		if !row.EmptyLayer {
+			size = humanSize(row.Size)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", layer, created, createdBy, size, row.Comment)
+	}
+
+	return w.Flush()
+}
+
+// historyRows matches the history entries that add layers to the layers of
+// the manifest, in order. Layers without an entry are listed after the
+// history.
+func historyRows(history []imgspecv1.History, layers []imgspecv1.Descriptor) []historyRow {
+	var rows []historyRow
+
+	next := 0
+	for _, entry := range history {
+		row := historyRow{
+			Created:    entry.Created,
+			CreatedBy:  entry.CreatedBy,
+			Comment:    entry.Comment,
+			EmptyLayer: entry.EmptyLayer,
+		}
+		if !entry.EmptyLayer && next < len(layers) {
+			row.Layer = layers[next].Digest.String()
+			row.Size = layers[next].Size
+			next++
+		}
+		rows = append(rows, row)
+	}
+
+	for ; next < len(layers); next++ {
+		rows = append(rows, historyRow{
+			Layer: layers[next].Digest.String(),
+			Size:  layers[next].Size,
+		})
+	}
+
+	return rows
+}
+
+// createdBy describes a command for the image history: its path, the flags
+// that were set and the arguments.
+func createdBy(c *cobra.Command, args []string) string {
+	parts := []string{c.CommandPath()}
+
+	c.Flags().Visit(func(f *pflag.Flag) {
+		if f.Name == "message" {
+			return
+		}
+		parts = append(parts, fmt.Sprintf("--%s=%s", f.Name, quoteArg(f.Value.String())))
+	})
+
+	for _, arg := range args {
+		parts = append(parts, quoteArg(arg))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func quoteArg(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"'\\$") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func shortDigest(d string) string {
+	_, hex, found := strings.Cut(d, ":")
+	if !found {
+		hex = d
+	}
+	return hex[:min(12, len(hex))]
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[unit])
+}
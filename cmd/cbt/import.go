@@ -0,0 +1,69 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type importFlags struct {
+	config             string
+	os                 string
+	arch               string
+	message            string
+	compression        string
+	archiveCompression string
+	jobs               int
+}
+
+func init() {
+	var opts importFlags
+	var importCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Create an image from a rootfs tarball.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleImportCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(2),
+		Example: `cbt import rootfs.tar.gz oci-layout:/tmp/base:base:1
+cbt import --config config.json - oci-archive:/tmp/base.tar:base:1 < rootfs.tar`,
+	}
+
+	flags := importCmd.Flags()
+	flags.StringVar(&opts.config, "config", "", "Image config JSON, or only its config section, to use")
+	flags.StringVar(&opts.os, "os", "", "OS (default from the config, or linux)")
+	flags.StringVar(&opts.arch, "arch", "", "Architecture (default from the config, or the host)")
+	flags.StringVarP(&opts.message, "message", "m", "", "Comment recorded in the image history")
+	flags.StringVar(&opts.compression, "compression", "gzip", "Compression of the layer (none, gzip, zstd)")
+	flags.StringVar(&opts.archiveCompression, "archive-compression", "none", "Compression of oci-archive output (none, gzip, zstd)")
+	flags.IntVar(&opts.jobs, "jobs", runtime.NumCPU(), "Number of threads to compress the layer with")
+
+	rootCmd.AddCommand(importCmd)
+}
+
+func handleImportCmd(c *cobra.Command, args []string, opts importFlags) error {
+	compression, err := archive.ParseCompression(opts.compression)
+	if err != nil {
+		return err
+	}
+
+	archiveCompression, err := archive.ParseCompression(opts.archiveCompression)
+	if err != nil {
+		return err
+	}
+
+	return builder.Import(builder.ImportOptions{
+		Source:             args[0],
+		Target:             args[1],
+		ConfigFile:         opts.config,
+		OS:                 opts.os,
+		Architecture:       opts.arch,
+		Message:            opts.message,
+		Compression:        compression,
+		ArchiveCompression: archiveCompression,
+		Jobs:               opts.jobs,
+	})
+}
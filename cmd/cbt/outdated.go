@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type outdatedFlags struct {
+	format   string
+	exitCode bool
+}
+
+func init() {
+	var opts outdatedFlags
+	var outdatedCmd = &cobra.Command{
+		Use:   "outdated",
+		Short: "Check whether the base image of an image has changed since it was built.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleOutdatedCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(1),
+		Example: `cbt outdated oci-layout:/tmp/app:app:1
+cbt outdated --exit-code --format json oci-archive:/tmp/app.tar`,
+	}
+
+	flags := outdatedCmd.Flags()
+	flags.StringVar(&opts.format, "format", "text", "Output format (text, json)")
+	flags.BoolVar(&opts.exitCode, "exit-code", false, "Exit with status 2 when the base image is outdated")
+
+	rootCmd.AddCommand(outdatedCmd)
+}
+
+func handleOutdatedCmd(c *cobra.Command, args []string, opts outdatedFlags) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("unknown format: %s", opts.format)
+	}
+
+	status, err := builder.CheckBase(args[0])
+	if err != nil {
+		return err
+	}
+
+	if opts.format == "json" {
+		if err := printJSON(status); err != nil {
+			return err
+		}
+	} else {
+		state := "up to date"
+		if status.Outdated {
+			state = "outdated"
+		}
+		fmt.Printf("Base image: %s\n", status.Name)
+		fmt.Printf("Built on:   %s\n", status.Digest)
+		fmt.Printf("Latest:     %s\n", status.Latest)
+		fmt.Printf("Status:     %s\n", state)
+	}
+
+	if opts.exitCode && status.Outdated {
+		os.Exit(2)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type rebaseFlags struct {
+	oldBase            string
+	newBase            string
+	target             string
+	archiveCompression string
+	jobs               int
+}
+
+func init() {
+	var opts rebaseFlags
+	var rebaseCmd = &cobra.Command{
+		Use:   "rebase",
+		Short: "Replace the base image layers of an image without rebuilding it.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleRebaseCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(1),
+		Example: `cbt rebase oci-layout:/tmp/app:app:1 \
+  --old-base oci-layout:/tmp/base:base:1 \
+  --new-base oci-layout:/tmp/base:base:2 \
+  --target oci-layout:/tmp/app:app:1-rebased`,
+	}
+
+	flags := rebaseCmd.Flags()
+	flags.StringVar(&opts.oldBase, "old-base", "", "Base image the image was built on")
+	flags.StringVar(&opts.newBase, "new-base", "", "Base image to rebase the image onto")
+	flags.StringVar(&opts.target, "target", "", "Image to write")
+	flags.StringVar(&opts.archiveCompression, "archive-compression", "none", "Compression of oci-archive output (none, gzip, zstd)")
+	flags.IntVar(&opts.jobs, "jobs", runtime.NumCPU(), "Number of layers to copy concurrently")
+	rebaseCmd.MarkFlagRequired("old-base")
+	rebaseCmd.MarkFlagRequired("new-base")
+	rebaseCmd.MarkFlagRequired("target")
+
+	rootCmd.AddCommand(rebaseCmd)
+}
+
+func handleRebaseCmd(c *cobra.Command, args []string, opts rebaseFlags) error {
+	archiveCompression, err := archive.ParseCompression(opts.archiveCompression)
+	if err != nil {
+		return err
+	}
+
+	return builder.Rebase(builder.RebaseOptions{
+		Image:              args[0],
+		OldBase:            opts.oldBase,
+		NewBase:            opts.newBase,
+		Target:             opts.target,
+		ArchiveCompression: archiveCompression,
+		Jobs:               opts.jobs,
+	})
+}
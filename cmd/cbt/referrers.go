@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type referrersFlags struct {
+	artifactType string
+	noTrunc      bool
+	format       string
+}
+
+func init() {
+	var opts referrersFlags
+	var referrersCmd = &cobra.Command{
+		Use:   "referrers",
+		Short: "List the artifacts attached to an image.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleReferrersCmd(c, args, opts)
+		},
+		Args: cobra.ExactArgs(1),
+		Example: `cbt referrers oci-layout:/tmp/app:app:1
+cbt referrers --artifact-type application/spdx+json --format json oci-layout:/tmp/app:app:1`,
+	}
+
+	flags := referrersCmd.Flags()
+	flags.StringVar(&opts.artifactType, "artifact-type", "", "Only list artifacts of this type")
+	flags.BoolVar(&opts.noTrunc, "no-trunc", false, "Don't truncate output")
+	flags.StringVar(&opts.format, "format", "text", "Output format (text, json)")
+
+	rootCmd.AddCommand(referrersCmd)
+}
+
+func handleReferrersCmd(c *cobra.Command, args []string, opts referrersFlags) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("unknown format: %s", opts.format)
+	}
+
+	ref, err := image.ParseReference(args[0])
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	reader, err := ref.NewImageReader(types.ImageReaderOptions{})
+	if err != nil {
+		return fmt.Errorf("creating image reader: %w", err)
+	}
+	defer reader.Close()
+
+	referrers, err := reader.Referrers(opts.artifactType)
+	if err != nil {
+		return err
+	}
+
+	if opts.format == "json" {
+		if referrers == nil {
+			referrers = []imgspecv1.Descriptor{}
+		}
+		return printJSON(referrers)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tARTIFACT TYPE\tCREATED\tSIZE")
+	for _, referrer := range referrers {
+		digest := referrer.Digest.String()
+		if !opts.noTrunc {
+			digest = shortDigest(digest)
+		}
+
+		created := "<missing>"
+		if t, err := time.Parse(time.RFC3339, referrer.Annotations[imgspecv1.AnnotationCreated]); err == nil {
+			created = t.Local().Format(time.DateTime)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", digest, referrer.ArtifactType, created, humanSize(referrer.Size))
+	}
+
+	return w.Flush()
+}
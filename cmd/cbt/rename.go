@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+func init() {
+	var renameCmd = &cobra.Command{
+		Use:   "rename",
+		Short: "Rename a working container.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return builder.Rename(args[0], args[1])
+		},
+		Args:    cobra.ExactArgs(2),
+		Example: `cbt rename $CONTAINER app`,
+	}
+
+	rootCmd.AddCommand(renameCmd)
+}
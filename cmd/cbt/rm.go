@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pkorzh/container-build-tool/internal/builder"
+)
+
+type rmFlags struct {
+	all bool
+}
+
+func init() {
+	var opts rmFlags
+	var rmCmd = &cobra.Command{
+		Use:   "rm",
+		Short: "Remove working containers and their layers.",
+		RunE: func(c *cobra.Command, args []string) error {
+			return handleRmCmd(c, args, opts)
+		},
+		Example: `cbt rm $CONTAINER
+cbt rm --all`,
+	}
+
+	flags := rmCmd.Flags()
+	flags.BoolVarP(&opts.all, "all", "a", false, "Remove all working containers")
+
+	rootCmd.AddCommand(rmCmd)
+}
+
+func handleRmCmd(c *cobra.Command, args []string, opts rmFlags) error {
+	if opts.all && len(args) > 0 {
+		return errors.New("--all and container names can't be combined")
+	}
+
+	if opts.all {
+		builders, unreadable, err := builder.List()
+		if err != nil {
+			return err
+		}
+		for _, b := range builders {
+			args = append(args, b.WorkDirID)
+		}
+		for _, u := range unreadable {
+			args = append(args, u.ID)
+		}
+	} else if len(args) == 0 {
+		return errors.New("a working container must be specified")
+	}
+
+	for _, nameOrID := range args {
+		if err := builder.Remove(nameOrID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
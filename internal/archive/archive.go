@@ -6,25 +6,58 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	internalfilepath "github.com/pkorzh/container-build-tool/internal/filepath"
+	"github.com/pkorzh/container-build-tool/internal/ignore"
 )
 
+const paxXattrPrefix = "SCHILY.xattr."
+
 type Compression int
 
 const (
 	Uncompressed Compression = iota
 	Bzip2
 	Gzip
+	Zstd
 )
 
+// compressionBlockSize is the amount of uncompressed data each parallel
+// compressor works on. The compressed output only depends on it and not on
+// the number of jobs, so digests stay reproducible.
+const compressionBlockSize = 1 << 20
+
+// ParseCompression parses the name of a compression to write. Bzip2 can
+// only be read, so it's refused here rather than when the output is
+// written.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "none", "":
+		return Uncompressed, nil
+	case "bzip2":
+		return Uncompressed, errors.New("bzip2 compression is only supported for reading")
+	case "gzip":
+		return Gzip, nil
+	case "zstd":
+		return Zstd, nil
+	default:
+		return Uncompressed, fmt.Errorf("unknown compression: %s", name)
+	}
+}
+
 func DetectCompression(source []byte) Compression {
 	for compression, m := range map[Compression][]byte{
 		Bzip2: {0x42, 0x5A, 0x68},
 		Gzip:  {0x1F, 0x8B, 0x08},
+		Zstd:  {0x28, 0xB5, 0x2F, 0xFD},
 	} {
 		if len(source) < len(m) {
 			continue
@@ -57,42 +90,76 @@ func DecompressStream(src io.Reader) (io.Reader, Compression, error) {
 			return nil, Gzip, err
 		}
 		return gzipReader, Gzip, nil
+	case Zstd:
+		zstdReader, err := zstd.NewReader(buffer, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, Zstd, err
+		}
+		return zstdReader, Zstd, nil
 	default:
 		return nil, Uncompressed, fmt.Errorf("unsupported compression: %d", compression)
 	}
 }
 
+// CloseDecompressed releases the decompressor of a stream returned by
+// DecompressStream.
+func CloseDecompressed(r io.Reader) {
+	switch r := r.(type) {
+	case io.Closer:
+		r.Close()
+	case interface{ Close() }:
+		r.Close()
+	}
+}
+
 func CompressStream(dst io.WriteCloser, compression Compression) (io.WriteCloser, error) {
+	return CompressStreamParallel(dst, compression, 1)
+}
+
+// CompressStreamParallel compresses blocks of the stream on up to jobs
+// goroutines.
+func CompressStreamParallel(dst io.WriteCloser, compression Compression, jobs int) (io.WriteCloser, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
 	switch compression {
 	case Uncompressed:
 		return dst, nil
 	case Bzip2:
 		return nil, fmt.Errorf("bzip2 compression not supported")
 	case Gzip:
-		return gzip.NewWriter(dst), nil
+		gzipWriter := pgzip.NewWriter(dst)
+		if err := gzipWriter.SetConcurrency(compressionBlockSize, jobs); err != nil {
+			return nil, err
+		}
+		return gzipWriter, nil
+	case Zstd:
+		return zstd.NewWriter(dst, zstd.WithEncoderConcurrency(jobs), zstd.WithWindowSize(compressionBlockSize))
 	default:
 		return nil, fmt.Errorf("unsupported compression: %d", compression)
 	}
 }
 
+type TarOptions struct {
+	Compression Compression
+	// ExcludePatterns skips files matching these .dockerignore style
+	// patterns, relative to the archived directory.
+	ExcludePatterns []string
+}
+
 func Tar(src string, compression Compression) (io.ReadCloser, error) {
-	pipeReader, pipeWriter := io.Pipe()
+	return TarWithOptions(src, TarOptions{Compression: compression})
+}
 
-	compressed, err := CompressStream(pipeWriter, compression)
+func TarWithOptions(src string, options TarOptions) (io.ReadCloser, error) {
+	matcher, err := ignore.NewMatcher(options.ExcludePatterns)
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
-		tr := tar.NewWriter(compressed)
-
-		defer func() {
-			tr.Close()
-			compressed.Close()
-			pipeWriter.Close()
-		}()
-
-		if err := filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+	return TarStream(options.Compression, func(tw *tar.Writer) error {
+		return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
 			if err != nil {
 				return fmt.Errorf("walk: %w", err)
 			}
@@ -106,59 +173,132 @@ func Tar(src string, compression Compression) (io.ReadCloser, error) {
 				return nil
 			}
 
-			fi, err := os.Lstat(path)
-			if err != nil {
-				return fmt.Errorf("lstat: %w", err)
-			}
-
-			var link string
-			if fi.Mode()&os.ModeSymlink != 0 {
-				link, err = os.Readlink(path)
-				if err != nil {
-					return fmt.Errorf("readlink: %w", err)
+			if matcher.Matches(relPath) {
+				// Re-included paths may still be found below an excluded
+				// directory.
+				if d.IsDir() && !matcher.Exclusions() {
+					return filepath.SkipDir
 				}
+				return nil
 			}
 
-			header, err := tar.FileInfoHeader(fi, link)
-			if err != nil {
-				return fmt.Errorf("header: %w", err)
-			}
+			return WriteEntry(tw, path, relPath)
+		})
+	})
+}
+
+// TarStream returns the compressed output of a tar stream written by fn.
+// An error returned by fn is passed on to the reader.
+func TarStream(compression Compression, fn func(tw *tar.Writer) error) (io.ReadCloser, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	compressed, err := CompressStream(pipeWriter, compression)
+	if err != nil {
+		return nil, err
+	}
 
-			header.Name = relPath
+	go func() {
+		tw := tar.NewWriter(compressed)
 
-			if err := tr.WriteHeader(header); err != nil {
-				return fmt.Errorf("write header: %w", err)
+		err := fn(tw)
+
+		if closeErr := tw.Close(); err == nil {
+			err = closeErr
+		}
+		if compressed != io.WriteCloser(pipeWriter) {
+			if closeErr := compressed.Close(); err == nil {
+				err = closeErr
 			}
+		}
+		pipeWriter.CloseWithError(err)
+	}()
 
-			if header.Typeflag == tar.TypeReg {
-				file, err := os.Open(path)
-				if err != nil {
-					return fmt.Errorf("open: %w", err)
-				}
+	return pipeReader, nil
+}
 
-				_, err = io.Copy(tr, file)
-				file.Close()
-				if err != nil {
-					return fmt.Errorf("copy: %w", err)
-				}
+// WriteEntry writes the file at path, with its metadata and contents, to
+// the tar stream under name.
+func WriteEntry(tw *tar.Writer, path, name string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("lstat: %w", err)
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("readlink: %w", err)
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+
+	header.Name = name
+
+	// Extended attributes carry file capabilities and POSIX ACLs
+	// (system.posix_acl_*) as well as user attributes.
+	if header.Typeflag != tar.TypeSymlink {
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return fmt.Errorf("xattrs: %w", err)
+		}
+		for name, value := range xattrs {
+			// Overlay bookkeeping such as opaque markers is expressed
+			// with whiteouts in layers instead.
+			if strings.HasPrefix(name, "trusted.overlay.") || strings.HasPrefix(name, "user.overlay.") {
+				continue
 			}
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[paxXattrPrefix+name] = value
+		}
+	}
 
-			return nil
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
 
-		}); err != nil {
-			fmt.Println(err)
+	if header.Typeflag == tar.TypeReg {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("open: %w", err)
 		}
-	}()
 
-	return pipeReader, nil
+		_, err = io.Copy(tw, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("copy: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type UntarOptions struct {
+	// NoSetuid clears setuid and setgid bits on extracted files.
+	NoSetuid bool
+	// MaxBytes caps the total size of extracted file contents. Zero means
+	// no limit.
+	MaxBytes int64
 }
 
-func Untar(src io.Reader, dst string) error {
+func Untar(src io.Reader, dst string, options UntarOptions) error {
 	decompressed, _, err := DecompressStream(src)
 	if err != nil {
 		return err
 	}
 
+	var extracted int64
+	var dirs []*tar.Header
+
+	// Ownership is only restored when running privileged.
+	chown := isPrivileged()
+
 	tr := tar.NewReader(decompressed)
 	for {
 		header, err := tr.Next()
@@ -169,45 +309,183 @@ func Untar(src io.Reader, dst string) error {
 			return fmt.Errorf("tar read: %w", err)
 		}
 
-		header.Name = filepath.Clean(header.Name)
+		path, err := entryPath(dst, header.Name)
+		if err != nil {
+			return fmt.Errorf("resolving %s: %w", header.Name, err)
+		}
+
+		if path == dst {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
 
-		path := filepath.Join(dst, header.Name)
-		fi := header.FileInfo()
-		mask := fi.Mode()
+		// Existing entries are replaced rather than written through, so a
+		// symlink planted by an earlier entry can't redirect this one.
+		if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && header.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return fmt.Errorf("remove: %w", err)
+			}
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if fi, err := os.Lstat(path); !(err == nil && fi.IsDir()) {
-				if err := os.MkdirAll(path, mask); err != nil {
-					return fmt.Errorf("mkdir: %w", err)
-				}
+			// Directories stay writable until every entry is extracted;
+			// their final mode and times are applied at the end.
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return fmt.Errorf("mkdir: %w", err)
 			}
 		case tar.TypeReg:
-			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, mask)
+			if options.MaxBytes > 0 && extracted+header.Size > options.MaxBytes {
+				return fmt.Errorf("extracted size exceeds limit of %d bytes", options.MaxBytes)
+			}
+			extracted += header.Size
+
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
 			if err != nil {
 				return fmt.Errorf("open: %w", err)
 			}
-			if _, err := io.Copy(file, tr); err != nil {
+			if _, err := io.CopyN(file, tr, header.Size); err != nil {
 				file.Close()
 				return fmt.Errorf("copy: %w", err)
 			}
 			file.Close()
-		case tar.TypeSymlink:
-			targetPath := filepath.Join(filepath.Dir(path), header.Linkname)
-			if !strings.HasPrefix(targetPath, dst) {
-				return fmt.Errorf("symlink: %w", err)
+		case tar.TypeLink:
+			target, err := entryPath(dst, header.Linkname)
+			if err != nil {
+				return fmt.Errorf("resolving %s: %w", header.Linkname, err)
+			}
+			if err := os.Link(target, path); err != nil {
+				return fmt.Errorf("link: %w", err)
 			}
+			continue
+		case tar.TypeSymlink:
 			if err := os.Symlink(header.Linkname, path); err != nil {
 				return fmt.Errorf("symlink: %w", err)
 			}
+		case tar.TypeChar, tar.TypeBlock:
+			if !isPrivileged() {
+				continue
+			}
+			if err := mknod(path, header); err != nil {
+				return fmt.Errorf("mknod: %w", err)
+			}
+		case tar.TypeFifo:
+			if err := mknod(path, header); err != nil {
+				return fmt.Errorf("mkfifo: %w", err)
+			}
+		case tar.TypeXGlobalHeader:
+			continue
 		default:
 			return fmt.Errorf("unsupported type: %d", header.Typeflag)
 		}
+
+		if chown {
+			if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+				return fmt.Errorf("chown: %w", err)
+			}
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, header)
+			continue
+		}
+
+		if err := restoreMetadata(path, header, options); err != nil {
+			return err
+		}
+	}
+
+	// Whatever follows the end of the archive is read too, so that the
+	// compression and the source are checked up to EOF.
+	if _, err := io.Copy(io.Discard, decompressed); err != nil {
+		return fmt.Errorf("reading past end of archive: %w", err)
+	}
+
+	// Parents come before their children in the archive, so restoring in
+	// reverse keeps a directory's mtime from being bumped by its children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path, err := entryPath(dst, dirs[i].Name)
+		if err != nil {
+			return fmt.Errorf("resolving %s: %w", dirs[i].Name, err)
+		}
+		// A later entry may have replaced the directory, with a symlink
+		// for instance, which chmod and chtimes would follow out of dst.
+		if fi, err := os.Lstat(path); err != nil || !fi.IsDir() {
+			continue
+		}
+		if err := restoreMetadata(path, dirs[i], options); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreMetadata applies mode, xattrs and timestamps from the header. It
+// runs after chown, which would otherwise clear setuid bits.
+func restoreMetadata(path string, header *tar.Header, options UntarOptions) error {
+	if header.Typeflag == tar.TypeSymlink {
+		if err := lutimes(path, header.AccessTime, header.ModTime); err != nil {
+			return fmt.Errorf("lutimes: %w", err)
+		}
+		return nil
+	}
+
+	mask := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if options.NoSetuid {
+		mask &^= os.ModeSetuid | os.ModeSetgid
+	}
+
+	if err := os.Chmod(path, mask); err != nil {
+		return fmt.Errorf("chmod: %w", err)
+	}
+
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := setXattr(path, name, value); err != nil {
+			return fmt.Errorf("setxattr %s on %s: %w", name, header.Name, err)
+		}
+	}
+
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+
+	if err := os.Chtimes(path, accessTime, header.ModTime); err != nil {
+		return fmt.Errorf("chtimes: %w", err)
 	}
 
 	return nil
 }
 
+// entryPath resolves the archive entry name inside root. Parent directories
+// are resolved with symlinks scoped to root, the last component is never
+// followed.
+func entryPath(root, name string) (string, error) {
+	name = filepath.Clean(string(filepath.Separator) + name)
+	if name == string(filepath.Separator) {
+		return root, nil
+	}
+
+	parent, err := internalfilepath.SecureJoin(root, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(parent, filepath.Base(name)), nil
+}
+
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
+
 func IsArchivePath(path string) bool {
 	file, err := os.Open(path)
 	if err != nil {
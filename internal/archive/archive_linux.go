@@ -0,0 +1,112 @@
+//go:build linux
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func mknod(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+
+	return syscall.Mknod(path, mode, int(mkdev(header.Devmajor, header.Devminor)))
+}
+
+func mkdev(major, minor int64) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return (ma&0x00000fff)<<8 | (ma&0xfffff000)<<32 | (mi & 0x000000ff) | (mi&0xffffff00)<<12
+}
+
+func readXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		valueSize, err := syscall.Getxattr(path, string(name), nil)
+		if err == syscall.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, valueSize)
+		valueSize, err = syscall.Getxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[string(name)] = string(value[:valueSize])
+	}
+
+	return xattrs, nil
+}
+
+// setXattr sets an extended attribute. Filesystems without xattr support,
+// and attributes in namespaces an unprivileged user can't write, such as
+// security.capability, are skipped.
+func setXattr(path, name, value string) error {
+	err := syscall.Setxattr(path, name, []byte(value), 0)
+	if err == syscall.ENOTSUP || (err == syscall.EPERM && !isPrivileged()) {
+		return nil
+	}
+	return err
+}
+
+func lutimes(path string, atime, mtime time.Time) error {
+	if atime.IsZero() {
+		atime = mtime
+	}
+
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	ts := []syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	dirfd := _AT_FDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), _AT_SYMLINK_NOFOLLOW, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+const (
+	_AT_FDCWD            = -0x64
+	_AT_SYMLINK_NOFOLLOW = 0x100
+)
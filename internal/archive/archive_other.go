@@ -0,0 +1,26 @@
+//go:build !linux
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+func mknod(path string, header *tar.Header) error {
+	return fmt.Errorf("special files are not supported on %s", runtime.GOOS)
+}
+
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func setXattr(path, name, value string) error {
+	return nil
+}
+
+func lutimes(path string, atime, mtime time.Time) error {
+	return nil
+}
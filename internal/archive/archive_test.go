@@ -0,0 +1,306 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type entry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	linkname string
+	body     string
+}
+
+func makeTar(t *testing.T, entries []entry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		header := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     mode,
+			Linkname: e.linkname,
+			Size:     int64(len(e.body)),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestUntarDirReplacedBySymlink(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.Chmod(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	arch := makeTar(t, []entry{
+		{name: "a/", typeflag: tar.TypeDir, mode: 0777},
+		{name: "a", typeflag: tar.TypeSymlink, linkname: outside},
+	})
+
+	dst := t.TempDir()
+	if err := Untar(arch, dst, UntarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0755 {
+		t.Errorf("mode of directory outside dst changed to %v", fi.Mode().Perm())
+	}
+
+	if fi, err := os.Lstat(filepath.Join(dst, "a")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("a isn't a symlink: %v, %v", fi, err)
+	}
+}
+
+// tree describes the files below a directory: "dir", "file:<contents>" or
+// "symlink:<target>" by slash separated relative path.
+func tree(t *testing.T, root string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case d.IsDir():
+			files[rel] = "dir"
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			files[rel] = "symlink:" + target
+		default:
+			contents, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			files[rel] = "file:" + string(contents)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestUntar(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []entry
+		options UntarOptions
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "parent traversal stays in dst",
+			entries: []entry{
+				{name: "../../escape", typeflag: tar.TypeReg, body: "x"},
+				{name: "a/../../b", typeflag: tar.TypeReg, body: "y"},
+			},
+			want: map[string]string{"escape": "file:x", "b": "file:y"},
+		},
+		{
+			name: "absolute name stays in dst",
+			entries: []entry{
+				{name: "/etc/passwd", typeflag: tar.TypeReg, body: "root"},
+			},
+			want: map[string]string{"etc": "dir", "etc/passwd": "file:root"},
+		},
+		{
+			name: "symlinked parent is resolved in dst",
+			entries: []entry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "/"},
+				{name: "link/file", typeflag: tar.TypeReg, body: "x"},
+			},
+			want: map[string]string{"link": "symlink:/", "file": "file:x"},
+		},
+		{
+			name: "relative symlink out of dst is resolved in dst",
+			entries: []entry{
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "../../.."},
+				{name: "link/file", typeflag: tar.TypeReg, body: "x"},
+			},
+			want: map[string]string{"link": "symlink:../../..", "file": "file:x"},
+		},
+		{
+			name: "file replaces symlink instead of writing through it",
+			entries: []entry{
+				{name: "target", typeflag: tar.TypeReg, body: "old"},
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "target"},
+				{name: "link", typeflag: tar.TypeReg, body: "new"},
+			},
+			want: map[string]string{"target": "file:old", "link": "file:new"},
+		},
+		{
+			name: "hardlink",
+			entries: []entry{
+				{name: "a", typeflag: tar.TypeReg, body: "x"},
+				{name: "b", typeflag: tar.TypeLink, linkname: "a"},
+			},
+			want: map[string]string{"a": "file:x", "b": "file:x"},
+		},
+		{
+			name: "hardlink target traversal stays in dst",
+			entries: []entry{
+				{name: "a", typeflag: tar.TypeReg, body: "x"},
+				{name: "b", typeflag: tar.TypeLink, linkname: "../../a"},
+			},
+			want: map[string]string{"a": "file:x", "b": "file:x"},
+		},
+		{
+			name: "hardlink to missing target",
+			entries: []entry{
+				{name: "b", typeflag: tar.TypeLink, linkname: "missing"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "whiteouts are kept as files",
+			entries: []entry{
+				{name: "a/", typeflag: tar.TypeDir, mode: 0755},
+				{name: "a/.wh..wh..opq", typeflag: tar.TypeReg},
+				{name: ".wh.b", typeflag: tar.TypeReg},
+			},
+			want: map[string]string{"a": "dir", "a/.wh..wh..opq": "file:", ".wh.b": "file:"},
+		},
+		{
+			name: "size limit",
+			entries: []entry{
+				{name: "a", typeflag: tar.TypeReg, body: "12345"},
+				{name: "b", typeflag: tar.TypeReg, body: "67890"},
+			},
+			options: UntarOptions{MaxBytes: 8},
+			wantErr: true,
+		},
+		{
+			name: "within size limit",
+			entries: []entry{
+				{name: "a", typeflag: tar.TypeReg, body: "12345"},
+			},
+			options: UntarOptions{MaxBytes: 5},
+			want:    map[string]string{"a": "file:12345"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// dst is nested so that escaping entries would land in parent.
+			parent := t.TempDir()
+			dst := filepath.Join(parent, "a", "b", "dst")
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Untar(makeTar(t, test.entries), dst, test.options)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("Untar succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tree(t, dst); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("extracted %v, want %v", got, test.want)
+			}
+
+			want := map[string]string{"a": "dir", "a/b": "dir", "a/b/dst": "dir"}
+			got := tree(t, parent)
+			for rel := range got {
+				if strings.HasPrefix(rel, "a/b/dst/") {
+					delete(got, rel)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("files written outside dst: %v", got)
+			}
+		})
+	}
+}
+
+func TestUntarNoSetuid(t *testing.T) {
+	arch := makeTar(t, []entry{
+		{name: "suid", typeflag: tar.TypeReg, mode: 04755},
+		{name: "sgid", typeflag: tar.TypeReg, mode: 02755},
+	})
+
+	dst := t.TempDir()
+	if err := Untar(arch, dst, UntarOptions{NoSetuid: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"suid", "sgid"} {
+		fi, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 || fi.Mode().Perm() != 0755 {
+			t.Errorf("mode of %s is %v, want -rwxr-xr-x", name, fi.Mode())
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Compression
+		wantErr bool
+	}{
+		{name: "", want: Uncompressed},
+		{name: "none", want: Uncompressed},
+		{name: "gzip", want: Gzip},
+		{name: "zstd", want: Zstd},
+		{name: "bzip2", wantErr: true},
+		{name: "xz", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseCompression(test.name)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseCompression(%q) error = %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("ParseCompression(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package builder
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/changes"
+	"github.com/pkorzh/container-build-tool/internal/ignore"
+	"github.com/pkorzh/container-build-tool/internal/workdir"
+)
+
+type AddOptions struct {
+	Sources []string
+	// Dest is resolved against the image's working directory when it's
+	// relative. A trailing slash marks it as a directory.
+	Dest string
+	// Layer names the layer to add to; a new layer is created when it's
+	// empty.
+	Layer string
+	// UID and GID, when not negative, own the added files. Setting them
+	// needs privileges, as the ownership of files only reaches the layer
+	// directory when running privileged.
+	UID int
+	GID int
+	// Mode, when set, replaces the permissions of the added files.
+	Mode *os.FileMode
+	// NoSetuid clears setuid and setgid bits of the added files.
+	NoSetuid bool
+	// MaxArchiveBytes, when positive, caps the extracted size of each
+	// source archive.
+	MaxArchiveBytes int64
+	// CreatedBy and Comment are recorded in the image history.
+	CreatedBy string
+	Comment   string
+}
+
+type addItem struct {
+	src  string
+	name string
+}
+
+// Add copies files from the host into a layer of the working container with
+// Docker COPY semantics: directories have their contents copied, globs are
+// expanded and local tar archives are extracted into the destination.
+func (b *Builder) Add(options AddOptions) (string, error) {
+	workDir, err := workdir.GetWorkingContainerDir(b.WorkDirID)
+	if err != nil {
+		return "", fmt.Errorf("getting workdir: %w", err)
+	}
+
+	if (options.UID >= 0 || options.GID >= 0) && os.Geteuid() != 0 {
+		return "", errors.New("setting the owner of added files requires running as root")
+	}
+
+	layersDir := filepath.Join(workDir, "layers")
+
+	var sources []string
+	for _, pattern := range options.Sources {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", fmt.Errorf("expanding %s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return "", fmt.Errorf("no source files were specified by %s", pattern)
+		}
+		sources = append(sources, matches...)
+	}
+
+	// "." and ".." name directories too, although joining them with the
+	// working directory drops what marks them as such.
+	destIsDir := strings.HasSuffix(options.Dest, "/") || path.Base(options.Dest) == "." || path.Base(options.Dest) == ".."
+
+	dest := options.Dest
+	if !path.IsAbs(dest) {
+		workingDir := b.OCIImage.Config.WorkingDir
+		if workingDir == "" {
+			workingDir = "/"
+		}
+		dest = path.Join(workingDir, dest)
+	}
+
+	if len(sources) > 1 && !destIsDir {
+		return "", errors.New("when adding more than one source file, the destination must be a directory and end with a /")
+	}
+
+	name := options.Layer
+	if name == "" {
+		name = nextLayerName(layersDir, "add", len(b.Layers)+1)
+	}
+
+	layerDir := filepath.Join(layersDir, name)
+
+	files, err := b.mergedFiles(workDir, name)
+	if err != nil {
+		return "", err
+	}
+
+	destRel, err := changes.ResolvePath(files, strings.TrimPrefix(path.Clean(dest), "/"))
+	if err != nil {
+		return "", fmt.Errorf("resolving %s: %w", dest, err)
+	}
+
+	if info := files[destRel]; info != nil {
+		if info.Mode.IsDir() {
+			destIsDir = true
+		} else if destIsDir {
+			return "", fmt.Errorf("%s is not a directory", dest)
+		}
+	}
+
+	var items []addItem
+	var archives []string
+
+	for _, src := range sources {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case fi.IsDir():
+			excludePatterns, err := ignore.LoadPatterns(src)
+			if err != nil {
+				return "", fmt.Errorf("loading ignore file: %w", err)
+			}
+
+			matcher, err := ignore.NewMatcher(excludePatterns)
+			if err != nil {
+				return "", err
+			}
+
+			err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, err := filepath.Rel(src, p)
+				if err != nil {
+					return err
+				}
+				if rel == "." {
+					return nil
+				}
+				if matcher.Matches(rel) {
+					if d.IsDir() && !matcher.Exclusions() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				items = append(items, addItem{src: p, name: path.Join(destRel, filepath.ToSlash(rel))})
+				return nil
+			})
+			if err != nil {
+				return "", fmt.Errorf("walking %s: %w", src, err)
+			}
+		case archive.IsArchivePath(src):
+			archives = append(archives, src)
+		case destIsDir:
+			items = append(items, addItem{src: src, name: path.Join(destRel, filepath.Base(src))})
+		default:
+			items = append(items, addItem{src: src, name: destRel})
+		}
+	}
+
+	// A layer created here is removed again when adding fails, like a
+	// layer that fails to commit.
+	_, err = os.Stat(layerDir)
+	created := os.IsNotExist(err)
+	if err := os.MkdirAll(layerDir, 0755); err != nil {
+		return "", err
+	}
+
+	discard := func() {
+		if created {
+			os.RemoveAll(layerDir)
+		}
+	}
+
+	stream, err := archive.TarStream(archive.Uncompressed, func(tw *tar.Writer) error {
+		for _, item := range items {
+			if err := archive.WriteEntry(tw, item.src, item.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		discard()
+		return "", err
+	}
+	defer stream.Close()
+
+	if err := untarAdded(stream, layerDir, "", files, options, archive.UntarOptions{NoSetuid: options.NoSetuid}); err != nil {
+		discard()
+		return "", fmt.Errorf("copying into layer: %w", err)
+	}
+
+	for _, src := range archives {
+		if err := extractInto(src, layerDir, destRel, files, options); err != nil {
+			discard()
+			return "", err
+		}
+	}
+
+	if !b.hasLayer(name) {
+		b.Layers = append(b.Layers, name)
+	}
+
+	createdBy := options.CreatedBy
+	if createdBy == "" {
+		createdBy = fmt.Sprintf("cbt add %s %s", strings.Join(options.Sources, " "), options.Dest)
+	}
+	b.addLayerHistory(name, createdBy, options.Comment)
+
+	return name, nil
+}
+
+func (b *Builder) hasLayer(name string) bool {
+	for _, layer := range b.Layers {
+		if layer == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mergedFiles lists the files of the merged image: the base image layers,
+// the layers of the working container and the layer added to.
+func (b *Builder) mergedFiles(workDir, layer string) (map[string]*changes.FileInfo, error) {
+	img, err := openImageSource(b.FromImage, b.Platform)
+	if err != nil {
+		return nil, err
+	}
+	defer img.reader.Close()
+
+	layers := blobOpeners(img.reader, img.manifest.Layers)
+	for _, name := range b.Layers {
+		layers = append(layers, layerDirOpener(workDir, name))
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "layers", layer)); err == nil && !b.hasLayer(layer) {
+		layers = append(layers, layerDirOpener(workDir, layer))
+	}
+
+	files, err := changes.MergeLayerStreams(layers)
+	if err != nil {
+		return nil, fmt.Errorf("reading image files: %w", err)
+	}
+
+	return files, nil
+}
+
+func extractInto(src, layerDir, destRel string, files map[string]*changes.FileInfo, options AddOptions) error {
+	arch, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer arch.Close()
+
+	untarOptions := archive.UntarOptions{
+		NoSetuid: options.NoSetuid,
+		MaxBytes: options.MaxArchiveBytes,
+	}
+
+	if err := untarAdded(arch, layerDir, destRel, files, options, untarOptions); err != nil {
+		return fmt.Errorf("extracting %s: %w", src, err)
+	}
+
+	return nil
+}
+
+// untarAdded extracts a tar stream into the layer with its entries moved
+// below prefix. Symlinked directories of the merged image are followed
+// rather than replaced, and files is updated with the extracted entries.
+// The ownership and permissions of options are set on the entries rather
+// than on the extracted files, so they're applied the same way as for
+// committed layers.
+func untarAdded(src io.Reader, layerDir, prefix string, files map[string]*changes.FileInfo, options AddOptions, untarOptions archive.UntarOptions) error {
+	decompressed, _, err := archive.DecompressStream(src)
+	if err != nil {
+		return err
+	}
+
+	stream, err := archive.TarStream(archive.Uncompressed, func(tw *tar.Writer) error {
+		tr := tar.NewReader(decompressed)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				_, err := io.Copy(io.Discard, decompressed)
+				return err
+			}
+			if err != nil {
+				return fmt.Errorf("tar read: %w", err)
+			}
+
+			name := cleanEntryName(header.Name)
+			// The root of an archive is the destination, which keeps
+			// its own metadata.
+			if name == "" {
+				continue
+			}
+
+			header.Name, err = resolveEntry(files, path.Join(prefix, name), header.Typeflag == tar.TypeDir)
+			if err != nil {
+				return fmt.Errorf("resolving %s: %w", name, err)
+			}
+			// A directory linking to the root adds to the destination.
+			if header.Name == "" {
+				continue
+			}
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname, err = resolveEntry(files, path.Join(prefix, cleanEntryName(header.Linkname)), false)
+				if err != nil {
+					return fmt.Errorf("resolving %s: %w", header.Linkname, err)
+				}
+			}
+
+			if options.UID >= 0 {
+				header.Uid = options.UID
+				header.Uname = ""
+			}
+			if options.GID >= 0 {
+				header.Gid = options.GID
+				header.Gname = ""
+			}
+			if options.Mode != nil && header.Typeflag != tar.TypeSymlink && header.Typeflag != tar.TypeLink {
+				header.Mode = int64(options.Mode.Perm())
+			}
+
+			files[header.Name] = changes.HeaderInfo(header)
+
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("write header: %w", err)
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return fmt.Errorf("copy: %w", err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	return archive.Untar(stream, layerDir, untarOptions)
+}
+
+// resolveEntry resolves the parent directories of an entry in the merged
+// image. A directory entry is merged into the directory a symlink of the
+// same name points to, while other entries replace the symlink.
+func resolveEntry(files map[string]*changes.FileInfo, rel string, isDir bool) (string, error) {
+	if isDir {
+		resolved, err := changes.ResolvePath(files, rel)
+		if err != nil {
+			return "", err
+		}
+		if info := files[resolved]; info == nil || info.Mode.IsDir() {
+			return resolved, nil
+		}
+	}
+
+	dir, err := changes.ResolvePath(files, path.Dir(rel))
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, path.Base(rel)), nil
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
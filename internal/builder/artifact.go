@@ -0,0 +1,249 @@
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+// DefaultArtifactFileType is the media type of artifact files that don't
+// name their own.
+const DefaultArtifactFileType = "application/octet-stream"
+
+type ArtifactFile struct {
+	Path      string
+	MediaType string
+}
+
+type PushArtifactOptions struct {
+	Target             string
+	ArtifactType       string
+	Files              []ArtifactFile
+	Annotations        map[string]string
+	ArchiveCompression archive.Compression
+	// Subject, when set, is the image the artifact is attached to.
+	Subject string
+}
+
+// PushArtifact writes an artifact manifest with an empty config and one
+// layer per file, titled with the file name.
+func PushArtifact(options PushArtifactOptions) (imgspecv1.Descriptor, error) {
+	if options.ArtifactType == "" {
+		return imgspecv1.Descriptor{}, errors.New("an artifact type is required")
+	}
+
+	var subject *imgspecv1.Descriptor
+	if options.Subject != "" {
+		descriptor, err := resolveSubject(options.Subject)
+		if err != nil {
+			return imgspecv1.Descriptor{}, err
+		}
+		subject = &descriptor
+	}
+
+	dstImageRef, err := image.ParseReference(options.Target)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	dstImageWriter, err := dstImageRef.NewImageWriter(types.ImageWriterOptions{
+		ArchiveCompression: options.ArchiveCompression,
+	})
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("creating image writer: %w", err)
+	}
+	defer dstImageWriter.Close()
+
+	config := imgspecv1.DescriptorEmptyJSON
+	if _, err := dstImageWriter.PutBlob(bytes.NewReader(config.Data), types.PutBlobOptions{
+		MediaType: config.MediaType,
+		Digest:    config.Digest,
+		Size:      config.Size,
+	}); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("putting config: %w", err)
+	}
+
+	var layers []imgspecv1.Descriptor
+	for _, file := range options.Files {
+		layer, err := putArtifactFile(dstImageWriter, file)
+		if err != nil {
+			return imgspecv1.Descriptor{}, err
+		}
+		layers = append(layers, layer)
+	}
+	// Manifests need at least one layer; artifacts without files get the
+	// empty blob.
+	if len(layers) == 0 {
+		layers = append(layers, config)
+	}
+
+	annotations := map[string]string{
+		imgspecv1.AnnotationCreated: time.Now().UTC().Format(time.RFC3339),
+	}
+	for key, value := range options.Annotations {
+		annotations[key] = value
+	}
+
+	manifest := imgspecv1.Manifest{
+		Versioned: imgspec.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: options.ArtifactType,
+		Config:       config,
+		Layers:       layers,
+		Subject:      subject,
+		Annotations:  annotations,
+	}
+
+	descriptor, err := dstImageWriter.PutManifestBlob(manifest)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("putting manifest: %w", err)
+	}
+
+	if err := dstImageWriter.Save(); err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("saving artifact: %w", err)
+	}
+
+	return descriptor, nil
+}
+
+func resolveSubject(name string) (imgspecv1.Descriptor, error) {
+	ref, err := image.ParseReference(name)
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("parsing subject reference: %w", err)
+	}
+
+	reader, err := ref.NewImageReader(types.ImageReaderOptions{})
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("creating image reader for subject: %w", err)
+	}
+	defer reader.Close()
+
+	descriptor := reader.ManifestDescriptor()
+
+	return imgspecv1.Descriptor{
+		MediaType: descriptor.MediaType,
+		Digest:    descriptor.Digest,
+		Size:      descriptor.Size,
+	}, nil
+}
+
+func putArtifactFile(writer types.ImageWriter, file ArtifactFile) (imgspecv1.Descriptor, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil {
+		return imgspecv1.Descriptor{}, err
+	} else if !fi.Mode().IsRegular() {
+		return imgspecv1.Descriptor{}, fmt.Errorf("%s is not a regular file", file.Path)
+	}
+
+	mediaType := file.MediaType
+	if mediaType == "" {
+		mediaType = DefaultArtifactFileType
+	}
+
+	descriptor, err := writer.PutBlob(f, types.PutBlobOptions{
+		MediaType: mediaType,
+		Annotations: map[string]string{
+			imgspecv1.AnnotationTitle: filepath.Base(file.Path),
+		},
+	})
+	if err != nil {
+		return imgspecv1.Descriptor{}, fmt.Errorf("putting %s: %w", file.Path, err)
+	}
+
+	return descriptor, nil
+}
+
+// ParseArtifactFile parses a file given as path[:mediatype].
+func ParseArtifactFile(s string) ArtifactFile {
+	if i := strings.LastIndex(s, ":"); i > 0 && strings.Contains(s[i+1:], "/") {
+		return ArtifactFile{Path: s[:i], MediaType: s[i+1:]}
+	}
+	return ArtifactFile{Path: s}
+}
+
+type PullArtifactOptions struct {
+	Source string
+	// Output is the directory the files are written to.
+	Output string
+}
+
+// PullArtifact writes the files of an artifact to a directory under their
+// titles, returning the paths written.
+func PullArtifact(options PullArtifactOptions) ([]string, error) {
+	ref, err := image.ParseReference(options.Source)
+	if err != nil {
+		return nil, fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	reader, err := ref.NewImageReader(types.ImageReaderOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating image reader: %w", err)
+	}
+	defer reader.Close()
+
+	manifest, err := reader.GetManifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	var files []imgspecv1.Descriptor
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == imgspecv1.MediaTypeEmptyJSON {
+			continue
+		}
+
+		title := layer.Annotations[imgspecv1.AnnotationTitle]
+		if title == "" {
+			return nil, fmt.Errorf("layer %s has no title", layer.Digest)
+		}
+		if !filepath.IsLocal(title) {
+			return nil, fmt.Errorf("layer %s has an unsafe title %q", layer.Digest, title)
+		}
+		files = append(files, layer)
+	}
+
+	var written []string
+	for _, file := range files {
+		dst := filepath.Join(options.Output, file.Annotations[imgspecv1.AnnotationTitle])
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+
+		err := writeOutput(dst, func(f *os.File) error {
+			blob, err := reader.GetBlob(file)
+			if err != nil {
+				return err
+			}
+			defer blob.Close()
+
+			_, err = io.Copy(f, blob)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("writing %s: %w", dst, err)
+		}
+
+		written = append(written, dst)
+	}
+
+	return written, nil
+}
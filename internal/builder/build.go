@@ -1,12 +1,17 @@
 package builder
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
 
 	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/changes"
+	"github.com/pkorzh/container-build-tool/internal/ignore"
 	"github.com/pkorzh/container-build-tool/internal/image"
 	"github.com/pkorzh/container-build-tool/internal/layer"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
 	"github.com/pkorzh/container-build-tool/internal/types"
 	"github.com/pkorzh/container-build-tool/internal/workdir"
 
@@ -14,12 +19,22 @@ import (
 )
 
 func (b *Builder) Build(options BuildOptions) error {
+	format := options.Format
+	if format == "" {
+		format = manifest.FormatOCI
+	}
+	if format == manifest.FormatDocker && options.Compression == archive.Zstd {
+		return errors.New("Docker v2 manifests can't hold zstd compressed layers")
+	}
+
 	dstImageRef, err := image.ParseReference(options.Target)
 	if err != nil {
 		return fmt.Errorf("parsing image reference: %w", err)
 	}
 
-	dstImageWriter, err := dstImageRef.NewImageWriter()
+	dstImageWriter, err := dstImageRef.NewImageWriter(types.ImageWriterOptions{
+		ArchiveCompression: options.ArchiveCompression,
+	})
 	if err != nil {
 		return fmt.Errorf("creating image reader: %w", err)
 	}
@@ -30,27 +45,114 @@ func (b *Builder) Build(options BuildOptions) error {
 		return fmt.Errorf("parsing image reference: %w", err)
 	}
 
-	srcImageReader, err := srcImageRef.NewImageReader()
+	srcImageReader, err := srcImageRef.NewImageReader(types.ImageReaderOptions{Platform: b.Platform})
 	if err != nil {
 		return fmt.Errorf("creating image reader: %w", err)
 	}
 	defer srcImageReader.Close()
 
-	rootFSLayers, err := b.copyRootFsBlobs(dstImageWriter, srcImageReader)
+	srcImage, err := srcImageReader.GetImage()
+	if err != nil {
+		return fmt.Errorf("getting image: %w", err)
+	}
+
+	// A layer named more than once is added once, where it's first named.
+	var layerDirNames []string
+	seen := make(map[string]bool)
+	for _, name := range append(append([]string{}, b.Layers...), options.Layers...) {
+		if !seen[name] {
+			seen[name] = true
+			layerDirNames = append(layerDirNames, name)
+		}
+	}
+	if len(layerDirNames) == 0 {
+		return errors.New("no layers to add to the image")
+	}
+
+	workDir, err := workdir.GetWorkingContainerDir(b.WorkDirID)
 	if err != nil {
-		return fmt.Errorf("copying rootfs blobs: %w", err)
+		return fmt.Errorf("getting workdir: %w", err)
+	}
+
+	history := b.imageHistory(layerDirNames)
+
+	switch {
+	case options.SquashAll:
+		srcManifest, err := srcImageReader.GetManifest()
+		if err != nil {
+			return fmt.Errorf("getting manifest: %w", err)
+		}
+
+		openers := blobOpeners(srcImageReader, srcManifest.Layers)
+		for _, name := range layerDirNames {
+			openers = append(openers, layerDirOpener(workDir, name))
+		}
+
+		squashed, err := putSquashedLayer(dstImageWriter, openers, false, options.Compression, options.Jobs)
+		if err != nil {
+			return fmt.Errorf("squashing layers: %w", err)
+		}
+
+		b.addLayers([]layer.LayerInfo{squashed})
+		history = squashHistory(append(baseHistory(srcImage), history...), "cbt build --squash-all", len(openers))
+	case options.Squash:
+		rootFSLayers, err := b.copyRootFsBlobs(dstImageWriter, srcImageReader, options.Jobs)
+		if err != nil {
+			return fmt.Errorf("copying rootfs blobs: %w", err)
+		}
+
+		var openers []changes.LayerOpener
+		for _, name := range layerDirNames {
+			openers = append(openers, layerDirOpener(workDir, name))
+		}
+
+		squashed, err := putSquashedLayer(dstImageWriter, openers, true, options.Compression, options.Jobs)
+		if err != nil {
+			return fmt.Errorf("squashing layers: %w", err)
+		}
+
+		b.addLayers(rootFSLayers)
+		b.addLayers([]layer.LayerInfo{squashed})
+		history = append(baseHistory(srcImage), squashHistory(history, "cbt build --squash", len(openers))...)
+	default:
+		rootFSLayers, err := b.copyRootFsBlobs(dstImageWriter, srcImageReader, options.Jobs)
+		if err != nil {
+			return fmt.Errorf("copying rootfs blobs: %w", err)
+		}
+
+		usersLayers, err := b.copyUsersFsBlobs(layerDirNames, dstImageWriter, options.Compression, options.Jobs)
+		if err != nil {
+			return fmt.Errorf("copying users blobs: %w", err)
+		}
+
+		b.addLayers(rootFSLayers)
+		b.addLayers(usersLayers)
+		history = append(baseHistory(srcImage), history...)
+	}
+
+	b.OCIImage.History = history
+
+	// Docker v2 manifests have no annotations to record the base image in.
+	if format == manifest.FormatOCI {
+		if b.OCIManifest.Annotations == nil {
+			b.OCIManifest.Annotations = make(map[string]string)
+		}
+		b.OCIManifest.Annotations[imgspecv1.AnnotationBaseImageName] = b.FromImage
+		b.OCIManifest.Annotations[imgspecv1.AnnotationBaseImageDigest] = srcImageReader.ManifestDescriptor().Digest.String()
 	}
 
-	usersLayers, err := b.copyUsersFsBlobs(options.Layers, dstImageWriter)
+	dstManifest, err := manifest.Convert(b.OCIManifest, format)
 	if err != nil {
-		return fmt.Errorf("copying users blobs: %w", err)
+		return fmt.Errorf("converting manifest: %w", err)
 	}
 
-	b.addLayers(rootFSLayers)
-	b.addLayers(usersLayers)
+	if _, err := dstImageWriter.PutImageBlob(*b.OCIImage, dstManifest); err != nil {
+		return fmt.Errorf("putting image: %w", err)
+	}
 
-	dstImageWriter.PutImageBlob(*b.OCIImage, b.OCIManifest)
-	dstImageWriter.PutManifestBlob(*b.OCIManifest)
+	if _, err := dstImageWriter.PutManifestBlob(*dstManifest); err != nil {
+		return fmt.Errorf("putting manifest: %w", err)
+	}
 
 	err = dstImageWriter.Save()
 	if err != nil {
@@ -72,7 +174,7 @@ func (b *Builder) addLayers(layers []layer.LayerInfo) {
 	}
 }
 
-func (b *Builder) copyRootFsBlobs(writer types.ImageWriter, reader types.ImageReader) ([]layer.LayerInfo, error) {
+func (b *Builder) copyRootFsBlobs(writer types.ImageWriter, reader types.ImageReader, jobs int) ([]layer.LayerInfo, error) {
 	srcManifest, err := reader.GetManifest()
 	if err != nil {
 		return nil, err
@@ -83,84 +185,112 @@ func (b *Builder) copyRootFsBlobs(writer types.ImageWriter, reader types.ImageRe
 		return nil, err
 	}
 
-	layerInfos := make([]layer.LayerInfo, 0, len(srcManifest.Layers))
+	layerInfos := make([]layer.LayerInfo, len(srcManifest.Layers))
 
-	for i, layerDescriptor := range srcManifest.Layers {
-		blobReader, err := reader.GetBlob(layerDescriptor.Digest)
+	err = runParallel(len(srcManifest.Layers), jobs, func(i int) error {
+		layerDescriptor := srcManifest.Layers[i]
+
+		blobReader, err := reader.GetBlob(layerDescriptor)
 		if err != nil {
-			return nil, fmt.Errorf("getting blob: %w", err)
+			return fmt.Errorf("getting blob: %w", err)
 		}
 		defer blobReader.Close()
 
 		blobDescriptor, err := writer.PutBlob(blobReader, types.PutBlobOptions{
 			MediaType: layerDescriptor.MediaType,
+			Digest:    layerDescriptor.Digest,
+			Size:      layerDescriptor.Size,
 		})
 		if err != nil {
-			return nil, fmt.Errorf("put blog: %w", err)
-		}
-
-		if layerDescriptor.Digest != blobDescriptor.Digest {
-			return nil, fmt.Errorf("digest mismatch: %s != %s", layerDescriptor.Digest, blobDescriptor.Digest)
+			return fmt.Errorf("put blog: %w", err)
 		}
 
-		layerInfos = append(layerInfos, layer.LayerInfo{
+		layerInfos[i] = layer.LayerInfo{
 			MediaType:          blobDescriptor.MediaType,
 			CompressedDigest:   blobDescriptor.Digest,
 			CompressedSize:     blobDescriptor.Size,
 			UncompressedDigest: srcImage.RootFS.DiffIDs[i],
-		})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return layerInfos, nil
 }
 
-func (b *Builder) copyUsersFsBlobs(layerDirNames []string, writer types.ImageWriter) ([]layer.LayerInfo, error) {
-	var layerInfos []layer.LayerInfo
-
+func (b *Builder) copyUsersFsBlobs(layerDirNames []string, writer types.ImageWriter, compression archive.Compression, jobs int) ([]layer.LayerInfo, error) {
 	workdir, err := workdir.GetWorkingContainerDir(b.WorkDirID)
 	if err != nil {
 		return nil, fmt.Errorf("getting workdir: %w", err)
 	}
 
-	for _, layerDirName := range layerDirNames {
-		layerDir := filepath.Join(workdir, "layers", layerDirName)
+	mediaType, err := layer.MediaType(compression)
+	if err != nil {
+		return nil, err
+	}
 
-		layerInfo, err := func() (layer.LayerInfo, error) {
-			arch, err := archive.Tar(layerDir, archive.Gzip)
-			if err != nil {
-				return layer.LayerInfo{}, fmt.Errorf("archiving layer: %w", err)
-			}
-			defer arch.Close()
+	layerInfos := make([]layer.LayerInfo, len(layerDirNames))
+	compressionJobs := jobsPerTask(len(layerDirNames), jobs)
 
-			descriptor, err := writer.PutBlob(arch, types.PutBlobOptions{
-				MediaType: imgspecv1.MediaTypeImageLayerGzip,
-			})
-			if err != nil {
-				return layer.LayerInfo{}, fmt.Errorf("putting blob: %w", err)
-			}
+	err = runParallel(len(layerDirNames), jobs, func(i int) error {
+		arch, err := layerDirOpener(workdir, layerDirNames[i])()
+		if err != nil {
+			return err
+		}
+		defer arch.Close()
 
-			blob, err := writer.GetBlob(descriptor.Digest)
-			if err != nil {
-				return layer.LayerInfo{}, fmt.Errorf("getting blob: %w", err)
-			}
-			defer blob.Close()
+		layerInfos[i], err = putLayer(writer, arch, mediaType, compression, compressionJobs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			layerInfo, err := layer.GetLayerInfo(blob)
-			if err != nil {
-				return layer.LayerInfo{}, fmt.Errorf("getting layer info: %w", err)
-			}
+	return layerInfos, nil
+}
 
-			layerInfo.MediaType = descriptor.MediaType
+// layerDirOpener archives a layer directory of the working container,
+// leaving out what its ignore file excludes.
+func layerDirOpener(workDir, name string) changes.LayerOpener {
+	return func() (io.ReadCloser, error) {
+		layerDir := filepath.Join(workDir, "layers", name)
 
-			return layerInfo, nil
-		}()
+		excludePatterns, err := ignore.LoadLayerPatterns(layerDir)
+		if err != nil {
+			return nil, fmt.Errorf("loading ignore file: %w", err)
+		}
 
+		arch, err := archive.TarWithOptions(layerDir, archive.TarOptions{
+			ExcludePatterns: excludePatterns,
+		})
 		if err != nil {
-			return nil, fmt.Errorf("archiving: %w", err)
+			return nil, fmt.Errorf("archiving layer: %w", err)
 		}
 
-		layerInfos = append(layerInfos, layerInfo)
+		return arch, nil
 	}
+}
 
-	return layerInfos, nil
+func putLayer(writer types.ImageWriter, uncompressed io.Reader, mediaType string, compression archive.Compression, jobs int) (layer.LayerInfo, error) {
+	compressed := layer.Compress(uncompressed, compression, jobs)
+	defer compressed.Close()
+
+	descriptor, err := writer.PutBlob(compressed, types.PutBlobOptions{
+		MediaType: mediaType,
+	})
+	if err != nil {
+		return layer.LayerInfo{}, fmt.Errorf("archiving: putting blob: %w", err)
+	}
+
+	layerInfo := compressed.LayerInfo()
+	if layerInfo.CompressedDigest != descriptor.Digest {
+		return layer.LayerInfo{}, fmt.Errorf("archiving: digest mismatch: %s != %s", layerInfo.CompressedDigest, descriptor.Digest)
+	}
+
+	layerInfo.MediaType = descriptor.MediaType
+
+	return layerInfo, nil
 }
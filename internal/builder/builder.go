@@ -4,10 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"runtime"
 	"time"
 
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/atomicfile"
 	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/lockfile"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
+	"github.com/pkorzh/container-build-tool/internal/types"
 	"github.com/pkorzh/container-build-tool/internal/workdir"
 
 	imgspec "github.com/opencontainers/image-spec/specs-go"
@@ -16,21 +20,54 @@ import (
 
 type BuilderOptions struct {
 	FromImage string
+	// Name of the working container; one is derived from the image name
+	// when it's empty.
+	Name string
+	// Platform picks the base image out of a multi-platform image.
+	Platform *imgspecv1.Platform
 }
 
 type BuildOptions struct {
-	Target string
-	Layers []string
+	Target             string
+	Layers             []string
+	ArchiveCompression archive.Compression
+	Compression        archive.Compression
+	Jobs               int
+	// Squash merges the layers of the working container into one layer;
+	// SquashAll merges the base image layers into it as well.
+	Squash    bool
+	SquashAll bool
+	// Format is the manifest format of the image, OCI when it's empty.
+	Format manifest.Format
 }
 
 type Builder struct {
+	Version     int                 `json:"version"`
 	FromImage   string              `json:"fromImage"`
 	WorkDirID   string              `json:"workDirId"`
+	Name        string              `json:"name"`
+	Created     time.Time           `json:"created"`
 	OCIImage    *imgspecv1.Image    `json:"ociImage"`
 	OCIManifest *imgspecv1.Manifest `json:"ociManifest"`
+	// Layers are layer directories added to every image built from the
+	// working container, ahead of the ones passed to Build.
+	Layers []string `json:"layers,omitempty"`
+	// History holds the entries added to the image history on build.
+	History []HistoryEntry `json:"history,omitempty"`
+	// Platform the base image was picked for, the default one when it's
+	// nil.
+	Platform *imgspecv1.Platform `json:"platform,omitempty"`
+
+	lock *lockfile.LockFile
+}
+
+func (b *Builder) Close() error {
+	return b.lock.Unlock()
 }
 
 func (b *Builder) Save() error {
+	b.Version = stateVersion
+
 	obj, err := json.Marshal(b)
 	if err != nil {
 		return fmt.Errorf("marshalling builder: %w", err)
@@ -41,7 +78,7 @@ func (b *Builder) Save() error {
 		return fmt.Errorf("getting workdir: %w", err)
 	}
 
-	err = os.WriteFile(workDir+"/builder.json", obj, 0600)
+	err = atomicfile.WriteFile(workDir+"/builder.json", obj, 0600)
 	if err != nil {
 		return fmt.Errorf("writing builder: %w", err)
 	}
@@ -55,13 +92,33 @@ func New(options BuilderOptions) (*Builder, error) {
 		return nil, fmt.Errorf("parsing image reference: %w", err)
 	}
 
-	workDirId := imageRef.ImageName()
+	lock, err := workdir.LockBaseDir()
+	if err != nil {
+		return nil, fmt.Errorf("locking workdir base: %w", err)
+	}
+	defer lock.Unlock()
+
+	name := options.Name
+	if name == "" {
+		name, err = uniqueName(imageRef.ImageName() + "-working-container")
+		if err != nil {
+			return nil, err
+		}
+	} else if err := checkNameAvailable(name); err != nil {
+		return nil, err
+	}
+
+	workDirId, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
 	workDir, err := workdir.NewWorkingContainerDir(workDirId)
 	if err != nil {
 		return nil, fmt.Errorf("creating workdir: %w", err)
 	}
 
-	imageReader, err := imageRef.NewImageReader()
+	imageReader, err := imageRef.NewImageReader(types.ImageReaderOptions{Platform: options.Platform})
 	if err != nil {
 		if err := os.RemoveAll(workDir); err != nil {
 			return nil, fmt.Errorf("removing workdir: %w", err)
@@ -80,15 +137,17 @@ func New(options BuilderOptions) (*Builder, error) {
 		return nil, fmt.Errorf("getting image: %w", err)
 	}
 
-	return &Builder{
+	builder := &Builder{
 		FromImage: options.FromImage,
 		WorkDirID: workDirId,
+		Name:      name,
+		Created:   now,
+		Platform:  options.Platform,
 		OCIImage: &imgspecv1.Image{
-			Created:      &now,
-			OS:           runtime.GOOS,
-			Architecture: runtime.GOARCH,
-			RootFS:       imgspecv1.RootFS{Type: "layers"},
-			Config:       fromImage.Config,
+			Created:  &now,
+			Platform: fromImage.Platform,
+			RootFS:   imgspecv1.RootFS{Type: "layers"},
+			Config:   fromImage.Config,
 		},
 		OCIManifest: &imgspecv1.Manifest{
 			Versioned: imgspec.Versioned{
@@ -96,25 +155,50 @@ func New(options BuilderOptions) (*Builder, error) {
 			},
 			MediaType: imgspecv1.MediaTypeImageManifest,
 		},
-	}, nil
+	}
+
+	// The state is saved while the base directory is still locked so the
+	// name is taken before another working container can claim it.
+	if err := builder.Save(); err != nil {
+		os.RemoveAll(workDir)
+		return nil, err
+	}
+
+	return builder, nil
 }
 
-func Open(workDirID string) (*Builder, error) {
+// Open locks and loads the working container with the given name or ID.
+func Open(nameOrID string) (*Builder, error) {
+	workDirID, err := resolveID(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+
 	workDir, err := workdir.GetWorkingContainerDir(workDirID)
 	if err != nil {
 		return nil, fmt.Errorf("getting workdir: %w", err)
 	}
 
+	// The lock is held until Close so that concurrent commands modifying the
+	// same working container don't overwrite each other's changes.
+	lock, err := lockfile.Lock(workDir)
+	if err != nil {
+		return nil, fmt.Errorf("locking workdir: %w", err)
+	}
+
 	obj, err := os.ReadFile(workDir + "/builder.json")
 	if err != nil {
+		lock.Unlock()
 		return nil, fmt.Errorf("reading builder: %w", err)
 	}
 
-	var builder Builder
-	err = json.Unmarshal(obj, &builder)
+	builder, err := decodeState(obj)
 	if err != nil {
+		lock.Unlock()
 		return nil, fmt.Errorf("unmarshalling builder: %w", err)
 	}
 
-	return &builder, nil
+	builder.lock = lock
+
+	return builder, nil
 }
@@ -0,0 +1,44 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkorzh/container-build-tool/internal/bundle"
+)
+
+type ExportBundleOptions struct {
+	// Source is an image reference or a working container name or ID.
+	Source   string
+	Dir      string
+	Rootless bool
+}
+
+// ExportBundle unpacks an image or working container into an OCI runtime
+// bundle.
+func ExportBundle(options ExportBundleOptions) error {
+	if entries, err := os.ReadDir(options.Dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("bundle directory %s is not empty", options.Dir)
+	}
+
+	source, err := openRootfsSource(options.Source)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	rootfs, err := source.Rootfs()
+	if err != nil {
+		return fmt.Errorf("merging layers: %w", err)
+	}
+	defer rootfs.Close()
+
+	err = bundle.Create(options.Dir, rootfs, source.image, bundle.Options{
+		Rootless: options.Rootless,
+	})
+	if err != nil {
+		return fmt.Errorf("creating bundle: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/changes"
+	"github.com/pkorzh/container-build-tool/internal/workdir"
+)
+
+type ChangesOptions struct {
+	// UpperLayer is the writable overlay layer holding the changes.
+	UpperLayer  string
+	LowerLayers []string
+	// Snapshot is a full copy of the filesystem to compare against the
+	// lower layers instead of an upper layer.
+	Snapshot string
+}
+
+type CommitOptions struct {
+	ChangesOptions
+	// Layer names the new layer; a name is picked when it's empty.
+	Layer string
+	// CreatedBy and Comment are recorded in the image history.
+	CreatedBy string
+	Comment   string
+}
+
+// Changes compares the upper layer, or a snapshot, of the working container
+// to its lower layers. It also returns the directory the changed files are
+// read from.
+func (b *Builder) Changes(options ChangesOptions) (string, []changes.Change, error) {
+	workDir, err := workdir.GetWorkingContainerDir(b.WorkDirID)
+	if err != nil {
+		return "", nil, fmt.Errorf("getting workdir: %w", err)
+	}
+
+	layersDir := filepath.Join(workDir, "layers")
+
+	lowers := make([]string, 0, len(options.LowerLayers))
+	for _, name := range options.LowerLayers {
+		lower := filepath.Join(layersDir, name)
+		if _, err := os.Stat(lower); err != nil {
+			return "", nil, fmt.Errorf("lower layer %s: %w", name, err)
+		}
+		lowers = append(lowers, lower)
+	}
+
+	var root string
+	var diff []changes.Change
+
+	switch {
+	case options.Snapshot != "":
+		root = options.Snapshot
+		diff, err = changes.SnapshotChanges(lowers, root)
+	case options.UpperLayer != "":
+		root = filepath.Join(layersDir, options.UpperLayer)
+		diff, err = changes.UpperChanges(root, lowers)
+	default:
+		return "", nil, errors.New("either an upper layer or a snapshot must be specified")
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("computing changes: %w", err)
+	}
+
+	return root, diff, nil
+}
+
+// Commit captures the changes of the working container as a new layer
+// directory with OCI whiteouts and appends it to the pending layers.
+func (b *Builder) Commit(options CommitOptions) (string, error) {
+	workDir, err := workdir.GetWorkingContainerDir(b.WorkDirID)
+	if err != nil {
+		return "", fmt.Errorf("getting workdir: %w", err)
+	}
+
+	layersDir := filepath.Join(workDir, "layers")
+
+	root, diff, err := b.Changes(options.ChangesOptions)
+	if err != nil {
+		return "", err
+	}
+
+	if len(diff) == 0 {
+		return "", errors.New("no changes to commit")
+	}
+
+	name := options.Layer
+	if name == "" {
+		name = nextLayerName(layersDir, "commit", len(b.Layers)+1)
+	}
+
+	layerDir := filepath.Join(layersDir, name)
+	if _, err := os.Stat(layerDir); !os.IsNotExist(err) {
+		return "", fmt.Errorf("layer %s already exists", name)
+	}
+
+	if err := os.MkdirAll(layerDir, 0755); err != nil {
+		return "", err
+	}
+
+	layer, err := changes.Export(root, diff)
+	if err != nil {
+		os.RemoveAll(layerDir)
+		return "", err
+	}
+	defer layer.Close()
+
+	if err := archive.Untar(layer, layerDir, archive.UntarOptions{}); err != nil {
+		os.RemoveAll(layerDir)
+		return "", fmt.Errorf("writing layer: %w", err)
+	}
+
+	b.Layers = append(b.Layers, name)
+
+	createdBy := options.CreatedBy
+	if createdBy == "" {
+		createdBy = "cbt commit"
+	}
+	b.addLayerHistory(name, createdBy, options.Comment)
+
+	return name, nil
+}
+
+func nextLayerName(layersDir, prefix string, n int) string {
+	for {
+		name := fmt.Sprintf("%s-%d", prefix, n)
+		if _, err := os.Stat(filepath.Join(layersDir, name)); os.IsNotExist(err) {
+			return name
+		}
+		n++
+	}
+}
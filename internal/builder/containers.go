@@ -0,0 +1,209 @@
+package builder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkorzh/container-build-tool/internal/lockfile"
+	"github.com/pkorzh/container-build-tool/internal/workdir"
+)
+
+// Unreadable is a working container whose state can't be loaded, because
+// it's damaged or was written by a newer cbt.
+type Unreadable struct {
+	ID  string
+	Err error
+}
+
+// List loads every working container without locking them. Working
+// containers that can't be loaded are returned apart, so that one of them
+// doesn't hide the others.
+func List() ([]*Builder, []Unreadable, error) {
+	ids, err := workdir.WorkingContainerIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builders := make([]*Builder, 0, len(ids))
+	var unreadable []Unreadable
+	for _, id := range ids {
+		builder, err := load(id)
+		if err != nil {
+			unreadable = append(unreadable, Unreadable{ID: id, Err: err})
+			continue
+		}
+		builders = append(builders, builder)
+	}
+
+	sort.Slice(builders, func(i, j int) bool {
+		return builders[i].Created.Before(builders[j].Created)
+	})
+
+	return builders, unreadable, nil
+}
+
+// Remove deletes the working container with the given name or ID along with
+// its layers. Its state isn't loaded, so unreadable working containers can
+// be removed by ID too.
+func Remove(nameOrID string) error {
+	lock, err := workdir.LockBaseDir()
+	if err != nil {
+		return fmt.Errorf("locking workdir base: %w", err)
+	}
+	defer lock.Unlock()
+
+	workDirID, err := resolveID(nameOrID)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := workdir.GetWorkingContainerDir(workDirID)
+	if err != nil {
+		return fmt.Errorf("getting workdir: %w", err)
+	}
+
+	containerLock, err := lockfile.Lock(workDir)
+	if err != nil {
+		return fmt.Errorf("locking workdir: %w", err)
+	}
+	defer containerLock.Unlock()
+
+	return workdir.RemoveWorkingContainerDir(workDirID)
+}
+
+// Rename gives the working container with the given name or ID a new name.
+func Rename(nameOrID, name string) error {
+	lock, err := workdir.LockBaseDir()
+	if err != nil {
+		return fmt.Errorf("locking workdir base: %w", err)
+	}
+	defer lock.Unlock()
+
+	if err := checkNameAvailable(name); err != nil {
+		return err
+	}
+
+	builder, err := Open(nameOrID)
+	if err != nil {
+		return err
+	}
+	defer builder.Close()
+
+	builder.Name = name
+
+	return builder.Save()
+}
+
+func load(id string) (*Builder, error) {
+	workDir, err := workdir.GetWorkingContainerDir(id)
+	if err != nil {
+		return nil, fmt.Errorf("getting workdir: %w", err)
+	}
+
+	obj, err := os.ReadFile(filepath.Join(workDir, "builder.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading builder: %w", err)
+	}
+
+	builder, err := decodeState(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling builder: %w", err)
+	}
+
+	return builder, nil
+}
+
+// resolveID finds a working container by exact ID, by name or by a unique
+// ID prefix, in that order.
+func resolveID(nameOrID string) (string, error) {
+	ids, err := workdir.WorkingContainerIDs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, id := range ids {
+		if id == nameOrID {
+			return id, nil
+		}
+	}
+
+	builders, _, err := List()
+	if err != nil {
+		return "", err
+	}
+
+	for _, builder := range builders {
+		if builder.Name == nameOrID {
+			return builder.WorkDirID, nil
+		}
+	}
+
+	var matches []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, nameOrID) {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("working container %s does not exist", nameOrID)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("working container ID %s is ambiguous", nameOrID)
+	}
+}
+
+func checkNameAvailable(name string) error {
+	builders, unreadable, err := List()
+	if err != nil {
+		return err
+	}
+
+	for _, builder := range builders {
+		if builder.Name == name || builder.WorkDirID == name {
+			return fmt.Errorf("working container name %s is already in use", name)
+		}
+	}
+
+	for _, u := range unreadable {
+		if u.ID == name {
+			return fmt.Errorf("working container name %s is already in use", name)
+		}
+	}
+
+	return nil
+}
+
+func uniqueName(base string) (string, error) {
+	builders, _, err := List()
+	if err != nil {
+		return "", err
+	}
+
+	taken := make(map[string]bool)
+	for _, builder := range builders {
+		taken[builder.Name] = true
+	}
+
+	name := base
+	for i := 1; taken[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	return name, nil
+}
+
+func newID() (string, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
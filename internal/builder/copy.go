@@ -0,0 +1,96 @@
+package builder
+
+import (
+	"fmt"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type CopyOptions struct {
+	Source             string
+	Target             string
+	ArchiveCompression archive.Compression
+	Jobs               int
+	// Format is the manifest format of the copy; the source format is kept
+	// when it's empty.
+	Format manifest.Format
+	// Platform picks the image copied out of a multi-platform source.
+	Platform *imgspecv1.Platform
+}
+
+// Copy writes the source image to the target, converting its manifest to
+// another format if asked to. Blobs are copied as they are, so the config
+// and layer digests don't change.
+func Copy(options CopyOptions) error {
+	srcImageRef, err := image.ParseReference(options.Source)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	srcImageReader, err := srcImageRef.NewImageReader(types.ImageReaderOptions{Platform: options.Platform})
+	if err != nil {
+		return fmt.Errorf("creating image reader: %w", err)
+	}
+	defer srcImageReader.Close()
+
+	srcManifest, err := srcImageReader.GetManifest()
+	if err != nil {
+		return fmt.Errorf("getting manifest: %w", err)
+	}
+
+	srcFormat, err := manifest.FormatOf(srcManifest)
+	if err != nil {
+		return err
+	}
+
+	// Manifests that stay in their format are copied unchanged, which keeps
+	// artifacts intact.
+	dstManifest := srcManifest
+	if options.Format != "" && options.Format != srcFormat {
+		dstManifest, err = manifest.Convert(srcManifest, options.Format)
+		if err != nil {
+			return fmt.Errorf("converting manifest: %w", err)
+		}
+	}
+
+	dstImageRef, err := image.ParseReference(options.Target)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	dstImageWriter, err := dstImageRef.NewImageWriter(types.ImageWriterOptions{
+		ArchiveCompression: options.ArchiveCompression,
+	})
+	if err != nil {
+		return fmt.Errorf("creating image writer: %w", err)
+	}
+	defer dstImageWriter.Close()
+
+	config, err := copyBlobs(dstImageWriter, srcImageReader, []imgspecv1.Descriptor{dstManifest.Config}, options.Jobs)
+	if err != nil {
+		return fmt.Errorf("copying config: %w", err)
+	}
+
+	layers, err := copyBlobs(dstImageWriter, srcImageReader, dstManifest.Layers, options.Jobs)
+	if err != nil {
+		return fmt.Errorf("copying layers: %w", err)
+	}
+
+	dstManifest.Config = config[0]
+	dstManifest.Layers = layers
+
+	if _, err := dstImageWriter.PutManifestBlob(*dstManifest); err != nil {
+		return fmt.Errorf("putting manifest: %w", err)
+	}
+
+	if err := dstImageWriter.Save(); err != nil {
+		return fmt.Errorf("saving image: %w", err)
+	}
+
+	return nil
+}
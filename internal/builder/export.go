@@ -0,0 +1,175 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/atomicfile"
+	"github.com/pkorzh/container-build-tool/internal/fsimage"
+	"github.com/pkorzh/container-build-tool/internal/tmpdir"
+)
+
+type ExportFormat string
+
+const (
+	ExportTar      ExportFormat = "tar"
+	ExportDir      ExportFormat = "dir"
+	ExportSquashfs ExportFormat = "squashfs"
+	ExportExt4     ExportFormat = "ext4"
+)
+
+type ExportOptions struct {
+	// Source is an image reference or a working container name or ID.
+	Source string
+	// Output is a file, a directory for ExportDir, or "-" for stdout when
+	// writing a tar.
+	Output      string
+	Format      ExportFormat
+	Compression archive.Compression
+}
+
+// Export writes the root filesystem of an image or working container, with
+// its layers merged and whiteouts applied. Filesystem images get a sidecar
+// JSON file next to them holding the image config.
+func Export(options ExportOptions) error {
+	if options.Output == "-" && options.Format != ExportTar {
+		return fmt.Errorf("%s exports can't be written to stdout", options.Format)
+	}
+
+	if options.Format == ExportDir {
+		if entries, err := os.ReadDir(options.Output); err == nil && len(entries) > 0 {
+			return fmt.Errorf("directory %s is not empty", options.Output)
+		}
+	}
+
+	source, err := openRootfsSource(options.Source)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	rootfs, err := source.Rootfs()
+	if err != nil {
+		return fmt.Errorf("merging layers: %w", err)
+	}
+	defer rootfs.Close()
+
+	switch options.Format {
+	case ExportDir:
+		if err := os.MkdirAll(options.Output, 0755); err != nil {
+			return err
+		}
+		if err := archive.Untar(rootfs, options.Output, archive.UntarOptions{}); err != nil {
+			return fmt.Errorf("unpacking rootfs: %w", err)
+		}
+		return nil
+	case ExportTar:
+		return writeOutput(options.Output, func(f *os.File) error {
+			compressed, err := archive.CompressStream(nopWriteCloser{f}, options.Compression)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(compressed, rootfs); err != nil {
+				return err
+			}
+			return compressed.Close()
+		})
+	case ExportSquashfs, ExportExt4:
+		return exportFilesystem(rootfs, source, options)
+	default:
+		return fmt.Errorf("unsupported export format: %s", options.Format)
+	}
+}
+
+func exportFilesystem(rootfs io.Reader, source *rootfsSource, options ExportOptions) error {
+	spool, err := tmpdir.MkTmpFile("fsimage")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	tree, err := fsimage.ReadTar(rootfs, spool)
+	if err != nil {
+		return fmt.Errorf("reading rootfs: %w", err)
+	}
+
+	var modTime time.Time
+	if source.image.Created != nil {
+		modTime = *source.image.Created
+	}
+
+	err = writeOutput(options.Output, func(f *os.File) error {
+		if options.Format == ExportSquashfs {
+			return fsimage.WriteSquashfs(tree, f, modTime)
+		}
+		return fsimage.WriteExt4(tree, f, modTime)
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s image: %w", options.Format, err)
+	}
+
+	config, err := json.MarshalIndent(source.image, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(options.Output+".json", config, 0644)
+}
+
+// writeOutput writes to stdout for "-", otherwise to a temporary file
+// renamed over the output once it's complete.
+func writeOutput(output string, fn func(f *os.File) error) error {
+	if output == "-" {
+		return fn(os.Stdout)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := fn(f); err != nil {
+		return err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), output)
+}
+
+// CompressionForPath picks the compression matching the extension of a file.
+func CompressionForPath(p string) archive.Compression {
+	switch {
+	case strings.HasSuffix(p, ".gz"), strings.HasSuffix(p, ".tgz"):
+		return archive.Gzip
+	case strings.HasSuffix(p, ".zst"), strings.HasSuffix(p, ".tzst"):
+		return archive.Zstd
+	default:
+		return archive.Uncompressed
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package builder
+
+import (
+	"fmt"
+	"time"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// HistoryEntry is a history entry recorded by the working container before
+// it's added to built images.
+type HistoryEntry struct {
+	imgspecv1.History
+	// Layer is the layer directory the entry describes; it's empty for
+	// configuration changes.
+	Layer string `json:"layer,omitempty"`
+}
+
+// AddHistory records a change that doesn't add a layer, such as a
+// configuration change.
+func (b *Builder) AddHistory(createdBy, comment string) {
+	now := time.Now().UTC()
+
+	b.History = append(b.History, HistoryEntry{
+		History: imgspecv1.History{
+			Created:    &now,
+			CreatedBy:  createdBy,
+			Comment:    comment,
+			EmptyLayer: true,
+		},
+	})
+}
+
+// addLayerHistory records how a layer was created. Changes to a layer that
+// already has an entry are appended to it, as the layer still ends up as a
+// single blob.
+func (b *Builder) addLayerHistory(layer, createdBy, comment string) {
+	now := time.Now().UTC()
+
+	for i := range b.History {
+		entry := &b.History[i]
+		if entry.Layer != layer {
+			continue
+		}
+
+		entry.Created = &now
+		entry.CreatedBy += " && " + createdBy
+		if comment != "" {
+			entry.Comment = comment
+		}
+		return
+	}
+
+	b.History = append(b.History, HistoryEntry{
+		History: imgspecv1.History{
+			Created:   &now,
+			CreatedBy: createdBy,
+			Comment:   comment,
+		},
+		Layer: layer,
+	})
+}
+
+// imageHistory returns the history of an image built with the given layers.
+// Entries with a layer follow the layer order; configuration changes are
+// kept ahead of the layer recorded after them.
+func (b *Builder) imageHistory(layerDirNames []string) []imgspecv1.History {
+	var history []imgspecv1.History
+
+	next := 0
+	flush := func(end int) {
+		for ; next < end; next++ {
+			if b.History[next].Layer == "" {
+				history = append(history, b.History[next].History)
+			}
+		}
+	}
+
+	for _, name := range layerDirNames {
+		index := -1
+		for i, entry := range b.History {
+			if entry.Layer == name {
+				index = i
+				break
+			}
+		}
+
+		if index < 0 {
+			history = append(history, imgspecv1.History{
+				Created:   b.OCIImage.Created,
+				CreatedBy: fmt.Sprintf("cbt build --layers %s", name),
+			})
+			continue
+		}
+
+		flush(index)
+		history = append(history, b.History[index].History)
+	}
+
+	flush(len(b.History))
+
+	return history
+}
+
+// baseHistory returns the history of a base image with an entry for every
+// layer. Images without history, or with entries for fewer layers than they
+// have, get entries for the remaining layers, so that the entries added on
+// top line up with their layers.
+func baseHistory(img *imgspecv1.Image) []imgspecv1.History {
+	history := append([]imgspecv1.History{}, img.History...)
+
+	layers := 0
+	for _, entry := range history {
+		if !entry.EmptyLayer {
+			layers++
+		}
+	}
+
+	for ; layers < len(img.RootFS.DiffIDs); layers++ {
+		history = append(history, imgspecv1.History{
+			Created: img.Created,
+		})
+	}
+
+	return history
+}
@@ -0,0 +1,188 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/layer"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type ImportOptions struct {
+	// Source is a rootfs tarball, possibly compressed, or "-" for stdin.
+	Source string
+	Target string
+	// ConfigFile is an image config, or only its config section, to base
+	// the image on.
+	ConfigFile         string
+	OS                 string
+	Architecture       string
+	Message            string
+	Compression        archive.Compression
+	ArchiveCompression archive.Compression
+	Jobs               int
+}
+
+// Import creates a single layer image from a rootfs tarball.
+func Import(options ImportOptions) error {
+	img, err := loadImportConfig(options.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	if options.OS != "" {
+		img.OS = options.OS
+	}
+	if options.Architecture != "" {
+		img.Architecture = options.Architecture
+	}
+
+	// Like images picked out of multi-platform ones, imported images are
+	// for linux on the host architecture unless told otherwise.
+	platform := manifest.DefaultPlatform()
+	if img.OS == "" {
+		img.OS = platform.OS
+	}
+	if img.Architecture == "" {
+		img.Architecture = platform.Architecture
+		img.Variant = platform.Variant
+	}
+
+	var src io.Reader = os.Stdin
+	if options.Source != "-" {
+		f, err := os.Open(options.Source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+
+	uncompressed, _, err := archive.DecompressStream(src)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", options.Source, err)
+	}
+
+	uncompressed, err = checkTar(uncompressed)
+	if err != nil {
+		return fmt.Errorf("%s is not a tar archive: %w", options.Source, err)
+	}
+
+	mediaType, err := layer.MediaType(options.Compression)
+	if err != nil {
+		return err
+	}
+
+	dstImageRef, err := image.ParseReference(options.Target)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	dstImageWriter, err := dstImageRef.NewImageWriter(types.ImageWriterOptions{
+		ArchiveCompression: options.ArchiveCompression,
+	})
+	if err != nil {
+		return fmt.Errorf("creating image writer: %w", err)
+	}
+	defer dstImageWriter.Close()
+
+	layerInfo, err := putLayer(dstImageWriter, uncompressed, mediaType, options.Compression, options.Jobs)
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", options.Source, err)
+	}
+
+	now := time.Now().UTC()
+
+	img.Created = &now
+	img.RootFS = imgspecv1.RootFS{
+		Type:    "layers",
+		DiffIDs: []digest.Digest{layerInfo.UncompressedDigest},
+	}
+	img.History = []imgspecv1.History{{
+		Created:   &now,
+		CreatedBy: fmt.Sprintf("cbt import %s", options.Source),
+		Comment:   options.Message,
+	}}
+
+	imageManifest := imgspecv1.Manifest{
+		Versioned: imgspec.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Layers: []imgspecv1.Descriptor{{
+			MediaType: layerInfo.MediaType,
+			Digest:    layerInfo.CompressedDigest,
+			Size:      layerInfo.CompressedSize,
+		}},
+	}
+
+	if _, err := dstImageWriter.PutImageBlob(*img, &imageManifest); err != nil {
+		return fmt.Errorf("putting image: %w", err)
+	}
+
+	if _, err := dstImageWriter.PutManifestBlob(imageManifest); err != nil {
+		return fmt.Errorf("putting manifest: %w", err)
+	}
+
+	if err := dstImageWriter.Save(); err != nil {
+		return fmt.Errorf("saving image: %w", err)
+	}
+
+	return nil
+}
+
+// loadImportConfig reads a full image config, recognised by its config or
+// rootfs sections, or a bare config section.
+func loadImportConfig(path string) (*imgspecv1.Image, error) {
+	img := &imgspecv1.Image{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var sections map[string]json.RawMessage
+		if err := json.Unmarshal(data, &sections); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+
+		_, hasConfig := sections["config"]
+		_, hasRootFS := sections["rootfs"]
+
+		if hasConfig || hasRootFS {
+			err = json.Unmarshal(data, img)
+		} else {
+			err = json.Unmarshal(data, &img.Config)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	return img, nil
+}
+
+// checkTar reads the first header of a stream so that files other than tar
+// archives aren't imported as layers. The stream is read from the returned
+// reader afterwards.
+func checkTar(r io.Reader) (io.Reader, error) {
+	var head bytes.Buffer
+	if _, err := tar.NewReader(io.TeeReader(r, &head)).Next(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return io.MultiReader(&head, r), nil
+}
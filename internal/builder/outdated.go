@@ -0,0 +1,64 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type BaseStatus struct {
+	Name string `json:"name"`
+	// Digest is the base image manifest the image was built on; Latest is
+	// the one the base name resolves to now.
+	Digest   digest.Digest `json:"digest"`
+	Latest   digest.Digest `json:"latest"`
+	Outdated bool          `json:"outdated"`
+}
+
+// CheckBase resolves the base image recorded in the annotations of an image
+// again and reports whether it has changed since the image was built.
+func CheckBase(name string) (*BaseStatus, error) {
+	source, err := openImageSource(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer source.reader.Close()
+
+	baseName := source.manifest.Annotations[imgspecv1.AnnotationBaseImageName]
+	baseDigest := source.manifest.Annotations[imgspecv1.AnnotationBaseImageDigest]
+	if baseName == "" || baseDigest == "" {
+		return nil, errors.New("image has no base image annotations")
+	}
+
+	status := &BaseStatus{
+		Name:   baseName,
+		Digest: digest.Digest(baseDigest),
+	}
+	if err := status.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid base image digest %q: %w", baseDigest, err)
+	}
+
+	baseRef, err := image.ParseReference(baseName)
+	if err != nil {
+		return nil, fmt.Errorf("parsing base image reference: %w", err)
+	}
+
+	// The base is resolved for the platform of the image, which may be
+	// picked out of a multi-platform base.
+	platform := source.image.Platform
+	baseReader, err := baseRef.NewImageReader(types.ImageReaderOptions{Platform: &platform})
+	if err != nil {
+		return nil, fmt.Errorf("creating image reader: %w", err)
+	}
+	defer baseReader.Close()
+
+	status.Latest = baseReader.ManifestDescriptor().Digest
+	status.Outdated = status.Latest != status.Digest
+
+	return status, nil
+}
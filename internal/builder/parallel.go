@@ -0,0 +1,51 @@
+package builder
+
+import "sync"
+
+// runParallel calls fn for every index in [0, n) on at most jobs goroutines
+// and returns the error of the lowest failing index. Callers store results
+// by index, which keeps their order independent of scheduling.
+func runParallel(n, jobs int, fn func(i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	errs := make([]error, n)
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jobsPerTask splits jobs between the tasks runParallel runs at once, for
+// tasks that are parallel themselves.
+func jobsPerTask(n, jobs int) int {
+	jobs = max(jobs, 1)
+	if n < 1 {
+		return jobs
+	}
+	return max(1, jobs/min(jobs, n))
+}
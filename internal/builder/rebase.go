@@ -0,0 +1,317 @@
+package builder
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type RebaseOptions struct {
+	Image              string
+	OldBase            string
+	NewBase            string
+	Target             string
+	ArchiveCompression archive.Compression
+	Jobs               int
+}
+
+type imageSource struct {
+	reader   types.ImageReader
+	manifest *imgspecv1.Manifest
+	image    *imgspecv1.Image
+}
+
+// Rebase writes the image to the target with the layers of its old base
+// replaced by the layers of the new base. The configuration the image
+// inherited from the old base is taken from the new base instead.
+func Rebase(options RebaseOptions) error {
+	var sources []*imageSource
+	defer func() {
+		for _, source := range sources {
+			source.reader.Close()
+		}
+	}()
+
+	img, err := openImageSource(options.Image, nil)
+	if err != nil {
+		return err
+	}
+	sources = append(sources, img)
+
+	// The bases are resolved for the platform of the image, which may be
+	// picked out of multi-platform bases.
+	platform := img.image.Platform
+	for _, name := range []string{options.OldBase, options.NewBase} {
+		source, err := openImageSource(name, &platform)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+
+	oldBase, newBase := sources[1], sources[2]
+
+	oldDiffIDs := oldBase.image.RootFS.DiffIDs
+	diffIDs := img.image.RootFS.DiffIDs
+	if len(oldDiffIDs) > len(diffIDs) {
+		return fmt.Errorf("%s has fewer layers than %s", options.Image, options.OldBase)
+	}
+	for i, diffID := range oldDiffIDs {
+		if diffIDs[i] != diffID {
+			return fmt.Errorf("%s is not based on %s: layer %d is %s, expected %s", options.Image, options.OldBase, i, diffIDs[i], diffID)
+		}
+	}
+	if len(img.manifest.Layers) != len(diffIDs) || len(newBase.manifest.Layers) != len(newBase.image.RootFS.DiffIDs) {
+		return fmt.Errorf("manifest and config layer counts differ")
+	}
+
+	dstImageRef, err := image.ParseReference(options.Target)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	dstImageWriter, err := dstImageRef.NewImageWriter(types.ImageWriterOptions{
+		ArchiveCompression: options.ArchiveCompression,
+	})
+	if err != nil {
+		return fmt.Errorf("creating image writer: %w", err)
+	}
+	defer dstImageWriter.Close()
+
+	baseLayers, err := copyBlobs(dstImageWriter, newBase.reader, newBase.manifest.Layers, options.Jobs)
+	if err != nil {
+		return fmt.Errorf("copying new base layers: %w", err)
+	}
+
+	appLayers, err := copyBlobs(dstImageWriter, img.reader, img.manifest.Layers[len(oldDiffIDs):], options.Jobs)
+	if err != nil {
+		return fmt.Errorf("copying image layers: %w", err)
+	}
+
+	dstImage := rebaseImage(img.image, oldBase.image, newBase.image)
+
+	// The rebased image is written as OCI, whatever the formats of its
+	// sources, so that it can record its new base.
+	srcManifest := *img.manifest
+	srcManifest.Layers = append(baseLayers, appLayers...)
+	dstManifest, err := manifest.Convert(&srcManifest, manifest.FormatOCI)
+	if err != nil {
+		return fmt.Errorf("converting manifest: %w", err)
+	}
+	dstManifest.Annotations = make(map[string]string)
+	for key, value := range img.manifest.Annotations {
+		dstManifest.Annotations[key] = value
+	}
+	dstManifest.Annotations[imgspecv1.AnnotationBaseImageName] = options.NewBase
+	dstManifest.Annotations[imgspecv1.AnnotationBaseImageDigest] = newBase.reader.ManifestDescriptor().Digest.String()
+
+	if _, err := dstImageWriter.PutImageBlob(*dstImage, dstManifest); err != nil {
+		return fmt.Errorf("putting image: %w", err)
+	}
+
+	if _, err := dstImageWriter.PutManifestBlob(*dstManifest); err != nil {
+		return fmt.Errorf("putting manifest: %w", err)
+	}
+
+	if err := dstImageWriter.Save(); err != nil {
+		return fmt.Errorf("saving image: %w", err)
+	}
+
+	return nil
+}
+
+func openImageSource(name string, platform *imgspecv1.Platform) (*imageSource, error) {
+	ref, err := image.ParseReference(name)
+	if err != nil {
+		return nil, fmt.Errorf("parsing image reference %s: %w", name, err)
+	}
+
+	reader, err := ref.NewImageReader(types.ImageReaderOptions{Platform: platform})
+	if err != nil {
+		return nil, fmt.Errorf("creating image reader for %s: %w", name, err)
+	}
+
+	manifest, err := reader.GetManifest()
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("getting manifest of %s: %w", name, err)
+	}
+
+	img, err := reader.GetImage()
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("getting image of %s: %w", name, err)
+	}
+
+	return &imageSource{reader: reader, manifest: manifest, image: img}, nil
+}
+
+func copyBlobs(writer types.ImageWriter, reader types.ImageReader, descriptors []imgspecv1.Descriptor, jobs int) ([]imgspecv1.Descriptor, error) {
+	copied := make([]imgspecv1.Descriptor, len(descriptors))
+
+	err := runParallel(len(descriptors), jobs, func(i int) error {
+		blob, err := reader.GetBlob(descriptors[i])
+		if err != nil {
+			return fmt.Errorf("getting blob: %w", err)
+		}
+		defer blob.Close()
+
+		descriptor, err := writer.PutBlob(blob, types.PutBlobOptions{
+			MediaType: descriptors[i].MediaType,
+			Digest:    descriptors[i].Digest,
+			Size:      descriptors[i].Size,
+		})
+		if err != nil {
+			return fmt.Errorf("putting blob: %w", err)
+		}
+
+		descriptor.Annotations = descriptors[i].Annotations
+		copied[i] = descriptor
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return copied, nil
+}
+
+// rebaseImage keeps what the image set itself and takes what it inherited
+// from the old base from the new base. The platform always comes from the
+// new base, as its layers decide what the image runs on.
+func rebaseImage(img, oldBase, newBase *imgspecv1.Image) *imgspecv1.Image {
+	now := time.Now().UTC()
+
+	rebased := *img
+	rebased.Created = &now
+	rebased.Platform = newBase.Platform
+
+	n := len(oldBase.RootFS.DiffIDs)
+	rebased.RootFS = imgspecv1.RootFS{
+		Type:    "layers",
+		DiffIDs: append(append([]digest.Digest{}, newBase.RootFS.DiffIDs...), img.RootFS.DiffIDs[n:]...),
+	}
+
+	rebased.History = append(baseHistory(newBase), historyAbove(img.History, oldBase)...)
+
+	config := &rebased.Config
+	oldConfig, newConfig := oldBase.Config, newBase.Config
+
+	config.Env = mergeEnv(img.Config.Env, oldConfig.Env, newConfig.Env)
+	config.Labels = mergeMap(img.Config.Labels, oldConfig.Labels, newConfig.Labels)
+	config.ExposedPorts = mergeMap(img.Config.ExposedPorts, oldConfig.ExposedPorts, newConfig.ExposedPorts)
+	config.Volumes = mergeMap(img.Config.Volumes, oldConfig.Volumes, newConfig.Volumes)
+
+	inherit(&config.User, oldConfig.User, newConfig.User)
+	inherit(&config.WorkingDir, oldConfig.WorkingDir, newConfig.WorkingDir)
+	inherit(&config.StopSignal, oldConfig.StopSignal, newConfig.StopSignal)
+	inherit(&config.Entrypoint, oldConfig.Entrypoint, newConfig.Entrypoint)
+	inherit(&config.Cmd, oldConfig.Cmd, newConfig.Cmd)
+
+	return &rebased
+}
+
+// historyAbove drops the entries of a history that describe a base: those
+// up to the entry of its last layer, along with the configuration changes
+// the base recorded after it. Counting layers rather than entries copes
+// with bases whose history was filled in by baseHistory.
+func historyAbove(history []imgspecv1.History, base *imgspecv1.Image) []imgspecv1.History {
+	baseEntries := baseHistory(base)
+
+	trailing := 0
+	for i := len(baseEntries) - 1; i >= 0 && baseEntries[i].EmptyLayer; i-- {
+		trailing++
+	}
+
+	layers := len(base.RootFS.DiffIDs)
+	i := 0
+	for ; i < len(history) && layers > 0; i++ {
+		if !history[i].EmptyLayer {
+			layers--
+		}
+	}
+	for ; i < len(history) && trailing > 0 && history[i].EmptyLayer; i++ {
+		trailing--
+	}
+
+	return append([]imgspecv1.History{}, history[i:]...)
+}
+
+// inherit replaces a value the image didn't change from the old base with
+// the new base's value.
+func inherit[T any](value *T, oldBase, newBase T) {
+	if reflect.DeepEqual(*value, oldBase) {
+		*value = newBase
+	}
+}
+
+// mergeMap merges per key: keys the image didn't change from the old base
+// follow the new base, the image's own keys are kept.
+func mergeMap[T any](img, oldBase, newBase map[string]T) map[string]T {
+	merged := make(map[string]T)
+
+	for key, value := range img {
+		if oldValue, ok := oldBase[key]; !ok || !reflect.DeepEqual(value, oldValue) {
+			merged[key] = value
+		}
+	}
+
+	for key, value := range newBase {
+		if _, ok := merged[key]; ok {
+			continue
+		}
+		// Keys the image removed from the old base stay removed.
+		if _, inImage := img[key]; !inImage {
+			if _, inOld := oldBase[key]; inOld {
+				continue
+			}
+		}
+		merged[key] = value
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+
+	return merged
+}
+
+func mergeEnv(img, oldBase, newBase []string) []string {
+	toMap := func(env []string) map[string]string {
+		m := make(map[string]string)
+		for _, e := range env {
+			key, value, _ := strings.Cut(e, "=")
+			m[key] = value
+		}
+		return m
+	}
+
+	merged := mergeMap(toMap(img), toMap(oldBase), toMap(newBase))
+
+	// Keep the image's order, then add what the new base introduced.
+	var env []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{img, newBase} {
+		for _, e := range list {
+			key, _, _ := strings.Cut(e, "=")
+			value, ok := merged[key]
+			if !ok || seen[key] {
+				continue
+			}
+			seen[key] = true
+			env = append(env, key+"="+value)
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,72 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func testImage(diffIDs []string, history ...imgspecv1.History) *imgspecv1.Image {
+	img := &imgspecv1.Image{History: history}
+	img.RootFS.Type = "layers"
+	for _, diffID := range diffIDs {
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, digest.FromString(diffID))
+	}
+	return img
+}
+
+func TestRebaseImageHistory(t *testing.T) {
+	layer := func(createdBy string) imgspecv1.History {
+		return imgspecv1.History{CreatedBy: createdBy}
+	}
+	config := func(createdBy string) imgspecv1.History {
+		return imgspecv1.History{CreatedBy: createdBy, EmptyLayer: true}
+	}
+
+	tests := []struct {
+		name    string
+		img     *imgspecv1.Image
+		oldBase *imgspecv1.Image
+		newBase *imgspecv1.Image
+		want    []imgspecv1.History
+	}{
+		{
+			name:    "configuration changes between base layers",
+			oldBase: testImage([]string{"a", "b"}, layer("add a"), config("env"), layer("add b"), config("cmd")),
+			img:     testImage([]string{"a", "b", "c"}, layer("add a"), config("env"), layer("add b"), config("cmd"), config("user"), layer("add c")),
+			newBase: testImage([]string{"x"}, layer("add x"), config("cmd")),
+			want:    []imgspecv1.History{layer("add x"), config("cmd"), config("user"), layer("add c")},
+		},
+		{
+			name:    "old base without history",
+			oldBase: testImage([]string{"a", "b"}),
+			img:     testImage([]string{"a", "b", "c"}, layer(""), layer(""), config("user"), layer("add c")),
+			newBase: testImage([]string{"x"}, layer("add x")),
+			want:    []imgspecv1.History{layer("add x"), config("user"), layer("add c")},
+		},
+		{
+			name:    "new base without history",
+			oldBase: testImage([]string{"a"}, layer("add a")),
+			img:     testImage([]string{"a", "c"}, layer("add a"), layer("add c")),
+			newBase: testImage([]string{"x", "y"}),
+			want:    []imgspecv1.History{layer(""), layer(""), layer("add c")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rebased := rebaseImage(tt.img, tt.oldBase, tt.newBase)
+
+			if !reflect.DeepEqual(rebased.History, tt.want) {
+				t.Errorf("history = %+v, want %+v", rebased.History, tt.want)
+			}
+
+			want := append(append([]digest.Digest{}, tt.newBase.RootFS.DiffIDs...), tt.img.RootFS.DiffIDs[len(tt.oldBase.RootFS.DiffIDs):]...)
+			if !reflect.DeepEqual(rebased.RootFS.DiffIDs, want) {
+				t.Errorf("diff IDs = %v, want %v", rebased.RootFS.DiffIDs, want)
+			}
+		})
+	}
+}
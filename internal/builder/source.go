@@ -0,0 +1,98 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/changes"
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/types"
+	"github.com/pkorzh/container-build-tool/internal/workdir"
+)
+
+// rootfsSource is an image, or a working container, whose layers are merged
+// into a root filesystem.
+type rootfsSource struct {
+	image   *imgspecv1.Image
+	layers  []changes.LayerOpener
+	closers []func() error
+}
+
+// openRootfsSource opens an image reference, or the working container with
+// the given name or ID when it isn't one. A working container stays locked
+// until the source is closed.
+func openRootfsSource(name string) (*rootfsSource, error) {
+	if _, err := image.ParseReference(name); err == nil {
+		return openImageRootfs(name, nil)
+	}
+
+	b, err := Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := openImageRootfs(b.FromImage, b.Platform)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	source.closers = append(source.closers, b.Close)
+
+	workDir, err := workdir.GetWorkingContainerDir(b.WorkDirID)
+	if err != nil {
+		source.Close()
+		return nil, fmt.Errorf("getting workdir: %w", err)
+	}
+
+	for _, name := range b.Layers {
+		source.layers = append(source.layers, layerDirOpener(workDir, name))
+	}
+
+	img := *b.OCIImage
+	source.image = &img
+
+	return source, nil
+}
+
+func openImageRootfs(name string, platform *imgspecv1.Platform) (*rootfsSource, error) {
+	img, err := openImageSource(name, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &rootfsSource{
+		image:   img.image,
+		closers: []func() error{img.reader.Close},
+	}
+	source.layers = blobOpeners(img.reader, img.manifest.Layers)
+
+	return source, nil
+}
+
+func blobOpeners(reader types.ImageReader, descriptors []imgspecv1.Descriptor) []changes.LayerOpener {
+	var openers []changes.LayerOpener
+	for _, descriptor := range descriptors {
+		descriptor := descriptor
+		openers = append(openers, func() (io.ReadCloser, error) {
+			return reader.GetBlob(descriptor)
+		})
+	}
+	return openers
+}
+
+// Rootfs returns the merged layers as a tar stream without whiteouts.
+func (s *rootfsSource) Rootfs() (io.ReadCloser, error) {
+	return changes.Squash(s.layers, false)
+}
+
+func (s *rootfsSource) Close() error {
+	var err error
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		if closeErr := s.closers[i](); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	"github.com/pkorzh/container-build-tool/internal/changes"
+	"github.com/pkorzh/container-build-tool/internal/image"
+	"github.com/pkorzh/container-build-tool/internal/layer"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type FlattenOptions struct {
+	Source             string
+	Target             string
+	ArchiveCompression archive.Compression
+	Compression        archive.Compression
+	Jobs               int
+	// Platform picks the image flattened out of a multi-platform source.
+	Platform *imgspecv1.Platform
+}
+
+// Flatten writes the source image to the target with all of its layers
+// merged into one.
+func Flatten(options FlattenOptions) error {
+	srcImageRef, err := image.ParseReference(options.Source)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	srcImageReader, err := srcImageRef.NewImageReader(types.ImageReaderOptions{Platform: options.Platform})
+	if err != nil {
+		return fmt.Errorf("creating image reader: %w", err)
+	}
+	defer srcImageReader.Close()
+
+	srcManifest, err := srcImageReader.GetManifest()
+	if err != nil {
+		return fmt.Errorf("getting manifest: %w", err)
+	}
+
+	srcImage, err := srcImageReader.GetImage()
+	if err != nil {
+		return fmt.Errorf("getting image: %w", err)
+	}
+
+	dstImageRef, err := image.ParseReference(options.Target)
+	if err != nil {
+		return fmt.Errorf("parsing image reference: %w", err)
+	}
+
+	dstImageWriter, err := dstImageRef.NewImageWriter(types.ImageWriterOptions{
+		ArchiveCompression: options.ArchiveCompression,
+	})
+	if err != nil {
+		return fmt.Errorf("creating image writer: %w", err)
+	}
+	defer dstImageWriter.Close()
+
+	openers := blobOpeners(srcImageReader, srcManifest.Layers)
+
+	squashed, err := putSquashedLayer(dstImageWriter, openers, false, options.Compression, options.Jobs)
+	if err != nil {
+		return fmt.Errorf("squashing layers: %w", err)
+	}
+
+	dstImage := *srcImage
+	dstImage.RootFS = imgspecv1.RootFS{
+		Type:    "layers",
+		DiffIDs: []digest.Digest{squashed.UncompressedDigest},
+	}
+	dstImage.History = squashHistory(srcImage.History, "cbt flatten", len(openers))
+
+	dstManifest := imgspecv1.Manifest{
+		Versioned:   srcManifest.Versioned,
+		MediaType:   imgspecv1.MediaTypeImageManifest,
+		Annotations: srcManifest.Annotations,
+		Layers: []imgspecv1.Descriptor{{
+			MediaType: squashed.MediaType,
+			Digest:    squashed.CompressedDigest,
+			Size:      squashed.CompressedSize,
+		}},
+	}
+
+	if _, err := dstImageWriter.PutImageBlob(dstImage, &dstManifest); err != nil {
+		return fmt.Errorf("putting image: %w", err)
+	}
+
+	if _, err := dstImageWriter.PutManifestBlob(dstManifest); err != nil {
+		return fmt.Errorf("putting manifest: %w", err)
+	}
+
+	err = dstImageWriter.Save()
+	if err != nil {
+		return fmt.Errorf("saving image: %w", err)
+	}
+
+	return nil
+}
+
+func putSquashedLayer(writer types.ImageWriter, openers []changes.LayerOpener, keepWhiteouts bool, compression archive.Compression, jobs int) (layer.LayerInfo, error) {
+	mediaType, err := layer.MediaType(compression)
+	if err != nil {
+		return layer.LayerInfo{}, err
+	}
+
+	squashed, err := changes.Squash(openers, keepWhiteouts)
+	if err != nil {
+		return layer.LayerInfo{}, err
+	}
+	defer squashed.Close()
+
+	return putLayer(writer, squashed, mediaType, compression, jobs)
+}
+
+// squashHistory keeps the entries of merged layers as empty ones and adds
+// an entry for the squashed layer.
+func squashHistory(history []imgspecv1.History, createdBy string, layers int) []imgspecv1.History {
+	squashed := make([]imgspecv1.History, 0, len(history)+1)
+	for _, entry := range history {
+		entry.EmptyLayer = true
+		squashed = append(squashed, entry)
+	}
+
+	now := time.Now().UTC()
+
+	return append(squashed, imgspecv1.History{
+		Created:   &now,
+		CreatedBy: createdBy,
+		Comment:   fmt.Sprintf("squashed %d layers", layers),
+	})
+}
@@ -0,0 +1,108 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+)
+
+// stateVersion is the version of the builder.json schema written by this
+// build of cbt. Bump it together with a new entry in migrations whenever the
+// persisted state changes shape.
+const stateVersion = 3
+
+// migrations[i] upgrades a decoded state from version i to version i+1.
+var migrations = []func(state map[string]any) error{
+	migrateV0,
+	migrateV1,
+	migrateV2,
+}
+
+// decodeState unmarshals a builder.json, upgrading states written by older
+// versions of cbt and refusing ones written by newer versions.
+func decodeState(data []byte) (*Builder, error) {
+	var state map[string]any
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if v, ok := state["version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return nil, fmt.Errorf("invalid state version %v", v)
+		}
+		version = int(f)
+	}
+
+	if version > stateVersion {
+		return nil, fmt.Errorf("state version %d was written by a newer cbt, this one supports up to version %d", version, stateVersion)
+	}
+
+	if version < stateVersion {
+		for ; version < stateVersion; version++ {
+			if err := migrations[version](state); err != nil {
+				return nil, fmt.Errorf("migrating state from version %d: %w", version, err)
+			}
+		}
+		state["version"] = stateVersion
+
+		var err error
+		data, err = json.Marshal(state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var builder Builder
+	if err := json.Unmarshal(data, &builder); err != nil {
+		return nil, err
+	}
+
+	return &builder, nil
+}
+
+// migrateV0 upgrades states from before working containers had names,
+// creation times and pending layers.
+func migrateV0(state map[string]any) error {
+	if _, ok := state["name"]; !ok {
+		state["name"] = state["workDirId"]
+	}
+
+	if _, ok := state["created"]; !ok {
+		if image, ok := state["ociImage"].(map[string]any); ok && image["created"] != nil {
+			state["created"] = image["created"]
+		}
+	}
+
+	if _, ok := state["layers"]; !ok {
+		state["layers"] = []any{}
+	}
+
+	return nil
+}
+
+// migrateV1 upgrades states from before working containers recorded
+// history entries.
+func migrateV1(state map[string]any) error {
+	if _, ok := state["history"]; !ok {
+		state["history"] = []any{}
+	}
+
+	return nil
+}
+
+// migrateV2 upgrades states from before working containers recorded the
+// platform of their base image. Those picked the base for the host OS and
+// architecture, whatever the variant, which is kept so the base doesn't
+// change under them.
+func migrateV2(state map[string]any) error {
+	if _, ok := state["platform"]; !ok {
+		state["platform"] = map[string]any{
+			"os":           runtime.GOOS,
+			"architecture": runtime.GOARCH,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package bundle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+	internalfilepath "github.com/pkorzh/container-build-tool/internal/filepath"
+)
+
+const (
+	AnnotationExposedPorts = "org.opencontainers.image.exposedPorts"
+	AnnotationStopSignal   = "org.opencontainers.image.stopSignal"
+
+	defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+var defaultCapabilities = []string{
+	"CAP_AUDIT_WRITE",
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_MKNOD",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_RAW",
+	"CAP_SETFCAP",
+	"CAP_SETGID",
+	"CAP_SETPCAP",
+	"CAP_SETUID",
+	"CAP_SYS_CHROOT",
+}
+
+type Options struct {
+	// Rootless generates a spec runc can start without root: the
+	// container gets a user namespace mapping the current user to root.
+	Rootless bool
+}
+
+// Create writes an OCI runtime bundle to dir: the root filesystem unpacked
+// from a tar stream and a config.json generated from the image config.
+func Create(dir string, rootfs io.Reader, img *imgspecv1.Image, options Options) error {
+	rootfsDir := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(rootfsDir, 0755); err != nil {
+		return err
+	}
+
+	if err := archive.Untar(rootfs, rootfsDir, archive.UntarOptions{}); err != nil {
+		return fmt.Errorf("unpacking rootfs: %w", err)
+	}
+
+	spec, err := Generate(rootfsDir, img, options)
+	if err != nil {
+		return err
+	}
+
+	spec.Mounts, err = addVolumes(dir, rootfsDir, spec.Mounts, img.Config.Volumes)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, "config.json"), data, 0644)
+}
+
+// Generate builds a runtime spec for an image unpacked at rootfs.
+func Generate(rootfs string, img *imgspecv1.Image, options Options) (*specs.Spec, error) {
+	config := img.Config
+
+	args := append(append([]string{}, config.Entrypoint...), config.Cmd...)
+	if len(args) == 0 {
+		return nil, errors.New("image has neither an entrypoint nor a command")
+	}
+
+	user, err := ResolveUser(rootfs, config.User)
+	if err != nil {
+		return nil, err
+	}
+
+	env := append([]string{}, config.Env...)
+	if !hasEnv(env, "PATH") {
+		env = append([]string{defaultPath}, env...)
+	}
+
+	cwd := config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	spec := &specs.Spec{
+		Version: specs.Version,
+		Root: &specs.Root{
+			Path: "rootfs",
+		},
+		Hostname: "cbt",
+		Process: &specs.Process{
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			User: specs.User{
+				UID:            user.UID,
+				GID:            user.GID,
+				AdditionalGids: user.AdditionalGids,
+			},
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  defaultCapabilities,
+				Effective: defaultCapabilities,
+				Permitted: defaultCapabilities,
+			},
+			Rlimits: []specs.POSIXRlimit{
+				{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024},
+			},
+			NoNewPrivileges: true,
+		},
+		Mounts:      defaultMounts(),
+		Annotations: annotations(config),
+		Linux: &specs.Linux{
+			Namespaces: []specs.LinuxNamespace{
+				{Type: specs.PIDNamespace},
+				{Type: specs.NetworkNamespace},
+				{Type: specs.IPCNamespace},
+				{Type: specs.UTSNamespace},
+				{Type: specs.MountNamespace},
+				{Type: specs.CgroupNamespace},
+			},
+			Resources: &specs.LinuxResources{
+				Devices: []specs.LinuxDeviceCgroup{
+					{Allow: false, Access: "rwm"},
+				},
+			},
+			MaskedPaths: []string{
+				"/proc/acpi",
+				"/proc/asound",
+				"/proc/kcore",
+				"/proc/keys",
+				"/proc/latency_stats",
+				"/proc/timer_list",
+				"/proc/timer_stats",
+				"/proc/sched_debug",
+				"/proc/scsi",
+				"/sys/firmware",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus",
+				"/proc/fs",
+				"/proc/irq",
+				"/proc/sys",
+				"/proc/sysrq-trigger",
+			},
+		},
+	}
+
+	if options.Rootless {
+		toRootless(spec)
+	}
+
+	return spec, nil
+}
+
+func defaultMounts() []specs.Mount {
+	return []specs.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+		{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+		{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+		{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+		{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+		{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+	}
+}
+
+// toRootless adjusts a spec the way runc spec --rootless does: a user
+// namespace instead of a network one, sysfs bind mounted and no cgroup
+// resources or devpts group.
+func toRootless(spec *specs.Spec) {
+	var namespaces []specs.LinuxNamespace
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type != specs.NetworkNamespace && ns.Type != specs.UserNamespace {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	spec.Linux.Namespaces = append(namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+
+	spec.Linux.UIDMappings = []specs.LinuxIDMapping{{HostID: uint32(os.Geteuid()), ContainerID: 0, Size: 1}}
+	spec.Linux.GIDMappings = []specs.LinuxIDMapping{{HostID: uint32(os.Getegid()), ContainerID: 0, Size: 1}}
+	spec.Linux.Resources = nil
+
+	// Only root is mapped, so the process can't switch to another user.
+	spec.Process.User = specs.User{}
+
+	var mounts []specs.Mount
+	for _, mount := range spec.Mounts {
+		switch mount.Destination {
+		case "/sys":
+			mount = specs.Mount{Destination: "/sys", Type: "none", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev", "ro"}}
+		case "/sys/fs/cgroup":
+			continue
+		}
+
+		var options []string
+		for _, option := range mount.Options {
+			if !strings.HasPrefix(option, "gid=") && !strings.HasPrefix(option, "uid=") {
+				options = append(options, option)
+			}
+		}
+		mount.Options = options
+
+		mounts = append(mounts, mount)
+	}
+	spec.Mounts = mounts
+}
+
+func annotations(config imgspecv1.ImageConfig) map[string]string {
+	annotations := make(map[string]string)
+
+	for key, value := range config.Labels {
+		annotations[key] = value
+	}
+
+	if len(config.ExposedPorts) > 0 {
+		var ports []string
+		for port := range config.ExposedPorts {
+			ports = append(ports, port)
+		}
+		sort.Strings(ports)
+		annotations[AnnotationExposedPorts] = strings.Join(ports, ",")
+	}
+
+	if config.StopSignal != "" {
+		annotations[AnnotationStopSignal] = config.StopSignal
+	}
+
+	if len(annotations) == 0 {
+		return nil
+	}
+
+	return annotations
+}
+
+// addVolumes bind mounts a directory of the bundle at every image volume,
+// seeded with what the image has at that path.
+func addVolumes(dir, rootfs string, mounts []specs.Mount, volumes map[string]struct{}) ([]specs.Mount, error) {
+	var destinations []string
+	for volume := range volumes {
+		destinations = append(destinations, volume)
+	}
+	sort.Strings(destinations)
+
+	for i, destination := range destinations {
+		name := fmt.Sprintf("%d-%s", i, strings.ReplaceAll(strings.Trim(filepath.Clean(destination), "/"), "/", "-"))
+		source := filepath.Join("volumes", name)
+
+		if err := os.MkdirAll(filepath.Join(dir, source), 0755); err != nil {
+			return nil, err
+		}
+
+		content, err := internalfilepath.SecureJoin(rootfs, destination)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(content); err == nil && fi.IsDir() {
+			if err := copyDir(content, filepath.Join(dir, source)); err != nil {
+				return nil, fmt.Errorf("seeding volume %s: %w", destination, err)
+			}
+		}
+
+		mounts = append(mounts, specs.Mount{
+			Destination: destination,
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"rbind", "rw"},
+		})
+	}
+
+	return mounts, nil
+}
+
+func copyDir(src, dst string) error {
+	arch, err := archive.Tar(src, archive.Uncompressed)
+	if err != nil {
+		return err
+	}
+	defer arch.Close()
+
+	return archive.Untar(arch, dst, archive.UntarOptions{})
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if key, _, _ := strings.Cut(e, "="); key == name {
+			return true
+		}
+	}
+	return false
+}
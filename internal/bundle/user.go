@@ -0,0 +1,181 @@
+package bundle
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	internalfilepath "github.com/pkorzh/container-build-tool/internal/filepath"
+)
+
+type User struct {
+	UID            uint32
+	GID            uint32
+	AdditionalGids []uint32
+}
+
+type passwdEntry struct {
+	name string
+	uid  uint32
+	gid  uint32
+}
+
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// ResolveUser resolves an image config user, user[:group] by name or ID,
+// against the /etc/passwd and /etc/group files of a root filesystem. The
+// groups listing the user are added as additional groups.
+func ResolveUser(rootfs, spec string) (User, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" {
+		userPart = "0"
+	}
+
+	users, err := readColonFile(rootfs, "/etc/passwd", parsePasswdLine)
+	if err != nil {
+		return User{}, err
+	}
+
+	groups, err := readColonFile(rootfs, "/etc/group", parseGroupLine)
+	if err != nil {
+		return User{}, err
+	}
+
+	var user User
+	var userName string
+
+	if uid, err := parseID(userPart); err == nil {
+		user.UID = uid
+		for _, entry := range users {
+			if entry.uid == uid {
+				user.GID = entry.gid
+				userName = entry.name
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, entry := range users {
+			if entry.name == userPart {
+				user.UID, user.GID, userName = entry.uid, entry.gid, entry.name
+				found = true
+				break
+			}
+		}
+		if !found {
+			return User{}, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userPart)
+		}
+	}
+
+	if hasGroup {
+		if gid, err := parseID(groupPart); err == nil {
+			user.GID = gid
+		} else {
+			found := false
+			for _, entry := range groups {
+				if entry.name == groupPart {
+					user.GID = entry.gid
+					found = true
+					break
+				}
+			}
+			if !found {
+				return User{}, fmt.Errorf("unable to find group %s: no matching entries in group file", groupPart)
+			}
+		}
+	}
+
+	if userName != "" {
+		for _, entry := range groups {
+			if entry.gid == user.GID {
+				continue
+			}
+			for _, member := range entry.members {
+				if member == userName {
+					user.AdditionalGids = append(user.AdditionalGids, entry.gid)
+					break
+				}
+			}
+		}
+	}
+
+	return user, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+func parsePasswdLine(fields []string) (passwdEntry, bool) {
+	if len(fields) < 4 {
+		return passwdEntry{}, false
+	}
+	uid, err := parseID(fields[2])
+	if err != nil {
+		return passwdEntry{}, false
+	}
+	gid, err := parseID(fields[3])
+	if err != nil {
+		return passwdEntry{}, false
+	}
+	return passwdEntry{name: fields[0], uid: uid, gid: gid}, true
+}
+
+func parseGroupLine(fields []string) (groupEntry, bool) {
+	if len(fields) < 3 {
+		return groupEntry{}, false
+	}
+	gid, err := parseID(fields[2])
+	if err != nil {
+		return groupEntry{}, false
+	}
+	entry := groupEntry{name: fields[0], gid: gid}
+	if len(fields) > 3 && fields[3] != "" {
+		entry.members = strings.Split(fields[3], ",")
+	}
+	return entry, true
+}
+
+// readColonFile parses a passwd style file of the root filesystem. A missing
+// file has no entries.
+func readColonFile[T any](rootfs, name string, parse func(fields []string) (T, bool)) ([]T, error) {
+	p, err := internalfilepath.SecureJoin(rootfs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []T
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if entry, ok := parse(strings.Split(line, ":")); ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,317 @@
+package changes
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	WhiteoutPrefix = ".wh."
+	OpaqueWhiteout = ".wh..wh..opq"
+)
+
+type Kind int
+
+const (
+	Added Kind = iota
+	Modified
+	Deleted
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+type FileInfo struct {
+	Mode    os.FileMode `json:"-"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"modTime"`
+	Link    string      `json:"link,omitempty"`
+}
+
+func (fi FileInfo) MarshalJSON() ([]byte, error) {
+	type fileInfo FileInfo
+	return json.Marshal(struct {
+		Mode string `json:"mode"`
+		fileInfo
+	}{fi.Mode.String(), fileInfo(fi)})
+}
+
+type Change struct {
+	// Path is slash separated and relative to the root of the filesystem.
+	Path string `json:"path"`
+	Kind Kind   `json:"kind"`
+	// Opaque marks a directory which hides everything below it in the
+	// lower layers.
+	Opaque bool      `json:"opaque,omitempty"`
+	Old    *FileInfo `json:"old,omitempty"`
+	New    *FileInfo `json:"new,omitempty"`
+}
+
+// UpperChanges lists the changes recorded in an overlay upper directory.
+// Overlay whiteouts (0/0 character devices) become deletions and opaque
+// directories are marked as such. The lower layers, lowest first, are only
+// used to tell additions from modifications and may be empty.
+func UpperChanges(upper string, lowers []string) ([]Change, error) {
+	merged, err := MergeLayers(lowers)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+
+	err = walk(upper, func(rel, p string, fi fs.FileInfo) error {
+		old, err := lowerInfo(merged, rel)
+		if err != nil {
+			return err
+		}
+
+		if isWhiteoutDevice(fi) {
+			changes = append(changes, Change{Path: rel, Kind: Deleted, Old: old})
+			return nil
+		}
+
+		info, err := newFileInfo(p, fi)
+		if err != nil {
+			return err
+		}
+
+		change := Change{Path: rel, Kind: Added, Old: old, New: info}
+		if fi.IsDir() {
+			change.Opaque = isOpaque(p)
+		}
+
+		if old != nil {
+			if !change.Opaque && !changed(old, info) {
+				return nil
+			}
+			change.Kind = Modified
+		}
+
+		changes = append(changes, change)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortChanges(changes)
+
+	return changes, nil
+}
+
+// SnapshotChanges compares a full copy of the filesystem against the merged
+// lower layers, lowest first.
+func SnapshotChanges(lowers []string, snapshot string) ([]Change, error) {
+	merged, err := MergeLayers(lowers)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	seen := make(map[string]bool)
+
+	err = walk(snapshot, func(rel, p string, fi fs.FileInfo) error {
+		seen[rel] = true
+
+		info, err := newFileInfo(p, fi)
+		if err != nil {
+			return err
+		}
+
+		old, err := lowerInfo(merged, rel)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case old == nil:
+			changes = append(changes, Change{Path: rel, Kind: Added, New: info})
+		case changed(old, info):
+			changes = append(changes, Change{Path: rel, Kind: Modified, Old: old, New: info})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for rel := range merged {
+		if seen[rel] {
+			continue
+		}
+
+		// Only the topmost deleted path needs a whiteout.
+		if parent := path.Dir(rel); parent != "." && !seen[parent] {
+			if _, ok := merged[parent]; ok {
+				continue
+			}
+		}
+
+		old, err := lowerInfo(merged, rel)
+		if err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, Change{Path: rel, Kind: Deleted, Old: old})
+	}
+
+	sortChanges(changes)
+
+	return changes, nil
+}
+
+// MergeLayers returns the files visible through the given layer
+// directories, lowest first, with OCI and overlay whiteouts applied. It maps
+// slash separated relative paths to the path of the file on disk.
+func MergeLayers(layers []string) (map[string]string, error) {
+	merged := newMergedTree[string]()
+
+	for _, layer := range layers {
+		var entries []string
+		var paths []string
+
+		// Whiteouts only hide lower layers, so they are applied before
+		// any of this layer's own entries are added.
+		err := walk(layer, func(rel, p string, fi fs.FileInfo) error {
+			dir, base := path.Split(rel)
+			dir = strings.TrimSuffix(dir, "/")
+
+			switch {
+			case base == OpaqueWhiteout:
+				merged.removeChildren(dir)
+			case strings.HasPrefix(base, WhiteoutPrefix):
+				merged.remove(path.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix)))
+			case isWhiteoutDevice(fi):
+				merged.remove(rel)
+			default:
+				if fi.IsDir() && isOpaque(p) {
+					merged.removeChildren(rel)
+				}
+				entries = append(entries, rel)
+				paths = append(paths, p)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for i, rel := range entries {
+			if fi, err := os.Lstat(paths[i]); err == nil && !fi.IsDir() {
+				merged.removeChildren(rel)
+			}
+			merged.set(rel, paths[i])
+		}
+	}
+
+	return merged.entries, nil
+}
+
+func walk(root string, fn func(rel, p string, fi fs.FileInfo) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(filepath.ToSlash(rel), p, fi)
+	})
+}
+
+func lowerInfo(merged map[string]string, rel string) (*FileInfo, error) {
+	p, ok := merged[rel]
+	if !ok {
+		return nil, nil
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFileInfo(p, fi)
+}
+
+func newFileInfo(p string, fi fs.FileInfo) (*FileInfo, error) {
+	uid, gid := owner(fi)
+
+	info := &FileInfo{
+		Mode:    fi.Mode(),
+		UID:     uid,
+		GID:     gid,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		info.Link = link
+	}
+
+	if fi.IsDir() {
+		info.Size = 0
+	}
+
+	return info, nil
+}
+
+// changed reports whether a file differs between two layers. Directory
+// timestamps are ignored since they change whenever an entry is added.
+func changed(old, new *FileInfo) bool {
+	if old.Mode != new.Mode || old.UID != new.UID || old.GID != new.GID || old.Link != new.Link {
+		return true
+	}
+
+	if new.Mode.IsDir() {
+		return false
+	}
+
+	return old.Size != new.Size || !old.ModTime.Equal(new.ModTime)
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+}
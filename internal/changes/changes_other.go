@@ -0,0 +1,13 @@
+//go:build !unix
+
+package changes
+
+import "io/fs"
+
+func owner(fi fs.FileInfo) (int, int) {
+	return 0, 0
+}
+
+func isWhiteoutDevice(fi fs.FileInfo) bool {
+	return false
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package changes
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+func owner(fi fs.FileInfo) (int, int) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return 0, 0
+}
+
+// isWhiteoutDevice reports whether fi is an overlay whiteout, a character
+// device with device number 0/0.
+func isWhiteoutDevice(fi fs.FileInfo) bool {
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Rdev == 0
+	}
+	return false
+}
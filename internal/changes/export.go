@@ -0,0 +1,74 @@
+package changes
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+)
+
+// Export writes the changes as an uncompressed OCI layer. Added and
+// modified files, and the directories leading to them, are read from root;
+// deletions become whiteout entries.
+func Export(root string, changes []Change) (io.ReadCloser, error) {
+	return archive.TarStream(archive.Uncompressed, func(tw *tar.Writer) error {
+		written := make(map[string]bool)
+
+		writeParents := func(rel string) error {
+			var parents []string
+			for dir := path.Dir(rel); dir != "." && !written[dir]; dir = path.Dir(dir) {
+				parents = append(parents, dir)
+			}
+			for i := len(parents) - 1; i >= 0; i-- {
+				if err := archive.WriteEntry(tw, filepath.Join(root, parents[i]), parents[i]); err != nil {
+					return err
+				}
+				written[parents[i]] = true
+			}
+			return nil
+		}
+
+		for _, change := range changes {
+			if err := writeParents(change.Path); err != nil {
+				return err
+			}
+
+			switch change.Kind {
+			case Added, Modified:
+				if written[change.Path] {
+					continue
+				}
+				if err := archive.WriteEntry(tw, filepath.Join(root, change.Path), change.Path); err != nil {
+					return err
+				}
+				written[change.Path] = true
+
+				if change.Opaque {
+					if err := writeWhiteout(tw, path.Join(change.Path, OpaqueWhiteout)); err != nil {
+						return err
+					}
+				}
+			case Deleted:
+				dir, base := path.Split(change.Path)
+				if err := writeWhiteout(tw, path.Join(dir, WhiteoutPrefix+base)); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown change kind %d for %s", change.Kind, change.Path)
+			}
+		}
+
+		return nil
+	})
+}
+
+func writeWhiteout(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+	})
+}
@@ -0,0 +1,282 @@
+package changes
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkorzh/container-build-tool/internal/types"
+)
+
+type LayerDiff struct {
+	Index int           `json:"index"`
+	Old   digest.Digest `json:"old,omitempty"`
+	New   digest.Digest `json:"new,omitempty"`
+	Same  bool          `json:"same"`
+}
+
+type ConfigDiff struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+type HistoryDiff struct {
+	Index int                `json:"index"`
+	Old   *imgspecv1.History `json:"old,omitempty"`
+	New   *imgspecv1.History `json:"new,omitempty"`
+}
+
+type ImageDiff struct {
+	Layers  []LayerDiff   `json:"layers"`
+	Config  []ConfigDiff  `json:"config"`
+	History []HistoryDiff `json:"history"`
+	Files   []Change      `json:"files"`
+}
+
+// CompareImages compares two images layer by layer, along with their
+// configs, histories and resulting filesystems.
+func CompareImages(old, new types.ImageReader) (*ImageDiff, error) {
+	oldImage, err := old.GetImage()
+	if err != nil {
+		return nil, fmt.Errorf("getting image: %w", err)
+	}
+
+	newImage, err := new.GetImage()
+	if err != nil {
+		return nil, fmt.Errorf("getting image: %w", err)
+	}
+
+	diff := &ImageDiff{
+		Layers:  compareLayers(oldImage.RootFS.DiffIDs, newImage.RootFS.DiffIDs),
+		Config:  compareConfigs(oldImage, newImage),
+		History: compareHistory(oldImage.History, newImage.History),
+	}
+
+	oldFiles, err := imageFiles(old)
+	if err != nil {
+		return nil, err
+	}
+
+	newFiles, err := imageFiles(new)
+	if err != nil {
+		return nil, err
+	}
+
+	diff.Files = Compare(oldFiles, newFiles)
+
+	return diff, nil
+}
+
+// Compare lists the changes between two sets of files keyed by slash
+// separated relative paths.
+func Compare(old, new map[string]*FileInfo) []Change {
+	var changes []Change
+
+	for rel, info := range new {
+		oldInfo, ok := old[rel]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Path: rel, Kind: Added, New: info})
+		case changed(oldInfo, info):
+			changes = append(changes, Change{Path: rel, Kind: Modified, Old: oldInfo, New: info})
+		}
+	}
+
+	for rel, info := range old {
+		if _, ok := new[rel]; ok {
+			continue
+		}
+
+		// Only the topmost deleted path is reported.
+		if parent := path.Dir(rel); parent != "." {
+			if _, ok := old[parent]; ok {
+				if _, ok := new[parent]; !ok {
+					continue
+				}
+			}
+		}
+
+		changes = append(changes, Change{Path: rel, Kind: Deleted, Old: info})
+	}
+
+	sortChanges(changes)
+
+	return changes
+}
+
+// MergeTarLayers returns the files visible through the given layer
+// streams, lowest first, with whiteouts applied.
+func MergeTarLayers(layers []io.Reader) (map[string]*FileInfo, error) {
+	openers := make([]LayerOpener, len(layers))
+	for i, layer := range layers {
+		layer := layer
+		openers[i] = func() (io.ReadCloser, error) {
+			return io.NopCloser(layer), nil
+		}
+	}
+
+	return MergeLayerStreams(openers)
+}
+
+// MergeLayerStreams is MergeTarLayers for layers opened one at a time.
+func MergeLayerStreams(layers []LayerOpener) (map[string]*FileInfo, error) {
+	merged := newMergedTree[*FileInfo]()
+
+	for _, layer := range layers {
+		var entries []string
+		var infos []*FileInfo
+
+		err := readLayer(layer, func(header *tar.Header, _ io.Reader) error {
+			rel := cleanName(header.Name)
+			if rel == "" {
+				return nil
+			}
+
+			dir, base := path.Split(rel)
+			dir = strings.TrimSuffix(dir, "/")
+
+			switch {
+			case base == OpaqueWhiteout:
+				merged.removeChildren(dir)
+			case strings.HasPrefix(base, WhiteoutPrefix):
+				merged.remove(path.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix)))
+			default:
+				entries = append(entries, rel)
+				infos = append(infos, HeaderInfo(header))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for i, rel := range entries {
+			if !infos[i].Mode.IsDir() {
+				merged.removeChildren(rel)
+			}
+			merged.set(rel, infos[i])
+
+			// Layers may omit entries for parent directories.
+			for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+				if merged.has(dir) {
+					break
+				}
+				merged.set(dir, &FileInfo{Mode: os.ModeDir | 0755})
+			}
+		}
+	}
+
+	return merged.entries, nil
+}
+
+// HeaderInfo describes the file of a tar entry.
+func HeaderInfo(header *tar.Header) *FileInfo {
+	info := &FileInfo{
+		Mode:    header.FileInfo().Mode(),
+		UID:     header.Uid,
+		GID:     header.Gid,
+		Size:    header.Size,
+		ModTime: header.ModTime,
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		info.Link = header.Linkname
+	}
+	return info
+}
+
+func imageFiles(reader types.ImageReader) (map[string]*FileInfo, error) {
+	manifest, err := reader.GetManifest()
+	if err != nil {
+		return nil, fmt.Errorf("getting manifest: %w", err)
+	}
+
+	var layers []io.Reader
+	for _, descriptor := range manifest.Layers {
+		blob, err := reader.GetBlob(descriptor)
+		if err != nil {
+			return nil, fmt.Errorf("getting blob: %w", err)
+		}
+		defer blob.Close()
+
+		layers = append(layers, blob)
+	}
+
+	return MergeTarLayers(layers)
+}
+
+func compareLayers(old, new []digest.Digest) []LayerDiff {
+	var diffs []LayerDiff
+
+	for i := 0; i < len(old) || i < len(new); i++ {
+		diff := LayerDiff{Index: i}
+		if i < len(old) {
+			diff.Old = old[i]
+		}
+		if i < len(new) {
+			diff.New = new[i]
+		}
+		diff.Same = diff.Old == diff.New
+		diffs = append(diffs, diff)
+	}
+
+	return diffs
+}
+
+func compareConfigs(old, new *imgspecv1.Image) []ConfigDiff {
+	fields := map[string][2]any{
+		"os":           {old.OS, new.OS},
+		"architecture": {old.Architecture, new.Architecture},
+		"variant":      {old.Variant, new.Variant},
+		"user":         {old.Config.User, new.Config.User},
+		"exposedPorts": {old.Config.ExposedPorts, new.Config.ExposedPorts},
+		"env":          {old.Config.Env, new.Config.Env},
+		"entrypoint":   {old.Config.Entrypoint, new.Config.Entrypoint},
+		"cmd":          {old.Config.Cmd, new.Config.Cmd},
+		"volumes":      {old.Config.Volumes, new.Config.Volumes},
+		"workingDir":   {old.Config.WorkingDir, new.Config.WorkingDir},
+		"labels":       {old.Config.Labels, new.Config.Labels},
+		"stopSignal":   {old.Config.StopSignal, new.Config.StopSignal},
+	}
+
+	var diffs []ConfigDiff
+	for field, values := range fields {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			diffs = append(diffs, ConfigDiff{Field: field, Old: values[0], New: values[1]})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Field < diffs[j].Field
+	})
+
+	return diffs
+}
+
+func compareHistory(old, new []imgspecv1.History) []HistoryDiff {
+	var diffs []HistoryDiff
+
+	for i := 0; i < len(old) || i < len(new); i++ {
+		diff := HistoryDiff{Index: i}
+		if i < len(old) {
+			diff.Old = &old[i]
+		}
+		if i < len(new) {
+			diff.New = &new[i]
+		}
+		if diff.Old != nil && diff.New != nil && reflect.DeepEqual(*diff.Old, *diff.New) {
+			continue
+		}
+		diffs = append(diffs, diff)
+	}
+
+	return diffs
+}
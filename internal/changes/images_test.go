@@ -0,0 +1,90 @@
+package changes
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func tarLayer(t *testing.T, names ...string) io.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		if name[len(name)-1] == '/' {
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestMergeTarLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]string
+		want   []string
+	}{
+		{
+			name:   "whiteout removes subtree",
+			layers: [][]string{{"a/", "a/b/", "a/b/c", "ab"}, {".wh.a"}},
+			want:   []string{"ab"},
+		},
+		{
+			name:   "opaque whiteout keeps the directory",
+			layers: [][]string{{"a/", "a/b", "a/c"}, {"a/", "a/.wh..wh..opq", "a/d"}},
+			want:   []string{"a", "a/d"},
+		},
+		{
+			name:   "file replaces directory",
+			layers: [][]string{{"a/", "a/b/", "a/b/c"}, {"a/b"}},
+			want:   []string{"a", "a/b"},
+		},
+		{
+			name:   "missing parents are added",
+			layers: [][]string{{"a/b/c"}},
+			want:   []string{"a", "a/b", "a/b/c"},
+		},
+		{
+			name:   "root opaque whiteout",
+			layers: [][]string{{"a", "b/", "b/c"}, {".wh..wh..opq", "d"}},
+			want:   []string{"d"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var layers []io.Reader
+			for _, names := range test.layers {
+				layers = append(layers, tarLayer(t, names...))
+			}
+
+			merged, err := MergeTarLayers(layers)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for rel := range merged {
+				got = append(got, rel)
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package changes
+
+import "syscall"
+
+// isOpaque reports whether an overlay directory is marked opaque, either by
+// a privileged or a rootless (userxattr) overlay mount.
+func isOpaque(p string) bool {
+	for _, name := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		value := make([]byte, 1)
+		n, err := syscall.Getxattr(p, name, value)
+		if err == nil && n == 1 && value[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package changes
+
+func isOpaque(p string) bool {
+	return false
+}
@@ -0,0 +1,62 @@
+package changes
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxSymlinks bounds the symlinks followed when resolving a path, as the
+// kernel does.
+const maxSymlinks = 40
+
+// ResolvePath resolves the symlinks in every component of a slash separated
+// relative path against merged files, the way SecureJoin resolves them on
+// disk: absolute links start over from the root and ".." never climbs out
+// of it. Components that don't exist are kept as they are.
+func ResolvePath(files map[string]*FileInfo, rel string) (string, error) {
+	resolved := ""
+	pending := strings.Split(rel, "/")
+	links := 0
+
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = parentDir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info := files[next]
+		if info == nil || info.Mode&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+
+		if path.IsAbs(info.Link) {
+			resolved = ""
+		}
+		pending = append(strings.Split(info.Link, "/"), pending...)
+	}
+
+	return resolved, nil
+}
+
+func parentDir(rel string) string {
+	dir := path.Dir(rel)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,53 @@
+package changes
+
+import (
+	"os"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	files := map[string]*FileInfo{
+		"usr":         {Mode: os.ModeDir | 0755},
+		"usr/bin":     {Mode: os.ModeDir | 0755},
+		"usr/bin/sh":  {Mode: 0755},
+		"bin":         {Mode: os.ModeSymlink | 0777, Link: "usr/bin"},
+		"sbin":        {Mode: os.ModeSymlink | 0777, Link: "/usr/bin"},
+		"etc":         {Mode: os.ModeDir | 0755},
+		"etc/up":      {Mode: os.ModeSymlink | 0777, Link: "../../../usr"},
+		"etc/alt":     {Mode: os.ModeSymlink | 0777, Link: "../bin"},
+		"loop":        {Mode: os.ModeSymlink | 0777, Link: "loop"},
+		"usr/bin/old": {Mode: os.ModeSymlink | 0777, Link: "sh"},
+	}
+
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{rel: "bin", want: "usr/bin"},
+		{rel: "bin/sh", want: "usr/bin/sh"},
+		{rel: "bin/new", want: "usr/bin/new"},
+		{rel: "bin/new/deeper", want: "usr/bin/new/deeper"},
+		{rel: "sbin/sh", want: "usr/bin/sh"},
+		{rel: "etc/up/bin", want: "usr/bin"},
+		{rel: "etc/alt/old", want: "usr/bin/sh"},
+		{rel: "../../bin", want: "usr/bin"},
+		{rel: "bin/..", want: "usr"},
+		{rel: "", want: ""},
+		{rel: "opt/app", want: "opt/app"},
+	}
+
+	for _, tt := range tests {
+		got, err := ResolvePath(files, tt.rel)
+		if err != nil {
+			t.Errorf("ResolvePath(%q): %v", tt.rel, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ResolvePath(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+
+	if _, err := ResolvePath(files, "loop/x"); err == nil {
+		t.Error("ResolvePath(\"loop/x\") succeeded, want too many links")
+	}
+}
@@ -0,0 +1,297 @@
+package changes
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkorzh/container-build-tool/internal/archive"
+)
+
+// LayerOpener opens a layer tar stream, which may be compressed. Squash
+// reads every layer twice.
+type LayerOpener func() (io.ReadCloser, error)
+
+type squashEntry struct {
+	keep bool
+	// opaque marks a directory that replaces one deleted in a squashed
+	// layer, so it must hide what's below the squashed layers.
+	opaque bool
+	// spool marks a hidden file whose content is still needed by a
+	// hardlink to it, which copyFrom names.
+	spool bool
+	// copyFrom, on a hardlink, names the hidden file it's written as a
+	// copy of.
+	copyFrom string
+	// linkname, on a hardlink, replaces its hidden target.
+	linkname string
+}
+
+type squashLink struct {
+	index  int
+	name   string
+	target string
+}
+
+type squashState struct {
+	entries [][]squashEntry
+	// seen holds the paths, and whether they're directories, taken by
+	// upper layers.
+	seen    map[string]bool
+	deleted map[string]bool
+	opaque  map[string]bool
+	// dirs locates the entries of the directories in seen.
+	dirs map[string][2]int
+}
+
+// Squash merges layers, lowest first, into a single tar stream, applying
+// whiteouts. With keepWhiteouts the whiteouts that don't apply within the
+// merged layers are kept, for squashing layers on top of a base; otherwise
+// they're dropped.
+func Squash(layers []LayerOpener, keepWhiteouts bool) (io.ReadCloser, error) {
+	state := &squashState{
+		entries: make([][]squashEntry, len(layers)),
+		seen:    make(map[string]bool),
+		deleted: make(map[string]bool),
+		opaque:  make(map[string]bool),
+		dirs:    make(map[string][2]int),
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := state.scan(i, layers[i], keepWhiteouts); err != nil {
+			return nil, fmt.Errorf("reading layer %d: %w", i, err)
+		}
+	}
+	entries := state.entries
+
+	return archive.TarStream(archive.Uncompressed, func(tw *tar.Writer) error {
+		for i, layer := range layers {
+			if err := copyEntries(tw, layer, entries[i]); err != nil {
+				return fmt.Errorf("copying layer %d: %w", i, err)
+			}
+		}
+		return nil
+	})
+}
+
+// scan decides which entries of a layer stay visible under the layers
+// already scanned. Whiteouts only apply to lower layers, so the state is
+// updated once the whole layer is read.
+func (s *squashState) scan(layer int, open LayerOpener, keepWhiteouts bool) error {
+	var entries []squashEntry
+
+	seen := make(map[string]int)
+	var deleted, opaque []string
+
+	// files locates the entries of the layer for the hardlinks to them.
+	files := make(map[string]int)
+	var links []squashLink
+
+	err := readLayer(open, func(header *tar.Header, _ io.Reader) error {
+		var entry squashEntry
+
+		rel := cleanName(header.Name)
+		dir, base := path.Split(rel)
+		dir = strings.TrimSuffix(dir, "/")
+
+		switch {
+		case base == OpaqueWhiteout:
+			opaque = append(opaque, dir)
+			entry.keep = keepWhiteouts && !s.hidden(rel)
+		case strings.HasPrefix(base, WhiteoutPrefix):
+			target := path.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+			deleted = append(deleted, target)
+			entry.keep = keepWhiteouts && !s.hidden(target)
+
+			// A directory recreated over the deleted one must be opaque,
+			// or what's below the squashed layers would show through.
+			if loc, ok := s.dirs[target]; ok && keepWhiteouts && !s.opaque[target] && !s.shadowed(target) {
+				s.entries[loc[0]][loc[1]].opaque = true
+			}
+		default:
+			files[rel] = len(entries)
+			entry.keep = !s.hidden(rel)
+			if entry.keep && header.Typeflag == tar.TypeLink {
+				links = append(links, squashLink{index: len(entries), name: rel, target: cleanName(header.Linkname)})
+			}
+			if entry.keep {
+				if header.Typeflag == tar.TypeDir {
+					seen[rel] = len(entries)
+				} else {
+					seen[rel] = -1
+				}
+			}
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Hardlinks to files hidden by the upper layers would dangle or link to
+	// the wrong content. The first of them becomes a copy of the file and
+	// the others link to it.
+	copies := make(map[string]string)
+	for _, link := range links {
+		target, ok := files[link.target]
+		if !ok || entries[target].keep {
+			continue
+		}
+		if first, ok := copies[link.target]; ok {
+			entries[link.index].linkname = first
+			continue
+		}
+		entries[target].spool = true
+		entries[link.index].copyFrom = link.target
+		copies[link.target] = link.name
+	}
+
+	for rel, index := range seen {
+		s.seen[rel] = index >= 0
+		if index >= 0 {
+			s.dirs[rel] = [2]int{layer, index}
+		}
+	}
+	for _, rel := range opaque {
+		s.opaque[rel] = true
+	}
+	for _, rel := range deleted {
+		s.deleted[rel] = true
+	}
+
+	s.entries[layer] = entries
+
+	return nil
+}
+
+// hidden reports whether an entry of a lower layer is shadowed by the
+// upper layers.
+func (s *squashState) hidden(rel string) bool {
+	if _, ok := s.seen[rel]; ok || s.deleted[rel] {
+		return true
+	}
+	return s.shadowed(rel)
+}
+
+// shadowed reports whether a parent directory of an entry is replaced or
+// deleted by the upper layers.
+func (s *squashState) shadowed(rel string) bool {
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if isDir, ok := s.seen[dir]; (ok && !isDir) || s.deleted[dir] || s.opaque[dir] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyEntries(tw *tar.Writer, open LayerOpener, entries []squashEntry) error {
+	type spooled struct {
+		header *tar.Header
+		file   *os.File
+	}
+	spool := make(map[string]spooled)
+	defer func() {
+		for _, s := range spool {
+			s.file.Close()
+			os.Remove(s.file.Name())
+		}
+	}()
+
+	i := 0
+	return readLayer(open, func(header *tar.Header, r io.Reader) error {
+		entry := entries[i]
+		i++
+
+		if entry.spool {
+			file, err := os.CreateTemp("", "cbt-squash-")
+			if err != nil {
+				return err
+			}
+			spool[cleanName(header.Name)] = spooled{header: header, file: file}
+			if _, err := io.Copy(file, r); err != nil {
+				return err
+			}
+		}
+
+		if !entry.keep {
+			return nil
+		}
+
+		if entry.copyFrom != "" {
+			s := spool[entry.copyFrom]
+			copied := *s.header
+			copied.Name = header.Name
+			if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			header, r = &copied, s.file
+		}
+		if entry.linkname != "" {
+			header.Linkname = entry.linkname
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return err
+		}
+
+		if entry.opaque {
+			return writeWhiteout(tw, path.Join(cleanName(header.Name), OpaqueWhiteout))
+		}
+
+		return nil
+	})
+}
+
+func readLayer(open LayerOpener, fn func(header *tar.Header, r io.Reader) error) error {
+	layer, err := open()
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	decompressed, _, err := archive.DecompressStream(layer)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(decompressed)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return drain(decompressed)
+		}
+		if err != nil {
+			return fmt.Errorf("tar read: %w", err)
+		}
+
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// drain reads the rest of a layer past the end of its tar archive, so that
+// its compression and the blob it's read from are checked up to EOF.
+func drain(r io.Reader) error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("reading past end of archive: %w", err)
+	}
+	return nil
+}
+
+func cleanName(name string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
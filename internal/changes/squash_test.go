@@ -0,0 +1,127 @@
+package changes
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type squashFile struct {
+	name     string
+	linkname string
+	body     string
+}
+
+func squashLayer(t *testing.T, files ...squashFile) LayerOpener {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.body))}
+		if file.linkname != "" {
+			header.Typeflag = tar.TypeLink
+			header.Linkname = file.linkname
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, file.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+}
+
+func TestSquashHardlinks(t *testing.T) {
+	base := []squashFile{
+		{name: "a", body: "old"},
+		{name: "b", linkname: "a"},
+		{name: "c", linkname: "a"},
+	}
+
+	tests := []struct {
+		name  string
+		upper []squashFile
+		want  []squashFile
+	}{
+		{
+			name:  "target kept",
+			upper: []squashFile{{name: "d", body: "new"}},
+			want: []squashFile{
+				{name: "a", body: "old"},
+				{name: "b", linkname: "a"},
+				{name: "c", linkname: "a"},
+				{name: "d", body: "new"},
+			},
+		},
+		{
+			name:  "target overwritten",
+			upper: []squashFile{{name: "a", body: "new"}},
+			want: []squashFile{
+				{name: "b", body: "old"},
+				{name: "c", linkname: "b"},
+				{name: "a", body: "new"},
+			},
+		},
+		{
+			name:  "target whited out",
+			upper: []squashFile{{name: ".wh.a"}},
+			want: []squashFile{
+				{name: "b", body: "old"},
+				{name: "c", linkname: "b"},
+			},
+		},
+		{
+			name:  "first link whited out too",
+			upper: []squashFile{{name: ".wh.a"}, {name: ".wh.b"}},
+			want: []squashFile{
+				{name: "c", body: "old"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			squashed, err := Squash([]LayerOpener{squashLayer(t, base...), squashLayer(t, tt.upper...)}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer squashed.Close()
+
+			var got []squashFile
+			tr := tar.NewReader(squashed)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file := squashFile{name: header.Name, body: string(body)}
+				if header.Typeflag == tar.TypeLink {
+					file.linkname = header.Linkname
+				}
+				got = append(got, file)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
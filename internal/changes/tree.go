@@ -0,0 +1,55 @@
+package changes
+
+import "path"
+
+// mergedTree holds the entries of merged layers by slash separated relative
+// path, with an index of the children of every directory so that removing
+// a subtree doesn't scan every entry.
+type mergedTree[T any] struct {
+	entries  map[string]T
+	children map[string]map[string]bool
+}
+
+func newMergedTree[T any]() *mergedTree[T] {
+	return &mergedTree[T]{
+		entries:  make(map[string]T),
+		children: make(map[string]map[string]bool),
+	}
+}
+
+func (t *mergedTree[T]) has(rel string) bool {
+	_, ok := t.entries[rel]
+	return ok
+}
+
+func (t *mergedTree[T]) set(rel string, value T) {
+	if !t.has(rel) {
+		parent := path.Dir(rel)
+		if t.children[parent] == nil {
+			t.children[parent] = make(map[string]bool)
+		}
+		t.children[parent][rel] = true
+	}
+	t.entries[rel] = value
+}
+
+// remove removes an entry and everything below it.
+func (t *mergedTree[T]) remove(rel string) {
+	t.removeChildren(rel)
+	delete(t.entries, rel)
+	delete(t.children[path.Dir(rel)], rel)
+}
+
+// removeChildren removes everything below a directory, "." or "" being the
+// root.
+func (t *mergedTree[T]) removeChildren(dir string) {
+	if dir == "" {
+		dir = "."
+	}
+
+	for child := range t.children[dir] {
+		t.removeChildren(child)
+		delete(t.entries, child)
+	}
+	delete(t.children, dir)
+}
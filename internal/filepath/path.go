@@ -1,7 +1,10 @@
 package filepath
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 )
 
 func ResolvePath(path string) (string, error) {
@@ -12,3 +15,65 @@ func ResolvePath(path string) (string, error) {
 
 	return filepath.Clean(resolved), nil
 }
+
+const maxSymlinks = 255
+
+// SecureJoin joins unsafePath to root the way the kernel would resolve it
+// if root were the filesystem root: ".." never climbs above root and
+// symlinks, absolute or relative, are followed but scoped to root.
+// Components which don't exist yet are joined lexically.
+func SecureJoin(root, unsafePath string) (string, error) {
+	var resolved []string
+
+	components := strings.Split(filepath.ToSlash(unsafePath), "/")
+	links := 0
+
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		current := filepath.Join(root, filepath.Join(resolved...), component)
+
+		fi, err := os.Lstat(current)
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = append(resolved, component)
+				continue
+			}
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, component)
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s", unsafePath)
+		}
+
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			resolved = resolved[:0]
+		}
+
+		components = append(strings.Split(filepath.ToSlash(target), "/"), components...)
+	}
+
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
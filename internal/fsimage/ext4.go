@@ -0,0 +1,804 @@
+package fsimage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ext4 without a journal, with 4KiB blocks and 256 byte inodes. Files and
+// directories are stored in extents, directories are linear, symlinks
+// shorter than 60 bytes are kept in the inode, and xattrs go in the inode
+// body or, when they don't fit there, in a block of their own. Some space is
+// left free so the image can be mounted read-write.
+const (
+	ext4BlockSize       = 4096
+	ext4InodeSize       = 256
+	ext4ExtraIsize      = 32
+	ext4BlocksPerGroup  = 8 * ext4BlockSize
+	ext4InodesPerBlock  = ext4BlockSize / ext4InodeSize
+	ext4DescSize        = 32
+	ext4RootIno         = 2
+	ext4FirstIno        = 11
+	ext4Magic           = 0xef53
+	ext4ExtentMagic     = 0xf30a
+	ext4MaxExtentLen    = 32768
+	ext4ExtentsPerBlock = (ext4BlockSize - 12) / 12
+	ext4InodeExtents    = 4
+	ext4FastSymlinkMax  = 60
+	ext4MaxNameLen      = 255
+	ext4XattrMagic      = 0xea020000
+	ext4XattrBlockStart = 32
+	ext4InodeXattrStart = 128 + ext4ExtraIsize
+	ext4ExtentsFlag     = 0x80000
+	ext4MaxLinks        = 65000
+
+	ext4FeatureCompatExtAttr       = 0x0008
+	ext4FeatureIncompatFiletype    = 0x0002
+	ext4FeatureIncompatExtents     = 0x0040
+	ext4FeatureRoCompatSparseSuper = 0x0001
+	ext4FeatureRoCompatLargeFile   = 0x0002
+	ext4FeatureRoCompatDirNlink    = 0x0020
+	ext4FeatureRoCompatExtraIsize  = 0x0040
+)
+
+var ext4XattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"user.", 1},
+	{"trusted.", 4},
+	{"security.", 6},
+}
+
+type ext4Extent struct {
+	logical uint32
+	start   uint32
+	length  uint32
+}
+
+type ext4Xattr struct {
+	index uint8
+	name  string
+	value string
+}
+
+// ext4File is an inode of the image along with the blocks allocated to it.
+type ext4File struct {
+	inode  *Inode
+	number uint32
+	// parent is the inode number of the directory holding a directory.
+	parent uint32
+	links  uint32
+	// data holds the contents of directories and slow symlinks; regular
+	// files are copied from the spool.
+	data    []byte
+	blocks  uint32
+	extents []ext4Extent
+	leaves  []uint32
+	xattrs  []ext4Xattr
+	// xattrBlock is set when the xattrs don't fit in the inode.
+	xattrBlock uint32
+}
+
+type ext4Writer struct {
+	tree    *Tree
+	out     *os.File
+	modTime time.Time
+
+	files   []*ext4File
+	numbers map[*Inode]uint32
+
+	groups         uint32
+	inodesPerGroup uint32
+	blocksCount    uint32
+	gdtBlocks      uint32
+	bitmap         []byte
+	next           uint32
+
+	uuid     [16]byte
+	hashSeed [16]byte
+}
+
+// WriteExt4 writes the tree as an ext4 filesystem image.
+func WriteExt4(tree *Tree, out *os.File, modTime time.Time) error {
+	w := &ext4Writer{
+		tree:    tree,
+		out:     out,
+		modTime: modTime,
+		numbers: make(map[*Inode]uint32),
+	}
+
+	if _, err := rand.Read(w.uuid[:]); err != nil {
+		return err
+	}
+	w.uuid[6] = w.uuid[6]&0x0f | 0x40
+	w.uuid[8] = w.uuid[8]&0x3f | 0x80
+	if _, err := rand.Read(w.hashSeed[:]); err != nil {
+		return err
+	}
+
+	w.number()
+
+	if err := w.prepare(); err != nil {
+		return err
+	}
+
+	var dataBlocks uint32
+	for _, f := range w.files {
+		dataBlocks += f.blocks
+		if f.xattrBlock != 0 {
+			dataBlocks++
+		}
+	}
+	w.layout(dataBlocks, w.files[len(w.files)-1].number)
+
+	if err := w.allocate(); err != nil {
+		return err
+	}
+
+	if err := out.Truncate(int64(w.blocksCount) * ext4BlockSize); err != nil {
+		return err
+	}
+
+	for _, f := range w.files {
+		if err := w.writeData(f); err != nil {
+			return err
+		}
+	}
+
+	return w.writeMetadata()
+}
+
+// number assigns inode numbers, parents before their entries. The root is
+// inode 2 and lost+found, which e2fsck expects, is created as inode 11
+// unless the tree has one.
+func (w *ext4Writer) number() {
+	next := uint32(ext4FirstIno)
+
+	if w.tree.Root.lookup("lost+found") == nil {
+		lostFound := &Inode{Mode: sIFDIR | 0o700, ModTime: w.modTime, Nlink: 1}
+		w.add(lostFound, next, ext4RootIno)
+		next++
+	}
+
+	w.add(w.tree.Root, ext4RootIno, ext4RootIno)
+
+	var walk func(dir *Inode)
+	walk = func(dir *Inode) {
+		for _, entry := range dir.Entries {
+			if _, ok := w.numbers[entry.Inode]; ok {
+				continue
+			}
+			w.add(entry.Inode, next, w.numbers[dir])
+			next++
+			if entry.Inode.IsDir() {
+				walk(entry.Inode)
+			}
+		}
+	}
+	walk(w.tree.Root)
+
+	sort.Slice(w.files, func(i, j int) bool {
+		return w.files[i].number < w.files[j].number
+	})
+}
+
+func (w *ext4Writer) add(inode *Inode, number, parent uint32) {
+	w.numbers[inode] = number
+	w.files = append(w.files, &ext4File{inode: inode, number: number, parent: parent, links: inode.Nlink})
+}
+
+// prepare builds directory listings and works out how many blocks each
+// file needs.
+func (w *ext4Writer) prepare() error {
+	for _, f := range w.files {
+		inode := f.inode
+
+		switch inode.Type() {
+		case sIFDIR:
+			if err := w.prepareDir(f); err != nil {
+				return err
+			}
+		case sIFREG:
+			f.blocks = uint32((inode.Size + ext4BlockSize - 1) / ext4BlockSize)
+		case sIFLNK:
+			if len(inode.Link) >= ext4BlockSize {
+				return fmt.Errorf("symlink target of %d bytes is too long", len(inode.Link))
+			}
+			if len(inode.Link) >= ext4FastSymlinkMax {
+				f.data = []byte(inode.Link)
+				f.blocks = 1
+			}
+		}
+
+		f.xattrs = ext4Xattrs(inode.Xattrs)
+		if len(f.xattrs) > 0 && !packXattrs(make([]byte, ext4InodeSize-ext4InodeXattrStart-4), 0, f.xattrs) {
+			if !packXattrs(make([]byte, ext4BlockSize-ext4XattrBlockStart), ext4XattrBlockStart, f.xattrs) {
+				return errors.New("xattrs don't fit in a block")
+			}
+			// Set for real once blocks are allocated.
+			f.xattrBlock = math.MaxUint32
+		}
+	}
+
+	return nil
+}
+
+type ext4DirEntry struct {
+	name   string
+	number uint32
+	kind   uint8
+}
+
+func (w *ext4Writer) prepareDir(f *ext4File) error {
+	entries := []ext4DirEntry{{".", f.number, 2}, {"..", f.parent, 2}}
+
+	subdirs := uint32(0)
+	children := f.inode.Entries
+	if f.inode == w.tree.Root && f.inode.lookup("lost+found") == nil {
+		entries = append(entries, ext4DirEntry{"lost+found", ext4FirstIno, 2})
+		subdirs++
+	}
+	for _, entry := range children {
+		if len(entry.Name) > ext4MaxNameLen {
+			return fmt.Errorf("file name %q is too long", entry.Name)
+		}
+		if entry.Inode.IsDir() {
+			subdirs++
+		}
+		entries = append(entries, ext4DirEntry{entry.Name, w.numbers[entry.Inode], ext4FileType(entry.Inode)})
+	}
+
+	f.links = 2 + subdirs
+	if f.links > ext4MaxLinks {
+		f.links = 1
+	}
+
+	f.data = ext4Listing(entries)
+	f.blocks = uint32(len(f.data) / ext4BlockSize)
+
+	return nil
+}
+
+// ext4Listing packs directory entries into blocks, the last entry of each
+// block taking up the rest of it.
+func ext4Listing(entries []ext4DirEntry) []byte {
+	var out []byte
+	block := make([]byte, 0, ext4BlockSize)
+	last := -1
+
+	for _, entry := range entries {
+		size := 8 + (len(entry.name)+3)&^3
+		if len(block)+size > ext4BlockSize {
+			binary.LittleEndian.PutUint16(block[last+4:], uint16(ext4BlockSize-last))
+			out = append(out, block[:ext4BlockSize]...)
+			block = make([]byte, 0, ext4BlockSize)
+		}
+
+		last = len(block)
+		record := make([]byte, size)
+		binary.LittleEndian.PutUint32(record[0:], entry.number)
+		binary.LittleEndian.PutUint16(record[4:], uint16(size))
+		record[6] = uint8(len(entry.name))
+		record[7] = entry.kind
+		copy(record[8:], entry.name)
+		block = append(block, record...)
+	}
+
+	binary.LittleEndian.PutUint16(block[last+4:], uint16(ext4BlockSize-last))
+	return append(out, block[:ext4BlockSize]...)
+}
+
+func ext4FileType(inode *Inode) uint8 {
+	switch inode.Type() {
+	case sIFREG:
+		return 1
+	case sIFDIR:
+		return 2
+	case sIFCHR:
+		return 3
+	case sIFBLK:
+		return 4
+	case sIFIFO:
+		return 5
+	case sIFSOCK:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// ext4Xattrs returns the xattrs ext4 can store, in the order the kernel
+// keeps them.
+func ext4Xattrs(xattrs map[string]string) []ext4Xattr {
+	var out []ext4Xattr
+	for name, value := range xattrs {
+		for _, prefix := range ext4XattrPrefixes {
+			if suffix, ok := strings.CutPrefix(name, prefix.prefix); ok {
+				out = append(out, ext4Xattr{prefix.index, suffix, value})
+				break
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	return out
+}
+
+// packXattrs writes xattr entries from the start of buf, followed by a
+// terminator, and their values from its end. Value offsets are relative to
+// base bytes before buf. It reports whether they fit.
+func packXattrs(buf []byte, base int, xattrs []ext4Xattr) bool {
+	pos, end := 0, len(buf)
+
+	for _, xattr := range xattrs {
+		size := 16 + (len(xattr.name)+3)&^3
+		valueSize := (len(xattr.value) + 3) &^ 3
+		if pos+size+4 > end-valueSize || len(xattr.name) > 255 {
+			return false
+		}
+		end -= valueSize
+
+		entry := buf[pos : pos+size]
+		entry[0] = uint8(len(xattr.name))
+		entry[1] = xattr.index
+		binary.LittleEndian.PutUint16(entry[2:], uint16(base+end))
+		binary.LittleEndian.PutUint32(entry[8:], uint32(len(xattr.value)))
+		binary.LittleEndian.PutUint32(entry[12:], ext4XattrHash(xattr))
+		copy(entry[16:], xattr.name)
+		copy(buf[end:], xattr.value)
+		pos += size
+	}
+
+	return true
+}
+
+// ext4XattrHash is the entry hash checked by e2fsck.
+func ext4XattrHash(xattr ext4Xattr) uint32 {
+	var hash uint32
+	for i := 0; i < len(xattr.name); i++ {
+		hash = hash<<5 ^ hash>>27 ^ uint32(xattr.name[i])
+	}
+
+	value := make([]byte, (len(xattr.value)+3)&^3)
+	copy(value, xattr.value)
+	for i := 0; i < len(value); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ binary.LittleEndian.Uint32(value[i:])
+	}
+
+	return hash
+}
+
+// layout sizes the filesystem: enough groups to hold the data, the inodes
+// and their metadata, with a tenth more of each left free.
+func (w *ext4Writer) layout(dataBlocks, inodes uint32) {
+	inodes += inodes/10 + 64
+	dataBlocks += dataBlocks/10 + 256
+
+	w.groups = 1
+	for {
+		w.inodesPerGroup = (inodes + w.groups - 1) / w.groups
+		w.inodesPerGroup = (w.inodesPerGroup + ext4InodesPerBlock - 1) / ext4InodesPerBlock * ext4InodesPerBlock
+		if w.inodesPerGroup > ext4BlocksPerGroup {
+			w.groups = (inodes + ext4BlocksPerGroup - 1) / ext4BlocksPerGroup
+			continue
+		}
+		w.gdtBlocks = (w.groups*ext4DescSize + ext4BlockSize - 1) / ext4BlockSize
+
+		total := dataBlocks
+		for g := uint32(0); g < w.groups; g++ {
+			total += w.overhead(g)
+		}
+
+		needed := (total + ext4BlocksPerGroup - 1) / ext4BlocksPerGroup
+		if needed <= w.groups {
+			last := w.groups - 1
+			w.blocksCount = max(total, last*ext4BlocksPerGroup+w.overhead(last)+64)
+			return
+		}
+		w.groups = needed
+	}
+}
+
+// overhead is the number of metadata blocks at the start of a group.
+func (w *ext4Writer) overhead(group uint32) uint32 {
+	n := 2 + w.inodesPerGroup/ext4InodesPerBlock
+	if ext4HasSuper(group) {
+		n += 1 + w.gdtBlocks
+	}
+	return n
+}
+
+// ext4HasSuper reports whether a group holds a copy of the superblock and
+// group descriptors: the first two and powers of 3, 5 and 7 with
+// sparse_super.
+func ext4HasSuper(group uint32) bool {
+	if group <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *ext4Writer) used(block uint32) bool {
+	return w.bitmap[block/8]&(1<<(block%8)) != 0
+}
+
+func (w *ext4Writer) use(block uint32) {
+	w.bitmap[block/8] |= 1 << (block % 8)
+}
+
+// allocate marks the metadata blocks used and hands out the rest to files
+// in inode order.
+func (w *ext4Writer) allocate() error {
+	w.bitmap = make([]byte, w.groups*ext4BlockSize)
+
+	for g := uint32(0); g < w.groups; g++ {
+		for i := uint32(0); i < w.overhead(g); i++ {
+			w.use(g*ext4BlocksPerGroup + i)
+		}
+	}
+	// Bits past the end of the last group are set as padding.
+	for b := w.blocksCount; b < w.groups*ext4BlocksPerGroup; b++ {
+		w.use(b)
+	}
+
+	for _, f := range w.files {
+		extents, err := w.alloc(f.blocks)
+		if err != nil {
+			return err
+		}
+		f.extents = extents
+
+		if f.xattrBlock != 0 {
+			block, err := w.alloc(1)
+			if err != nil {
+				return err
+			}
+			f.xattrBlock = block[0].start
+		}
+	}
+
+	for _, f := range w.files {
+		if len(f.extents) <= ext4InodeExtents {
+			continue
+		}
+		leaves := (len(f.extents) + ext4ExtentsPerBlock - 1) / ext4ExtentsPerBlock
+		if leaves > ext4InodeExtents {
+			return fmt.Errorf("file of %d bytes is too fragmented", f.inode.Size)
+		}
+		for i := 0; i < leaves; i++ {
+			block, err := w.alloc(1)
+			if err != nil {
+				return err
+			}
+			f.leaves = append(f.leaves, block[0].start)
+		}
+	}
+
+	return nil
+}
+
+// alloc returns extents covering n free blocks.
+func (w *ext4Writer) alloc(n uint32) ([]ext4Extent, error) {
+	var extents []ext4Extent
+
+	for logical := uint32(0); logical < n; {
+		for w.next < w.blocksCount && w.used(w.next) {
+			w.next++
+		}
+		if w.next >= w.blocksCount {
+			return nil, errors.New("out of space")
+		}
+
+		extent := ext4Extent{logical: logical, start: w.next}
+		for w.next < w.blocksCount && !w.used(w.next) && logical < n && extent.length < ext4MaxExtentLen {
+			w.use(w.next)
+			w.next++
+			extent.length++
+			logical++
+		}
+		extents = append(extents, extent)
+	}
+
+	return extents, nil
+}
+
+func (w *ext4Writer) writeData(f *ext4File) error {
+	for _, extent := range f.extents {
+		offset := int64(extent.start) * ext4BlockSize
+		logical := int64(extent.logical) * ext4BlockSize
+		length := int64(extent.length) * ext4BlockSize
+
+		var r io.Reader
+		if f.inode.Type() == sIFREG {
+			r = io.NewSectionReader(w.tree.spool, f.inode.offset+logical, min(length, f.inode.Size-logical))
+		} else {
+			r = bytes.NewReader(f.data[logical:min(logical+length, int64(len(f.data)))])
+		}
+
+		if _, err := io.Copy(io.NewOffsetWriter(w.out, offset), r); err != nil {
+			return err
+		}
+	}
+
+	for i, leaf := range f.leaves {
+		extents := f.extents[i*ext4ExtentsPerBlock : min((i+1)*ext4ExtentsPerBlock, len(f.extents))]
+		block := make([]byte, ext4BlockSize)
+		putExtents(block, extents, ext4ExtentsPerBlock)
+		if _, err := w.out.WriteAt(block, int64(leaf)*ext4BlockSize); err != nil {
+			return err
+		}
+	}
+
+	if f.xattrBlock != 0 {
+		block := make([]byte, ext4BlockSize)
+		binary.LittleEndian.PutUint32(block[0:], ext4XattrMagic)
+		binary.LittleEndian.PutUint32(block[4:], 1)
+		binary.LittleEndian.PutUint32(block[8:], 1)
+		packXattrs(block[ext4XattrBlockStart:], ext4XattrBlockStart, f.xattrs)
+
+		var hash uint32
+		for _, xattr := range f.xattrs {
+			hash = hash<<16 ^ hash>>16 ^ ext4XattrHash(xattr)
+		}
+		binary.LittleEndian.PutUint32(block[12:], hash)
+
+		if _, err := w.out.WriteAt(block, int64(f.xattrBlock)*ext4BlockSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putExtents writes an extent tree node holding leaf extents.
+func putExtents(b []byte, extents []ext4Extent, capacity int) {
+	binary.LittleEndian.PutUint16(b[0:], ext4ExtentMagic)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(extents)))
+	binary.LittleEndian.PutUint16(b[4:], uint16(capacity))
+	for i, extent := range extents {
+		e := b[12+12*i:]
+		binary.LittleEndian.PutUint32(e[0:], extent.logical)
+		binary.LittleEndian.PutUint16(e[4:], uint16(extent.length))
+		binary.LittleEndian.PutUint32(e[8:], extent.start)
+	}
+}
+
+func (w *ext4Writer) encodeInode(f *ext4File) []byte {
+	b := make([]byte, ext4InodeSize)
+	le := binary.LittleEndian
+	inode := f.inode
+
+	var size uint64
+	switch inode.Type() {
+	case sIFREG:
+		size = uint64(inode.Size)
+	case sIFDIR:
+		size = uint64(len(f.data))
+	case sIFLNK:
+		size = uint64(len(inode.Link))
+	}
+
+	blocks := f.blocks + uint32(len(f.leaves))
+	if f.xattrBlock != 0 {
+		blocks++
+	}
+
+	seconds, extra := ext4Time(inode.ModTime)
+
+	le.PutUint16(b[0:], uint16(inode.Mode))
+	le.PutUint16(b[2:], uint16(inode.UID))
+	le.PutUint32(b[4:], uint32(size))
+	le.PutUint32(b[8:], seconds)
+	le.PutUint32(b[12:], seconds)
+	le.PutUint32(b[16:], seconds)
+	le.PutUint16(b[24:], uint16(inode.GID))
+	le.PutUint16(b[26:], uint16(f.links))
+	le.PutUint32(b[28:], blocks*(ext4BlockSize/512))
+	le.PutUint32(b[104:], f.xattrBlock)
+	le.PutUint32(b[108:], uint32(size>>32))
+	le.PutUint16(b[120:], uint16(inode.UID>>16))
+	le.PutUint16(b[122:], uint16(inode.GID>>16))
+	le.PutUint16(b[128:], ext4ExtraIsize)
+	le.PutUint32(b[132:], extra)
+	le.PutUint32(b[136:], extra)
+	le.PutUint32(b[140:], extra)
+	le.PutUint32(b[144:], seconds)
+	le.PutUint32(b[148:], extra)
+
+	iblock := b[40:100]
+	switch {
+	case inode.Type() == sIFLNK && f.blocks == 0:
+		copy(iblock, inode.Link)
+	case inode.Type() == sIFCHR || inode.Type() == sIFBLK:
+		if inode.Devmajor < 256 && inode.Devminor < 256 {
+			le.PutUint32(iblock[0:], inode.Devmajor<<8|inode.Devminor)
+		} else {
+			le.PutUint32(iblock[4:], encodeDev(inode.Devmajor, inode.Devminor))
+		}
+	case inode.Type() == sIFIFO || inode.Type() == sIFSOCK:
+	default:
+		le.PutUint32(b[32:], ext4ExtentsFlag)
+		if f.leaves == nil {
+			putExtents(iblock, f.extents, ext4InodeExtents)
+			break
+		}
+		le.PutUint16(iblock[0:], ext4ExtentMagic)
+		le.PutUint16(iblock[2:], uint16(len(f.leaves)))
+		le.PutUint16(iblock[4:], ext4InodeExtents)
+		le.PutUint16(iblock[6:], 1)
+		for i, leaf := range f.leaves {
+			index := iblock[12+12*i:]
+			le.PutUint32(index[0:], f.extents[i*ext4ExtentsPerBlock].logical)
+			le.PutUint32(index[4:], leaf)
+		}
+	}
+
+	if len(f.xattrs) > 0 && f.xattrBlock == 0 {
+		le.PutUint32(b[ext4InodeXattrStart:], ext4XattrMagic)
+		packXattrs(b[ext4InodeXattrStart+4:], 0, f.xattrs)
+	}
+
+	return b
+}
+
+// ext4Time encodes a timestamp as its low 32 bits of seconds and the extra
+// field holding the epoch bits and nanoseconds.
+func ext4Time(t time.Time) (uint32, uint32) {
+	seconds := max(t.Unix(), math.MinInt32)
+	epoch := uint32((seconds-int64(int32(seconds)))>>32) & 3
+	return uint32(seconds), uint32(t.Nanosecond())<<2 | epoch
+}
+
+// writeMetadata writes the inode tables, bitmaps, group descriptors and the
+// superblock with its backups.
+func (w *ext4Writer) writeMetadata() error {
+	le := binary.LittleEndian
+
+	descriptors := make([]byte, w.gdtBlocks*ext4BlockSize)
+	var freeBlocks, freeInodes uint32
+
+	files := w.files
+	for g := uint32(0); g < w.groups; g++ {
+		start := g*ext4BlocksPerGroup + w.overhead(g) - 2 - w.inodesPerGroup/ext4InodesPerBlock
+		first := g*w.inodesPerGroup + 1
+
+		inodeBitmap := make([]byte, ext4BlockSize)
+		inodeTable := make([]byte, w.inodesPerGroup*ext4InodeSize)
+		var usedInodes, dirs uint32
+
+		for number := first; number < first+w.inodesPerGroup; number++ {
+			if number >= ext4FirstIno && (len(files) == 0 || files[0].number != number) {
+				continue
+			}
+			i := number - first
+			inodeBitmap[i/8] |= 1 << (i % 8)
+			usedInodes++
+
+			if len(files) > 0 && files[0].number == number {
+				if files[0].inode.IsDir() {
+					dirs++
+				}
+				copy(inodeTable[i*ext4InodeSize:], w.encodeInode(files[0]))
+				files = files[1:]
+			}
+		}
+		for i := w.inodesPerGroup; i < ext4BlockSize*8; i++ {
+			inodeBitmap[i/8] |= 1 << (i % 8)
+		}
+
+		blockBitmap := w.bitmap[g*ext4BlockSize : (g+1)*ext4BlockSize]
+		var usedBlocks uint32
+		for _, b := range blockBitmap {
+			usedBlocks += uint32(bits.OnesCount8(b))
+		}
+		groupFree := ext4BlocksPerGroup - usedBlocks
+
+		for i, data := range [][]byte{blockBitmap, inodeBitmap, inodeTable} {
+			if _, err := w.out.WriteAt(data, int64(start+uint32(i))*ext4BlockSize); err != nil {
+				return err
+			}
+		}
+
+		d := descriptors[g*ext4DescSize:]
+		le.PutUint32(d[0:], start)
+		le.PutUint32(d[4:], start+1)
+		le.PutUint32(d[8:], start+2)
+		le.PutUint16(d[12:], uint16(groupFree))
+		le.PutUint16(d[14:], uint16(w.inodesPerGroup-usedInodes))
+		le.PutUint16(d[16:], uint16(dirs))
+
+		freeBlocks += groupFree
+		freeInodes += w.inodesPerGroup - usedInodes
+	}
+
+	for g := uint32(0); g < w.groups; g++ {
+		if !ext4HasSuper(g) {
+			continue
+		}
+
+		offset := int64(g) * ext4BlocksPerGroup * ext4BlockSize
+		sb := w.superblock(g, freeBlocks, freeInodes)
+		if g == 0 {
+			// The first 1KiB is left for a boot sector.
+			if _, err := w.out.WriteAt(sb, 1024); err != nil {
+				return err
+			}
+		} else if _, err := w.out.WriteAt(sb, offset); err != nil {
+			return err
+		}
+
+		if _, err := w.out.WriteAt(descriptors, offset+ext4BlockSize); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *ext4Writer) superblock(group, freeBlocks, freeInodes uint32) []byte {
+	sb := make([]byte, 1024)
+	le := binary.LittleEndian
+	created := uint32(max(w.modTime.Unix(), 0))
+
+	le.PutUint32(sb[0:], w.groups*w.inodesPerGroup)
+	le.PutUint32(sb[4:], w.blocksCount)
+	le.PutUint32(sb[12:], freeBlocks)
+	le.PutUint32(sb[16:], freeInodes)
+	le.PutUint32(sb[24:], 2)
+	le.PutUint32(sb[28:], 2)
+	le.PutUint32(sb[32:], ext4BlocksPerGroup)
+	le.PutUint32(sb[36:], ext4BlocksPerGroup)
+	le.PutUint32(sb[40:], w.inodesPerGroup)
+	le.PutUint32(sb[48:], created)
+	le.PutUint16(sb[54:], math.MaxUint16)
+	le.PutUint16(sb[56:], ext4Magic)
+	le.PutUint16(sb[58:], 1)
+	le.PutUint16(sb[60:], 1)
+	le.PutUint32(sb[64:], created)
+	le.PutUint32(sb[76:], 1)
+	le.PutUint32(sb[84:], ext4FirstIno)
+	le.PutUint16(sb[88:], ext4InodeSize)
+	le.PutUint16(sb[90:], uint16(group))
+	le.PutUint32(sb[92:], ext4FeatureCompatExtAttr)
+	le.PutUint32(sb[96:], ext4FeatureIncompatFiletype|ext4FeatureIncompatExtents)
+	le.PutUint32(sb[100:], ext4FeatureRoCompatSparseSuper|ext4FeatureRoCompatLargeFile|
+		ext4FeatureRoCompatDirNlink|ext4FeatureRoCompatExtraIsize)
+	copy(sb[104:], w.uuid[:])
+	copy(sb[236:], w.hashSeed[:])
+	sb[252] = 1
+	le.PutUint32(sb[264:], created)
+	le.PutUint16(sb[348:], ext4ExtraIsize)
+	le.PutUint16(sb[350:], ext4ExtraIsize)
+
+	return sb
+}
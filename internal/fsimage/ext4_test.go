@@ -0,0 +1,143 @@
+package fsimage
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type ext4Stat struct {
+	number uint64
+	mode   uint64
+	uid    int
+	gid    int
+}
+
+// TestWriteExt4 checks an image with e2fsck and reads it back with debugfs,
+// when e2fsprogs is installed.
+func TestWriteExt4(t *testing.T) {
+	for _, tool := range []string{"e2fsck", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	img := filepath.Join(dir, "rootfs.ext4")
+
+	out, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if err := WriteExt4(fixtureTree(t), out, fixtureModTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if output, err := exec.Command("e2fsck", "-fn", img).CombinedOutput(); err != nil {
+		t.Fatalf("e2fsck: %v\n%s", err, output)
+	}
+
+	debugfs := func(request string) string {
+		t.Helper()
+		output, err := exec.Command("debugfs", "-R", request, img).Output()
+		if err != nil {
+			t.Fatalf("debugfs %s: %v", request, err)
+		}
+		return string(output)
+	}
+
+	// ls -p prints /number/mode/uid/gid/name/size/ per entry.
+	stats := make(map[string]ext4Stat)
+	var list func(dir string)
+	list = func(dir string) {
+		for _, line := range strings.Split(debugfs("ls -p /"+dir), "\n") {
+			fields := strings.Split(line, "/")
+			if len(fields) < 6 || fields[5] == "." || fields[5] == ".." {
+				continue
+			}
+			var stat ext4Stat
+			stat.number, _ = strconv.ParseUint(fields[1], 10, 32)
+			stat.mode, _ = strconv.ParseUint(fields[2], 8, 32)
+			stat.uid, _ = strconv.Atoi(fields[3])
+			stat.gid, _ = strconv.Atoi(fields[4])
+
+			rel := path.Join(dir, fields[5])
+			stats[rel] = stat
+			if stat.mode&sIFMT == sIFDIR {
+				list(rel)
+			}
+		}
+	}
+	list("")
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	debugfs("rdump / " + rootfs)
+
+	for _, file := range fixtureFiles() {
+		rel := strings.TrimSuffix(file.name, "/")
+		stat, ok := stats[rel]
+		if !ok {
+			t.Errorf("%s is missing", rel)
+			continue
+		}
+
+		if file.typeflag == tar.TypeLink {
+			if target := stats[file.linkname]; stat.number != target.number {
+				t.Errorf("%s is inode %d, want %s's %d", rel, stat.number, file.linkname, target.number)
+			}
+			continue
+		}
+
+		var kind uint64
+		switch file.typeflag {
+		case tar.TypeDir:
+			kind = sIFDIR
+		case tar.TypeSymlink:
+			kind = sIFLNK
+		default:
+			kind = sIFREG
+		}
+		want := ext4Stat{number: stat.number, mode: kind | uint64(file.mode), uid: file.uid, gid: file.gid}
+		if stat != want {
+			t.Errorf("%s: got %+v, want %+v", rel, stat, want)
+		}
+
+		switch file.typeflag {
+		case tar.TypeReg:
+			contents, err := os.ReadFile(filepath.Join(rootfs, rel))
+			if err != nil {
+				t.Error(err)
+			} else if string(contents) != file.body {
+				t.Errorf("%s: got %d bytes of contents, want %d", rel, len(contents), len(file.body))
+			}
+		case tar.TypeSymlink:
+			if link, err := os.Readlink(filepath.Join(rootfs, rel)); err != nil || link != file.linkname {
+				t.Errorf("%s: links to %q (%v), want %q", rel, link, err, file.linkname)
+			}
+		}
+
+		for name, value := range file.xattrs {
+			valueFile := filepath.Join(dir, "xattr")
+			debugfs(fmt.Sprintf("ea_get -f %s /%s %s", valueFile, rel, name))
+			got, err := os.ReadFile(valueFile)
+			if err != nil || string(got) != value {
+				t.Errorf("%s: xattr %s is %q (%v), want %q", rel, name, got, err, value)
+			}
+		}
+	}
+
+	if home := stats["home"]; home.mode != sIFDIR|0o755 {
+		t.Errorf("home mode %o, want %o", home.mode, sIFDIR|0o755)
+	}
+}
@@ -0,0 +1,623 @@
+package fsimage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Squashfs 4.0 as read by the Linux kernel. Data and metadata blocks are
+// zlib compressed when that makes them smaller. Files have no fragments and
+// every inode uses the extended form, which carries link counts and xattrs.
+const (
+	squashfsMagic          = 0x73717368
+	squashfsBlockSize      = 128 << 10
+	squashfsBlockLog       = 17
+	squashfsMetadataSize   = 8192
+	squashfsCompressionGz  = 1
+	squashfsFlagNoFrags    = 0x0010
+	squashfsFlagNoXattrs   = 0x0200
+	squashfsSuperblockSize = 96
+	squashfsInvalidTable   = math.MaxUint64
+	squashfsInvalidFrag    = math.MaxUint32
+	squashfsNoXattr        = math.MaxUint32
+	squashfsUncompressed   = 1 << 15
+	squashfsDataRaw        = 1 << 24
+
+	squashfsDirType     = 1
+	squashfsFileType    = 2
+	squashfsSymlinkType = 3
+	squashfsBlkType     = 4
+	squashfsChrType     = 5
+	squashfsFifoType    = 6
+	squashfsSocketType  = 7
+	// Extended inode types are the basic ones plus this.
+	squashfsExtended = 7
+)
+
+var squashfsXattrPrefixes = []string{"user.", "trusted.", "security."}
+
+// metadataWriter packs metadata into blocks of 8KiB, each stored with a
+// two byte header.
+type metadataWriter struct {
+	out     bytes.Buffer
+	current bytes.Buffer
+}
+
+// ref returns the location of the next byte: the offset of its block from
+// the start of the table and its offset within the uncompressed block.
+func (m *metadataWriter) ref() (uint64, uint16) {
+	return uint64(m.out.Len()), uint16(m.current.Len())
+}
+
+func (m *metadataWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := min(len(p), squashfsMetadataSize-m.current.Len())
+		m.current.Write(p[:chunk])
+		p = p[chunk:]
+		if m.current.Len() == squashfsMetadataSize {
+			if err := m.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (m *metadataWriter) flush() error {
+	if m.current.Len() == 0 {
+		return nil
+	}
+
+	block, compressed, err := compressBlock(m.current.Bytes())
+	if err != nil {
+		return err
+	}
+
+	header := uint16(len(block))
+	if !compressed {
+		header |= squashfsUncompressed
+	}
+
+	binary.Write(&m.out, binary.LittleEndian, header)
+	m.out.Write(block)
+	m.current.Reset()
+
+	return nil
+}
+
+func (m *metadataWriter) bytes() ([]byte, error) {
+	if err := m.flush(); err != nil {
+		return nil, err
+	}
+	return m.out.Bytes(), nil
+}
+
+func compressBlock(data []byte) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	zw, err := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if buf.Len() >= len(data) {
+		return data, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+type squashfsWriter struct {
+	tree *Tree
+	out  *os.File
+
+	ids    []uint32
+	idMap  map[uint32]uint16
+	xattrs map[*Inode]uint32
+
+	// Per inode state.
+	blocksStart map[*Inode]uint64
+	blockSizes  map[*Inode][]uint32
+	refs        map[*Inode]uint64
+
+	inodeTable metadataWriter
+	dirTable   metadataWriter
+	xattrTable metadataWriter
+	xattrIDs   metadataWriter
+
+	inodeCount uint32
+}
+
+// WriteSquashfs writes the tree as a squashfs image.
+func WriteSquashfs(tree *Tree, out *os.File, modTime time.Time) error {
+	w := &squashfsWriter{
+		tree:        tree,
+		out:         out,
+		idMap:       make(map[uint32]uint16),
+		xattrs:      make(map[*Inode]uint32),
+		blocksStart: make(map[*Inode]uint64),
+		blockSizes:  make(map[*Inode][]uint32),
+		refs:        make(map[*Inode]uint64),
+	}
+
+	if _, err := out.Seek(squashfsSuperblockSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	err := tree.Walk(func(inode *Inode) error {
+		w.id(inode.UID)
+		w.id(inode.GID)
+		if err := w.addXattrs(inode); err != nil {
+			return err
+		}
+		if inode.Type() == sIFREG {
+			return w.writeData(inode)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(w.ids) > math.MaxUint16 {
+		return fmt.Errorf("too many distinct uids and gids: %d", len(w.ids))
+	}
+
+	w.number(tree.Root)
+
+	// The root directory's parent is one past the last inode.
+	if err := w.writeDir(tree.Root, w.inodeCount+1); err != nil {
+		return err
+	}
+
+	pos, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	inodeTableStart := uint64(pos)
+	inodeTable, err := w.inodeTable.bytes()
+	if err != nil {
+		return err
+	}
+	dirTableStart := inodeTableStart + uint64(len(inodeTable))
+	dirTable, err := w.dirTable.bytes()
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(inodeTable, dirTable...)); err != nil {
+		return err
+	}
+
+	// There are no fragments, but like mksquashfs the empty fragment table
+	// still gets a location, which some readers expect.
+	fragTableStart := dirTableStart + uint64(len(dirTable))
+
+	idTableStart, err := w.writeTable(fragTableStart, func(m *metadataWriter) {
+		for _, id := range w.ids {
+			binary.Write(m, binary.LittleEndian, id)
+		}
+	}, len(w.ids)*4)
+	if err != nil {
+		return err
+	}
+
+	end := idTableStart + uint64(8*((len(w.ids)*4+squashfsMetadataSize-1)/squashfsMetadataSize))
+
+	flags := uint16(squashfsFlagNoFrags)
+	xattrIDTableStart := uint64(squashfsInvalidTable)
+
+	if len(w.xattrs) > 0 {
+		xattrTableStart := end
+		kv, err := w.xattrTable.bytes()
+		if err != nil {
+			return err
+		}
+		ids, err := w.xattrIDs.bytes()
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(append(kv, ids...)); err != nil {
+			return err
+		}
+
+		xattrIDTableStart = xattrTableStart + uint64(len(kv)) + uint64(len(ids))
+		idBlocks := (len(w.xattrs)*16 + squashfsMetadataSize - 1) / squashfsMetadataSize
+
+		var table bytes.Buffer
+		binary.Write(&table, binary.LittleEndian, xattrTableStart)
+		binary.Write(&table, binary.LittleEndian, uint32(len(w.xattrs)))
+		binary.Write(&table, binary.LittleEndian, uint32(0))
+		for _, offset := range blockOffsets(ids, idBlocks) {
+			binary.Write(&table, binary.LittleEndian, xattrTableStart+uint64(len(kv))+offset)
+		}
+		if _, err := out.Write(table.Bytes()); err != nil {
+			return err
+		}
+
+		end = xattrIDTableStart + uint64(table.Len())
+	} else {
+		flags |= squashfsFlagNoXattrs
+	}
+
+	// Images are padded to 4KiB so they can be used as block devices.
+	if pad := (4096 - end%4096) % 4096; pad > 0 {
+		if _, err := out.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+
+	rootRef := w.refs[tree.Root]
+
+	var sb bytes.Buffer
+	for _, v := range []any{
+		uint32(squashfsMagic),
+		w.inodeCount,
+		uint32(max(modTime.Unix(), 0)),
+		uint32(squashfsBlockSize),
+		uint32(0),
+		uint16(squashfsCompressionGz),
+		uint16(squashfsBlockLog),
+		flags,
+		uint16(len(w.ids)),
+		uint16(4),
+		uint16(0),
+		rootRef,
+		end,
+		idTableStart,
+		xattrIDTableStart,
+		inodeTableStart,
+		dirTableStart,
+		fragTableStart,
+		uint64(squashfsInvalidTable),
+	} {
+		binary.Write(&sb, binary.LittleEndian, v)
+	}
+
+	if _, err := out.WriteAt(sb.Bytes(), 0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// writeTable writes a table stored in metadata blocks followed by the
+// locations of those blocks, returning where the locations start.
+func (w *squashfsWriter) writeTable(start uint64, fill func(m *metadataWriter), size int) (uint64, error) {
+	var m metadataWriter
+	fill(&m)
+
+	data, err := m.bytes()
+	if err != nil {
+		return 0, err
+	}
+
+	blocks := (size + squashfsMetadataSize - 1) / squashfsMetadataSize
+
+	var index bytes.Buffer
+	for _, offset := range blockOffsets(data, blocks) {
+		binary.Write(&index, binary.LittleEndian, start+offset)
+	}
+
+	if _, err := w.out.Write(append(data, index.Bytes()...)); err != nil {
+		return 0, err
+	}
+
+	return start + uint64(len(data)), nil
+}
+
+// blockOffsets returns the offsets of the metadata blocks in data.
+func blockOffsets(data []byte, blocks int) []uint64 {
+	var offsets []uint64
+	var offset uint64
+	for i := 0; i < blocks; i++ {
+		offsets = append(offsets, offset)
+		header := binary.LittleEndian.Uint16(data[offset:])
+		offset += 2 + uint64(header&^squashfsUncompressed)
+	}
+	return offsets
+}
+
+func (w *squashfsWriter) id(id uint32) uint16 {
+	if index, ok := w.idMap[id]; ok {
+		return index
+	}
+	index := uint16(len(w.ids))
+	w.idMap[id] = index
+	w.ids = append(w.ids, id)
+	return index
+}
+
+func (w *squashfsWriter) addXattrs(inode *Inode) error {
+	var names []string
+	for name := range inode.Xattrs {
+		for _, prefix := range squashfsXattrPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	block, offset := w.xattrTable.ref()
+
+	var kv bytes.Buffer
+	for _, name := range names {
+		for i, prefix := range squashfsXattrPrefixes {
+			if suffix, ok := strings.CutPrefix(name, prefix); ok {
+				binary.Write(&kv, binary.LittleEndian, uint16(i))
+				binary.Write(&kv, binary.LittleEndian, uint16(len(suffix)))
+				kv.WriteString(suffix)
+				break
+			}
+		}
+		value := inode.Xattrs[name]
+		binary.Write(&kv, binary.LittleEndian, uint32(len(value)))
+		kv.WriteString(value)
+	}
+
+	if _, err := w.xattrTable.Write(kv.Bytes()); err != nil {
+		return err
+	}
+
+	w.xattrs[inode] = uint32(len(w.xattrs))
+
+	binary.Write(&w.xattrIDs, binary.LittleEndian, block<<16|uint64(offset))
+	binary.Write(&w.xattrIDs, binary.LittleEndian, uint32(len(names)))
+	binary.Write(&w.xattrIDs, binary.LittleEndian, uint32(kv.Len()))
+
+	return nil
+}
+
+func (w *squashfsWriter) xattrIndex(inode *Inode) uint32 {
+	if index, ok := w.xattrs[inode]; ok {
+		return index
+	}
+	return squashfsNoXattr
+}
+
+func (w *squashfsWriter) writeData(inode *Inode) error {
+	pos, err := w.out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	w.blocksStart[inode] = uint64(pos)
+
+	contents := w.tree.Contents(inode)
+	buf := make([]byte, squashfsBlockSize)
+
+	for {
+		n, err := io.ReadFull(contents, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		block, compressed, cerr := compressBlock(buf[:n])
+		if cerr != nil {
+			return cerr
+		}
+
+		size := uint32(len(block))
+		if !compressed {
+			size |= squashfsDataRaw
+		}
+		w.blockSizes[inode] = append(w.blockSizes[inode], size)
+
+		if _, err := w.out.Write(block); err != nil {
+			return err
+		}
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// number assigns inode numbers in the order writeDir writes the inodes:
+// the entries of a directory before the directory itself.
+func (w *squashfsWriter) number(dir *Inode) {
+	for _, entry := range dir.Entries {
+		if entry.Inode.number != 0 {
+			continue
+		}
+		if entry.Inode.IsDir() {
+			w.number(entry.Inode)
+		} else {
+			w.inodeCount++
+			entry.Inode.number = w.inodeCount
+		}
+	}
+	w.inodeCount++
+	dir.number = w.inodeCount
+}
+
+type squashfsDirEntry struct {
+	name  string
+	inode *Inode
+}
+
+// writeDir writes the inodes below a directory, its listing and then its
+// own inode.
+func (w *squashfsWriter) writeDir(dir *Inode, parent uint32) error {
+	subdirs := 0
+
+	for _, entry := range dir.Entries {
+		inode := entry.Inode
+		if inode.IsDir() {
+			subdirs++
+		}
+		if _, ok := w.refs[inode]; ok {
+			continue
+		}
+
+		var err error
+		if inode.IsDir() {
+			err = w.writeDir(inode, dir.number)
+		} else {
+			err = w.writeInode(inode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	block, offset := w.dirTable.ref()
+	size, err := w.writeListing(dir.Entries)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w.inodeHeader(&body, dir, squashfsDirType+squashfsExtended)
+	binary.Write(&body, binary.LittleEndian, uint32(2+subdirs))
+	binary.Write(&body, binary.LittleEndian, uint32(size+3))
+	binary.Write(&body, binary.LittleEndian, uint32(block))
+	binary.Write(&body, binary.LittleEndian, parent)
+	binary.Write(&body, binary.LittleEndian, uint16(0))
+	binary.Write(&body, binary.LittleEndian, offset)
+	binary.Write(&body, binary.LittleEndian, w.xattrIndex(dir))
+
+	return w.putInode(dir, body.Bytes())
+}
+
+// writeListing writes the entries of a directory. Entries are grouped
+// under headers sharing an inode metadata block and a base inode number
+// within the range of a 16 bit offset.
+func (w *squashfsWriter) writeListing(entries []*Entry) (int, error) {
+	var listing bytes.Buffer
+
+	for i := 0; i < len(entries); {
+		start := w.refs[entries[i].Inode] >> 16
+		base := entries[i].Inode.number
+
+		j := i
+		for j < len(entries) && j-i < 256 {
+			inode := entries[j].Inode
+			diff := int64(inode.number) - int64(base)
+			if w.refs[inode]>>16 != start || diff < math.MinInt16 || diff > math.MaxInt16 {
+				break
+			}
+			j++
+		}
+
+		binary.Write(&listing, binary.LittleEndian, uint32(j-i-1))
+		binary.Write(&listing, binary.LittleEndian, uint32(start))
+		binary.Write(&listing, binary.LittleEndian, base)
+
+		for _, entry := range entries[i:j] {
+			if len(entry.Name) > 256 {
+				return 0, fmt.Errorf("file name too long: %s", entry.Name)
+			}
+			binary.Write(&listing, binary.LittleEndian, uint16(w.refs[entry.Inode]&0xffff))
+			binary.Write(&listing, binary.LittleEndian, int16(int64(entry.Inode.number)-int64(base)))
+			binary.Write(&listing, binary.LittleEndian, squashfsBasicType(entry.Inode))
+			binary.Write(&listing, binary.LittleEndian, uint16(len(entry.Name)-1))
+			listing.WriteString(entry.Name)
+		}
+
+		i = j
+	}
+
+	if _, err := w.dirTable.Write(listing.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return listing.Len(), nil
+}
+
+func (w *squashfsWriter) writeInode(inode *Inode) error {
+	var body bytes.Buffer
+	w.inodeHeader(&body, inode, squashfsBasicType(inode)+squashfsExtended)
+
+	switch inode.Type() {
+	case sIFREG:
+		binary.Write(&body, binary.LittleEndian, w.blocksStart[inode])
+		binary.Write(&body, binary.LittleEndian, uint64(inode.Size))
+		binary.Write(&body, binary.LittleEndian, uint64(0))
+		binary.Write(&body, binary.LittleEndian, inode.Nlink)
+		binary.Write(&body, binary.LittleEndian, uint32(squashfsInvalidFrag))
+		binary.Write(&body, binary.LittleEndian, uint32(0))
+		binary.Write(&body, binary.LittleEndian, w.xattrIndex(inode))
+		for _, size := range w.blockSizes[inode] {
+			binary.Write(&body, binary.LittleEndian, size)
+		}
+	case sIFLNK:
+		binary.Write(&body, binary.LittleEndian, inode.Nlink)
+		binary.Write(&body, binary.LittleEndian, uint32(len(inode.Link)))
+		body.WriteString(inode.Link)
+		binary.Write(&body, binary.LittleEndian, w.xattrIndex(inode))
+	case sIFBLK, sIFCHR:
+		binary.Write(&body, binary.LittleEndian, inode.Nlink)
+		binary.Write(&body, binary.LittleEndian, encodeDev(inode.Devmajor, inode.Devminor))
+		binary.Write(&body, binary.LittleEndian, w.xattrIndex(inode))
+	case sIFIFO, sIFSOCK:
+		binary.Write(&body, binary.LittleEndian, inode.Nlink)
+		binary.Write(&body, binary.LittleEndian, w.xattrIndex(inode))
+	default:
+		return fmt.Errorf("unsupported file type %o", inode.Type())
+	}
+
+	return w.putInode(inode, body.Bytes())
+}
+
+func (w *squashfsWriter) inodeHeader(body *bytes.Buffer, inode *Inode, kind uint16) {
+	binary.Write(body, binary.LittleEndian, kind)
+	binary.Write(body, binary.LittleEndian, uint16(inode.Mode&0o7777))
+	binary.Write(body, binary.LittleEndian, w.id(inode.UID))
+	binary.Write(body, binary.LittleEndian, w.id(inode.GID))
+	binary.Write(body, binary.LittleEndian, uint32(inode.ModTime.Unix()))
+	binary.Write(body, binary.LittleEndian, inode.number)
+}
+
+func (w *squashfsWriter) putInode(inode *Inode, body []byte) error {
+	block, offset := w.inodeTable.ref()
+	w.refs[inode] = block<<16 | uint64(offset)
+
+	_, err := w.inodeTable.Write(body)
+	return err
+}
+
+func squashfsBasicType(inode *Inode) uint16 {
+	switch inode.Type() {
+	case sIFDIR:
+		return squashfsDirType
+	case sIFREG:
+		return squashfsFileType
+	case sIFLNK:
+		return squashfsSymlinkType
+	case sIFBLK:
+		return squashfsBlkType
+	case sIFCHR:
+		return squashfsChrType
+	case sIFIFO:
+		return squashfsFifoType
+	default:
+		return squashfsSocketType
+	}
+}
+
+// encodeDev encodes a device number like the kernel's new_encode_dev.
+func encodeDev(major, minor uint32) uint32 {
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
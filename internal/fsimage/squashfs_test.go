@@ -0,0 +1,295 @@
+package fsimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type squashfsSuperblock struct {
+	Magic             uint32
+	InodeCount        uint32
+	ModTime           uint32
+	BlockSize         uint32
+	FragCount         uint32
+	Compression       uint16
+	BlockLog          uint16
+	Flags             uint16
+	IDCount           uint16
+	VersionMajor      uint16
+	VersionMinor      uint16
+	RootInode         uint64
+	BytesUsed         uint64
+	IDTableStart      uint64
+	XattrIDTableStart uint64
+	InodeTableStart   uint64
+	DirTableStart     uint64
+	FragTableStart    uint64
+	ExportTableStart  uint64
+}
+
+type squashfsInodeHeader struct {
+	Type   uint16
+	Mode   uint16
+	UID    uint16
+	GID    uint16
+	MTime  uint32
+	Number uint32
+}
+
+type squashfsFile struct {
+	header   squashfsInodeHeader
+	nlink    uint32
+	xattr    uint32
+	contents string
+	link     string
+}
+
+// squashfsReader reads back the images WriteSquashfs writes.
+type squashfsReader struct {
+	t     *testing.T
+	image []byte
+	sb    squashfsSuperblock
+	// inodes and dirs hold the decompressed metadata tables, with the
+	// offsets of their blocks.
+	inodes, dirs           []byte
+	inodeBlocks, dirBlocks map[uint64]int
+	ids                    []uint32
+}
+
+func (r *squashfsReader) metadata(start, end uint64) ([]byte, map[uint64]int) {
+	var data []byte
+	blocks := make(map[uint64]int)
+
+	for pos := start; pos < end; {
+		blocks[pos-start] = len(data)
+		header := binary.LittleEndian.Uint16(r.image[pos:])
+		size := uint64(header &^ squashfsUncompressed)
+		block := r.image[pos+2 : pos+2+size]
+		if header&squashfsUncompressed == 0 {
+			block = r.inflate(block)
+		}
+		data = append(data, block...)
+		pos += 2 + size
+	}
+
+	return data, blocks
+}
+
+func (r *squashfsReader) inflate(block []byte) []byte {
+	zr, err := zlib.NewReader(bytes.NewReader(block))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return data
+}
+
+// inode reads the inode at a reference, recursing into directories.
+func (r *squashfsReader) inode(ref uint64, rel string, files map[string]squashfsFile) {
+	b := bytes.NewReader(r.inodes[r.inodeBlocks[ref>>16]+int(ref&0xffff):])
+	read := func(v any) {
+		if err := binary.Read(b, binary.LittleEndian, v); err != nil {
+			r.t.Fatalf("reading inode of %s: %v", rel, err)
+		}
+	}
+
+	var file squashfsFile
+	read(&file.header)
+
+	switch file.header.Type {
+	case squashfsDirType + squashfsExtended:
+		var dir struct {
+			Nlink       uint32
+			Size        uint32
+			Block       uint32
+			Parent      uint32
+			IndexCount  uint16
+			BlockOffset uint16
+			Xattr       uint32
+		}
+		read(&dir)
+		file.nlink, file.xattr = dir.Nlink, dir.Xattr
+
+		start := r.dirBlocks[uint64(dir.Block)] + int(dir.BlockOffset)
+		r.listing(r.dirs[start:start+int(dir.Size)-3], rel, files)
+	case squashfsFileType + squashfsExtended:
+		var reg struct {
+			BlocksStart uint64
+			Size        uint64
+			Sparse      uint64
+			Nlink       uint32
+			Frag        uint32
+			Offset      uint32
+			Xattr       uint32
+		}
+		read(&reg)
+		file.nlink, file.xattr = reg.Nlink, reg.Xattr
+
+		var contents []byte
+		pos := reg.BlocksStart
+		for n := (reg.Size + squashfsBlockSize - 1) / squashfsBlockSize; n > 0; n-- {
+			var size uint32
+			read(&size)
+			block := r.image[pos : pos+uint64(size&^squashfsDataRaw)]
+			if size&squashfsDataRaw == 0 {
+				block = r.inflate(block)
+			}
+			contents = append(contents, block...)
+			pos += uint64(size &^ squashfsDataRaw)
+		}
+		file.contents = string(contents)
+	case squashfsSymlinkType + squashfsExtended:
+		var size uint32
+		read(&file.nlink)
+		read(&size)
+		link := make([]byte, size)
+		read(link)
+		file.link = string(link)
+		read(&file.xattr)
+	default:
+		r.t.Fatalf("%s: unexpected inode type %d", rel, file.header.Type)
+	}
+
+	files[rel] = file
+}
+
+func (r *squashfsReader) listing(listing []byte, dir string, files map[string]squashfsFile) {
+	b := bytes.NewReader(listing)
+	read := func(v any) {
+		if err := binary.Read(b, binary.LittleEndian, v); err != nil {
+			r.t.Fatalf("reading listing of %s: %v", dir, err)
+		}
+	}
+
+	for b.Len() > 0 {
+		var header struct {
+			Count uint32
+			Start uint32
+			Base  uint32
+		}
+		read(&header)
+
+		for i := uint32(0); i <= header.Count; i++ {
+			var entry struct {
+				Offset   uint16
+				Number   int16
+				Type     uint16
+				NameSize uint16
+			}
+			read(&entry)
+			name := make([]byte, entry.NameSize+1)
+			read(name)
+
+			rel := path.Join(dir, string(name))
+			r.inode(uint64(header.Start)<<16|uint64(entry.Offset), rel, files)
+			if got, want := files[rel].header.Number, uint32(int64(header.Base)+int64(entry.Number)); got != want {
+				r.t.Errorf("%s: inode number %d, listed as %d", rel, got, want)
+			}
+		}
+	}
+}
+
+func readSquashfs(t *testing.T, image []byte) (squashfsSuperblock, []uint32, map[string]squashfsFile) {
+	r := &squashfsReader{t: t, image: image}
+
+	if err := binary.Read(bytes.NewReader(image), binary.LittleEndian, &r.sb); err != nil {
+		t.Fatal(err)
+	}
+	if r.sb.Magic != squashfsMagic || r.sb.VersionMajor != 4 || r.sb.VersionMinor != 0 {
+		t.Fatalf("bad superblock %+v", r.sb)
+	}
+	if r.sb.BytesUsed > uint64(len(image)) || len(image)%4096 != 0 {
+		t.Fatalf("%d bytes used in an image of %d", r.sb.BytesUsed, len(image))
+	}
+
+	r.inodes, r.inodeBlocks = r.metadata(r.sb.InodeTableStart, r.sb.DirTableStart)
+	r.dirs, r.dirBlocks = r.metadata(r.sb.DirTableStart, r.sb.FragTableStart)
+
+	idBlock := binary.LittleEndian.Uint64(image[r.sb.IDTableStart:])
+	ids, _ := r.metadata(idBlock, r.sb.IDTableStart)
+	for i := 0; i < int(r.sb.IDCount); i++ {
+		r.ids = append(r.ids, binary.LittleEndian.Uint32(ids[4*i:]))
+	}
+
+	files := make(map[string]squashfsFile)
+	r.inode(r.sb.RootInode, "", files)
+
+	return r.sb, r.ids, files
+}
+
+func TestWriteSquashfs(t *testing.T) {
+	img := filepath.Join(t.TempDir(), "rootfs.squashfs")
+
+	out, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if err := WriteSquashfs(fixtureTree(t), out, fixtureModTime); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := os.ReadFile(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb, ids, files := readSquashfs(t, image)
+
+	if sb.InodeCount != uint32(len(files)-1) {
+		t.Errorf("superblock counts %d inodes, found %d", sb.InodeCount, len(files)-1)
+	}
+	if sb.ModTime != uint32(fixtureModTime.Unix()) {
+		t.Errorf("superblock mod time %d, want %d", sb.ModTime, fixtureModTime.Unix())
+	}
+	if sb.Flags&squashfsFlagNoXattrs != 0 || sb.XattrIDTableStart == squashfsInvalidTable {
+		t.Errorf("superblock has no xattrs")
+	}
+
+	for _, file := range fixtureFiles() {
+		rel := strings.TrimSuffix(file.name, "/")
+		got, ok := files[rel]
+		if !ok {
+			t.Errorf("%s is missing", rel)
+			continue
+		}
+
+		if file.typeflag == tar.TypeLink {
+			if target := files[file.linkname]; got.header.Number != target.header.Number || got.nlink != 2 {
+				t.Errorf("%s is inode %d with %d links, want %s's %d with 2", rel, got.header.Number, got.nlink, file.linkname, target.header.Number)
+			}
+			continue
+		}
+
+		if int64(got.header.Mode) != file.mode {
+			t.Errorf("%s: mode %o, want %o", rel, got.header.Mode, file.mode)
+		}
+		if uid, gid := ids[got.header.UID], ids[got.header.GID]; uid != uint32(file.uid) || gid != uint32(file.gid) {
+			t.Errorf("%s: owned by %d:%d, want %d:%d", rel, uid, gid, file.uid, file.gid)
+		}
+		if got.header.MTime != uint32(fixtureModTime.Unix()) {
+			t.Errorf("%s: mtime %d, want %d", rel, got.header.MTime, fixtureModTime.Unix())
+		}
+		if got.contents != file.body {
+			t.Errorf("%s: got %d bytes of contents, want %d", rel, len(got.contents), len(file.body))
+		}
+		if file.typeflag == tar.TypeSymlink && got.link != file.linkname {
+			t.Errorf("%s: links to %q, want %q", rel, got.link, file.linkname)
+		}
+		if hasXattrs := got.xattr != squashfsNoXattr; hasXattrs != (len(file.xattrs) > 0) {
+			t.Errorf("%s: xattr index %#x", rel, got.xattr)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package fsimage writes root filesystems as squashfs and ext4 images
+// without mounting anything.
+package fsimage
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sIFMT   = 0o170000
+	sIFSOCK = 0o140000
+	sIFLNK  = 0o120000
+	sIFREG  = 0o100000
+	sIFBLK  = 0o060000
+	sIFDIR  = 0o040000
+	sIFCHR  = 0o020000
+	sIFIFO  = 0o010000
+
+	xattrPrefix = "SCHILY.xattr."
+)
+
+// Inode is a file of the tree; hard links share one.
+type Inode struct {
+	// Mode holds the file type and permission bits as in stat(2).
+	Mode     uint32
+	UID      uint32
+	GID      uint32
+	ModTime  time.Time
+	Xattrs   map[string]string
+	Link     string
+	Devmajor uint32
+	Devminor uint32
+	Size     int64
+	Entries  []*Entry
+	Nlink    uint32
+
+	// offset locates regular file contents in the spool file.
+	offset int64
+	// number is the inode number assigned by a writer.
+	number uint32
+}
+
+type Entry struct {
+	Name  string
+	Inode *Inode
+}
+
+// Tree is a root filesystem read from a tar stream. Regular file contents
+// are kept in a spool file until the image is written.
+type Tree struct {
+	Root  *Inode
+	spool *os.File
+}
+
+func (i *Inode) IsDir() bool {
+	return i.Mode&sIFMT == sIFDIR
+}
+
+func (i *Inode) Type() uint32 {
+	return i.Mode & sIFMT
+}
+
+func (i *Inode) lookup(name string) *Entry {
+	for _, entry := range i.Entries {
+		if entry.Name == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// ReadTar reads a tar stream without whiteouts, such as a merged rootfs,
+// into a tree. spool receives the file contents.
+func ReadTar(r io.Reader, spool *os.File) (*Tree, error) {
+	tree := &Tree{
+		Root:  &Inode{Mode: sIFDIR | 0o755, ModTime: time.Unix(0, 0), Nlink: 1},
+		spool: spool,
+	}
+
+	var offset int64
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tar read: %w", err)
+		}
+
+		rel := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+
+		if header.Typeflag == tar.TypeLink {
+			target, err := tree.find(strings.TrimPrefix(path.Clean("/"+header.Linkname), "/"))
+			if err != nil {
+				return nil, fmt.Errorf("hard link %s: %w", header.Name, err)
+			}
+			if target.IsDir() {
+				return nil, fmt.Errorf("hard link %s: %s is a directory", header.Name, header.Linkname)
+			}
+			if err := tree.link(rel, target); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		inode, err := newInode(header)
+		if err != nil {
+			return nil, err
+		}
+		if inode == nil {
+			continue
+		}
+
+		if inode.Type() == sIFREG && inode.Size > 0 {
+			n, err := io.Copy(spool, tr)
+			if err != nil {
+				return nil, fmt.Errorf("spooling %s: %w", header.Name, err)
+			}
+			inode.offset = offset
+			inode.Size = n
+			offset += n
+		}
+
+		if rel == "" {
+			inode.Entries = tree.Root.Entries
+			tree.Root = inode
+			continue
+		}
+
+		if err := tree.link(rel, inode); err != nil {
+			return nil, err
+		}
+	}
+
+	tree.Root.Nlink = 1
+	tree.sort(tree.Root)
+
+	return tree, nil
+}
+
+func newInode(header *tar.Header) (*Inode, error) {
+	inode := &Inode{
+		Mode:     uint32(header.Mode) & 0o7777,
+		UID:      uint32(header.Uid),
+		GID:      uint32(header.Gid),
+		ModTime:  header.ModTime,
+		Devmajor: uint32(header.Devmajor),
+		Devminor: uint32(header.Devminor),
+		Size:     header.Size,
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		inode.Mode |= sIFREG
+	case tar.TypeDir:
+		inode.Mode |= sIFDIR
+		inode.Size = 0
+	case tar.TypeSymlink:
+		inode.Mode |= sIFLNK
+		inode.Link = header.Linkname
+		inode.Size = int64(len(header.Linkname))
+	case tar.TypeChar:
+		inode.Mode |= sIFCHR
+		inode.Size = 0
+	case tar.TypeBlock:
+		inode.Mode |= sIFBLK
+		inode.Size = 0
+	case tar.TypeFifo:
+		inode.Mode |= sIFIFO
+		inode.Size = 0
+	case tar.TypeXGlobalHeader:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported tar entry type %q", header.Name, header.Typeflag)
+	}
+
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, xattrPrefix); ok {
+			if inode.Xattrs == nil {
+				inode.Xattrs = make(map[string]string)
+			}
+			inode.Xattrs[name] = value
+		}
+	}
+
+	return inode, nil
+}
+
+// link adds an entry for inode at rel, creating missing parent directories
+// and replacing what was there unless both are directories.
+func (t *Tree) link(rel string, inode *Inode) error {
+	parent := t.Root
+	dir, name := path.Split(rel)
+
+	if dir != "" {
+		for _, component := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+			entry := parent.lookup(component)
+			if entry == nil {
+				entry = &Entry{
+					Name:  component,
+					Inode: &Inode{Mode: sIFDIR | 0o755, ModTime: time.Unix(0, 0), Nlink: 1},
+				}
+				parent.Entries = append(parent.Entries, entry)
+			}
+			if !entry.Inode.IsDir() {
+				return fmt.Errorf("%s: parent %s is not a directory", rel, component)
+			}
+			parent = entry.Inode
+		}
+	}
+
+	if existing := parent.lookup(name); existing != nil {
+		if existing.Inode.IsDir() && inode.IsDir() {
+			inode.Entries = existing.Inode.Entries
+		} else {
+			existing.Inode.Nlink--
+		}
+		existing.Inode = inode
+		inode.Nlink++
+		return nil
+	}
+
+	parent.Entries = append(parent.Entries, &Entry{Name: name, Inode: inode})
+	inode.Nlink++
+
+	return nil
+}
+
+func (t *Tree) find(rel string) (*Inode, error) {
+	inode := t.Root
+	if rel == "" {
+		return inode, nil
+	}
+
+	for _, component := range strings.Split(rel, "/") {
+		entry := inode.lookup(component)
+		if entry == nil {
+			return nil, fmt.Errorf("%s not found", rel)
+		}
+		inode = entry.Inode
+	}
+
+	return inode, nil
+}
+
+func (t *Tree) sort(inode *Inode) {
+	sort.Slice(inode.Entries, func(i, j int) bool {
+		return inode.Entries[i].Name < inode.Entries[j].Name
+	})
+	for _, entry := range inode.Entries {
+		if entry.Inode.IsDir() {
+			t.sort(entry.Inode)
+		}
+	}
+}
+
+// Contents returns a reader of the contents of a regular file.
+func (t *Tree) Contents(inode *Inode) io.Reader {
+	return io.NewSectionReader(t.spool, inode.offset, inode.Size)
+}
+
+// Walk calls fn for every inode once, parents before their entries.
+func (t *Tree) Walk(fn func(inode *Inode) error) error {
+	seen := make(map[*Inode]bool)
+
+	var walk func(inode *Inode) error
+	walk = func(inode *Inode) error {
+		if seen[inode] {
+			return nil
+		}
+		seen[inode] = true
+
+		if err := fn(inode); err != nil {
+			return err
+		}
+		for _, entry := range inode.Entries {
+			if err := walk(entry.Inode); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk(t.Root)
+}
@@ -0,0 +1,172 @@
+package fsimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixtureFile is an entry of the tar fixture, and what the image is expected
+// to hold for it. Hardlinks only name their target.
+type fixtureFile struct {
+	name     string
+	typeflag byte
+	mode     int64
+	uid      int
+	gid      int
+	body     string
+	linkname string
+	xattrs   map[string]string
+}
+
+var (
+	fixtureModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	longLinkTarget = "../" + strings.Repeat("very-long-directory-name/", 8) + "target"
+	bigBody        = strings.Repeat("0123456789abcdef", 20000)
+)
+
+// fixtureFiles covers hardlinks, xattrs, symlinks too long to be kept in
+// the inode, directories with many entries, ownership and special modes.
+func fixtureFiles() []fixtureFile {
+	files := []fixtureFile{
+		{name: "bin/", typeflag: tar.TypeDir, mode: 0o755},
+		{name: "bin/ping", typeflag: tar.TypeReg, mode: 0o4755, body: "ping", xattrs: map[string]string{
+			"security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+			"user.comment":        "setuid and capable",
+		}},
+		{name: "bin/ping6", typeflag: tar.TypeLink, linkname: "bin/ping"},
+		{name: "etc/", typeflag: tar.TypeDir, mode: 0o755},
+		{name: "etc/shadow", typeflag: tar.TypeReg, mode: 0o640, uid: 0, gid: 42, body: "root:*:19000::::::\n"},
+		{name: "home/user/", typeflag: tar.TypeDir, mode: 0o700, uid: 1000, gid: 1000},
+		{name: "home/user/big", typeflag: tar.TypeReg, mode: 0o644, uid: 1000, gid: 1000, body: bigBody},
+		{name: "home/user/empty", typeflag: tar.TypeReg, mode: 0o600, uid: 1000, gid: 1000},
+		{name: "lib/short", typeflag: tar.TypeSymlink, mode: 0o777, linkname: "short-target"},
+		{name: "lib/long", typeflag: tar.TypeSymlink, mode: 0o777, linkname: longLinkTarget},
+		{name: "tmp/", typeflag: tar.TypeDir, mode: 0o1777},
+		{name: "many/", typeflag: tar.TypeDir, mode: 0o755},
+	}
+
+	for i := 0; i < 1000; i++ {
+		files = append(files, fixtureFile{
+			name:     fmt.Sprintf("many/entry-with-a-longer-name-%04d", i),
+			typeflag: tar.TypeReg,
+			mode:     0o644,
+			body:     fmt.Sprint(i),
+		})
+	}
+
+	return files
+}
+
+func fixtureTree(t *testing.T) *Tree {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, file := range fixtureFiles() {
+		header := &tar.Header{
+			Name:     file.name,
+			Typeflag: file.typeflag,
+			Mode:     file.mode,
+			Uid:      file.uid,
+			Gid:      file.gid,
+			Linkname: file.linkname,
+			Size:     int64(len(file.body)),
+			ModTime:  fixtureModTime,
+			Format:   tar.FormatPAX,
+		}
+		for name, value := range file.xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[xattrPrefix+name] = value
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, file.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := os.Create(filepath.Join(t.TempDir(), "spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { spool.Close() })
+
+	tree, err := ReadTar(&buf, spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+func TestReadTar(t *testing.T) {
+	tree := fixtureTree(t)
+
+	ping, err := tree.find("bin/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping6, err := tree.find("bin/ping6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping != ping6 || ping.Nlink != 2 {
+		t.Errorf("hard link: same inode %v, nlink %d, want the same inode twice", ping == ping6, ping.Nlink)
+	}
+	if ping.Mode != sIFREG|0o4755 {
+		t.Errorf("ping mode %o, want %o", ping.Mode, sIFREG|0o4755)
+	}
+	if ping.Xattrs["user.comment"] != "setuid and capable" || len(ping.Xattrs) != 2 {
+		t.Errorf("ping xattrs %q", ping.Xattrs)
+	}
+
+	big, err := tree.find("home/user/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := io.ReadAll(tree.Contents(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != bigBody || big.UID != 1000 || big.GID != 1000 {
+		t.Errorf("big: %d bytes owned by %d:%d", len(contents), big.UID, big.GID)
+	}
+
+	long, err := tree.find("lib/long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if long.Link != longLinkTarget || long.Size != int64(len(longLinkTarget)) {
+		t.Errorf("long symlink to %q of size %d", long.Link, long.Size)
+	}
+
+	// Parents without entries of their own are created.
+	home, err := tree.find("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if home.Mode != sIFDIR|0o755 {
+		t.Errorf("home mode %o, want %o", home.Mode, sIFDIR|0o755)
+	}
+
+	many, err := tree.find("many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(many.Entries) != 1000 || many.Entries[0].Name != "entry-with-a-longer-name-0000" {
+		t.Errorf("many has %d sorted entries", len(many.Entries))
+	}
+}
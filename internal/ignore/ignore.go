@@ -0,0 +1,203 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FileNames are the ignore files looked up in a context root, in order of
+// preference.
+var FileNames = []string{".cbtignore", ".dockerignore"}
+
+// LayerFileName is the only ignore file looked up in a layer root. A
+// .dockerignore there is a file of the image rather than exclusion rules.
+const LayerFileName = ".cbtignore"
+
+// LoadPatterns reads the exclusion patterns of the ignore file in a context
+// root. The ignore file excludes itself unless a later pattern re-includes
+// it. No patterns are returned when root has no ignore file.
+func LoadPatterns(root string) ([]string, error) {
+	return loadPatterns(root, FileNames)
+}
+
+// LoadLayerPatterns is LoadPatterns for a layer root.
+func LoadLayerPatterns(root string) ([]string, error) {
+	return loadPatterns(root, []string{LayerFileName})
+}
+
+func loadPatterns(root string, names []string) ([]string, error) {
+	for _, name := range names {
+		patterns, err := ReadFile(filepath.Join(root, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{name}, patterns...), nil
+	}
+
+	return nil, nil
+}
+
+// ReadFile parses an ignore file. Blank lines and lines starting with #
+// are skipped.
+func ReadFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return patterns, nil
+}
+
+type pattern struct {
+	text      string
+	re        *regexp.Regexp
+	exclusion bool
+	depth     int
+}
+
+// Matcher matches paths against patterns with .dockerignore semantics:
+// filepath.Match globs, ** for any number of directories and ! to
+// re-include previously excluded paths. The last matching pattern wins.
+type Matcher struct {
+	patterns   []pattern
+	exclusions bool
+}
+
+func NewMatcher(patterns []string) (*Matcher, error) {
+	m := &Matcher{}
+
+	for _, text := range patterns {
+		p := pattern{}
+
+		if strings.HasPrefix(text, "!") {
+			text = strings.TrimSpace(text[1:])
+			if text == "" {
+				return nil, fmt.Errorf("illegal exclusion pattern: \"!\"")
+			}
+			p.exclusion = true
+			m.exclusions = true
+		}
+
+		text = filepath.ToSlash(filepath.Clean(text))
+		text = strings.TrimPrefix(text, "/")
+		if text == "" || text == "." {
+			continue
+		}
+
+		re, err := compile(text)
+		if err != nil {
+			return nil, fmt.Errorf("compiling pattern %q: %w", text, err)
+		}
+
+		p.text = text
+		p.re = re
+		p.depth = len(strings.Split(text, "/"))
+
+		m.patterns = append(m.patterns, p)
+	}
+
+	return m, nil
+}
+
+// Exclusions reports whether any pattern re-includes paths. When it does an
+// ignored directory still has to be walked.
+func (m *Matcher) Exclusions() bool {
+	return m.exclusions
+}
+
+// Matches reports whether the slash separated relative path is ignored,
+// either directly or because one of its parent directories is.
+func (m *Matcher) Matches(rel string) bool {
+	rel = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(rel)), "/")
+	parents := strings.Split(rel, "/")
+	parents = parents[:len(parents)-1]
+
+	matched := false
+	for _, p := range m.patterns {
+		match := p.re.MatchString(rel)
+
+		if !match && len(parents) > 0 && p.depth <= len(parents) {
+			for i := range parents {
+				if p.re.MatchString(strings.Join(parents[:i+1], "/")) {
+					match = true
+					break
+				}
+			}
+		}
+
+		if match {
+			matched = !p.exclusion
+		}
+	}
+
+	return matched
+}
+
+func compile(text string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case ch == '*' && i+1 < len(text) && text[i+1] == '*':
+			i++
+			// **/ is treated like ** so a leading **/ also matches the root.
+			if i+1 < len(text) && text[i+1] == '/' {
+				i++
+			}
+			if i+1 == len(text) {
+				re.WriteString(".*")
+			} else {
+				re.WriteString("(.*/)?")
+			}
+		case ch == '*':
+			re.WriteString("[^/]*")
+		case ch == '?':
+			re.WriteString("[^/]")
+		case ch == '[':
+			end := strings.IndexByte(text[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := text[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		case ch == '\\' && i+1 < len(text):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(text[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
@@ -0,0 +1,185 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The cases follow those of moby/patternmatcher, which .dockerignore files
+// are matched with.
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"**", "file", true},
+		{"**", "dir/file", true},
+		{"**/", "file", true},
+		{"**/", "dir/file", true},
+		{"dir/**", "dir/file", true},
+		{"dir/**", "dir/dir2/file", true},
+		{"**/dir2/*", "dir/dir2/file", true},
+		{"**/dir2/**", "dir/dir2/dir3/file", true},
+		{"**file", "file", true},
+		{"**file", "dir/file", true},
+		{"**/file", "dir/file", true},
+		{"**file", "dir/dir/file", true},
+		{"**/file", "dir/dir/file", true},
+		{"**/file*", "dir/dir/file", true},
+		{"**/file*", "dir/dir/file.txt", true},
+		{"**/file*txt", "dir/dir/file.txt", true},
+		{"**/file*.txt", "dir/dir/file.txt", true},
+		{"**/file*.txt*", "dir/dir/file.txt", true},
+		{"**/**/*.txt", "dir/dir/file.txt", true},
+		{"**/**/*.txt2", "dir/dir/file.txt", false},
+		{"**/*.txt", "file.txt", true},
+		{"**/**/*.txt", "file.txt", true},
+		{"a**/*.txt", "a/file.txt", true},
+		{"a**/*.txt", "a/dir/file.txt", true},
+		{"a**/*.txt", "a/dir/dir/file.txt", true},
+		{"a/*.txt", "a/dir/file.txt", false},
+		{"a/*.txt", "a/file.txt", true},
+		{"a/*.txt**", "a/file.txt", true},
+		{"a[b-d]e", "ae", false},
+		{"a[b-d]e", "ace", true},
+		{"a[b-d]e", "aae", false},
+		{"a[^b-d]e", "aze", true},
+		{"a[!b-d]e", "aze", true},
+		{".*", ".foo", true},
+		{".*", "foo", false},
+		{"abc.def", "abcdef", false},
+		{"abc.def", "abc.def", true},
+		{"abc.def", "abcZdef", false},
+		{"abc?def", "abcZdef", true},
+		{"abc?def", "abcdef", false},
+		{`a\\`, `a\`, true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{`a\?b`, "axb", false},
+		{"**/foo/bar", "foo/bar", true},
+		{"**/foo/bar", "dir/foo/bar", true},
+		{"**/foo/bar", "dir/dir2/foo/bar", true},
+		{"abc/**", "abc", false},
+		{"abc/**", "abc/def", true},
+		{"abc/**", "abc/def/ghi", true},
+		{"**/.foo", ".foo", true},
+		{"**/.foo", "bar.foo", false},
+		{"a(b)c/def", "a(b)c/def", true},
+		{"a(b)c/def", "a(b)c/xyz", false},
+		{"a.|)$(}+{bc", "a.|)$(}+{bc", true},
+		{"dir", "dir/file", true},
+		{"dir", "dir/sub/file", true},
+		{"dir/*", "dir/sub/file", true},
+		{"/dir/file", "dir/file", true},
+		{"./dir/../file", "file", true},
+		{"file", "dir/file", false},
+	}
+
+	for _, tt := range tests {
+		m, err := NewMatcher([]string{tt.pattern})
+		if err != nil {
+			t.Errorf("NewMatcher(%q): %v", tt.pattern, err)
+			continue
+		}
+		if got := m.Matches(tt.path); got != tt.want {
+			t.Errorf("pattern %q, path %q: got %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesExclusions(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{[]string{"docs", "!docs/README.md"}, "docs/README.md", false},
+		{[]string{"docs", "!docs/README.md"}, "docs/other.md", true},
+		{[]string{"*.md", "!README*.md", "README-secret.md"}, "README.md", false},
+		{[]string{"*.md", "!README*.md", "README-secret.md"}, "README-secret.md", true},
+		{[]string{"!file", "file"}, "file", true},
+		{[]string{"file", "!file"}, "file", false},
+		{[]string{"**", "!keep/**"}, "keep/sub/file", false},
+		{[]string{"**", "!keep/**"}, "drop/file", true},
+		{[]string{`\!file`}, "!file", true},
+		{[]string{`\!file`}, "file", false},
+	}
+
+	for _, tt := range tests {
+		m, err := NewMatcher(tt.patterns)
+		if err != nil {
+			t.Errorf("NewMatcher(%q): %v", tt.patterns, err)
+			continue
+		}
+		if got := m.Matches(tt.path); got != tt.want {
+			t.Errorf("patterns %q, path %q: got %v, want %v", tt.patterns, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestNewMatcherErrors(t *testing.T) {
+	for _, pattern := range []string{"!", "! ", "[", "a[b"} {
+		if _, err := NewMatcher([]string{pattern}); err == nil {
+			t.Errorf("NewMatcher(%q) succeeded, want an error", pattern)
+		}
+	}
+}
+
+func TestLoadPatterns(t *testing.T) {
+	write := func(t *testing.T, dir, name, contents string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("context", func(t *testing.T) {
+		dir := t.TempDir()
+		write(t, dir, ".dockerignore", "# comment\n\n*.log\n!keep.log\n")
+
+		got, err := LoadPatterns(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{".dockerignore", "*.log", "!keep.log"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+
+		write(t, dir, ".cbtignore", "tmp\n")
+		got, err = LoadPatterns(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = []string{".cbtignore", "tmp"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("layer", func(t *testing.T) {
+		dir := t.TempDir()
+		write(t, dir, ".dockerignore", "*\n")
+
+		got, err := LoadLayerPatterns(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != nil {
+			t.Errorf("got %q from a layer .dockerignore, want none", got)
+		}
+
+		write(t, dir, ".cbtignore", "tmp\n")
+		got, err = LoadLayerPatterns(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{".cbtignore", "tmp"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
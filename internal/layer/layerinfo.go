@@ -1,9 +1,11 @@
 package layer
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkorzh/container-build-tool/internal/archive"
 )
 
@@ -16,6 +18,19 @@ type LayerInfo struct {
 	MediaType string
 }
 
+func MediaType(compression archive.Compression) (string, error) {
+	switch compression {
+	case archive.Uncompressed:
+		return imgspecv1.MediaTypeImageLayer, nil
+	case archive.Gzip:
+		return imgspecv1.MediaTypeImageLayerGzip, nil
+	case archive.Zstd:
+		return imgspecv1.MediaTypeImageLayerZstd, nil
+	default:
+		return "", fmt.Errorf("unsupported layer compression: %d", compression)
+	}
+}
+
 type writeCounter struct {
 	Writer io.Writer
 	Count  int64
@@ -51,3 +66,70 @@ func GetLayerInfo(layer io.Reader) (LayerInfo, error) {
 		UncompressedDigest: decompressedDigester.Digest(),
 	}, nil
 }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// CompressingReader compresses an uncompressed layer stream while hashing
+// it before and after the compressor, so the layer info is known as soon as
+// the compressed stream has been read without reading the blob back.
+type CompressingReader struct {
+	pipeReader *io.PipeReader
+	info       LayerInfo
+	done       chan struct{}
+}
+
+func Compress(uncompressed io.Reader, compression archive.Compression, jobs int) *CompressingReader {
+	pipeReader, pipeWriter := io.Pipe()
+
+	r := &CompressingReader{
+		pipeReader: pipeReader,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+
+		uncompressedDigester := digest.Canonical.Digester()
+		compressedDigester := digest.Canonical.Digester()
+		counter := &writeCounter{Writer: io.MultiWriter(pipeWriter, compressedDigester.Hash())}
+
+		compressor, err := archive.CompressStreamParallel(nopWriteCloser{counter}, compression, jobs)
+		if err == nil {
+			_, err = io.Copy(compressor, io.TeeReader(uncompressed, uncompressedDigester.Hash()))
+			if closeErr := compressor.Close(); err == nil {
+				err = closeErr
+			}
+		}
+
+		r.info = LayerInfo{
+			CompressedDigest:   compressedDigester.Digest(),
+			CompressedSize:     counter.Count,
+			UncompressedDigest: uncompressedDigester.Digest(),
+		}
+
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return r
+}
+
+func (r *CompressingReader) Read(p []byte) (int, error) {
+	return r.pipeReader.Read(p)
+}
+
+func (r *CompressingReader) Close() error {
+	return r.pipeReader.Close()
+}
+
+// LayerInfo returns the digests and size of the layer. It must only be
+// called once the stream has been read to EOF.
+func (r *CompressingReader) LayerInfo() LayerInfo {
+	<-r.done
+	return r.info
+}
@@ -0,0 +1,39 @@
+package lockfile
+
+import (
+	"fmt"
+	"os"
+)
+
+type LockFile struct {
+	file *os.File
+}
+
+// Lock takes an exclusive lock on path, blocking until it is available.
+// The path must already exist; directories can be locked as well.
+func Lock(path string) (*LockFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+
+	if err := lock(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+
+	return &LockFile{file: file}, nil
+}
+
+func (l *LockFile) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+
+	defer func() {
+		l.file.Close()
+		l.file = nil
+	}()
+
+	return unlock(l.file)
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package lockfile
+
+import "os"
+
+func lock(file *os.File) error {
+	return nil
+}
+
+func unlock(file *os.File) error {
+	return nil
+}
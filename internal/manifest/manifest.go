@@ -0,0 +1,155 @@
+// Package manifest converts image manifests between the OCI and Docker v2
+// schema 2 formats.
+package manifest
+
+import (
+	"errors"
+	"fmt"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	DockerV2Schema2MediaType                  = "application/vnd.docker.distribution.manifest.v2+json"
+	DockerV2ListMediaType                     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	DockerV2Schema2ConfigMediaType            = "application/vnd.docker.container.image.v1+json"
+	DockerV2Schema2LayerMediaType             = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	DockerV2Schema2UncompressedLayerMediaType = "application/vnd.docker.image.rootfs.diff.tar"
+	DockerV2Schema2ForeignLayerMediaType      = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	// OCI media types of layers that must not be pushed to registries,
+	// which Docker foreign layers map to.
+	ociNondistributableLayerMediaType     = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	ociNondistributableTarLayerMediaType  = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	ociNondistributableZstdLayerMediaType = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+type Format string
+
+const (
+	FormatOCI    Format = "oci"
+	FormatDocker Format = "docker"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatOCI, FormatDocker:
+		return Format(s), nil
+	default:
+		return "", fmt.Errorf("unknown manifest format: %s", s)
+	}
+}
+
+// FormatOf returns the format of a manifest from its media type.
+func FormatOf(m *imgspecv1.Manifest) (Format, error) {
+	switch m.MediaType {
+	case imgspecv1.MediaTypeImageManifest, "":
+		return FormatOCI, nil
+	case DockerV2Schema2MediaType:
+		return FormatDocker, nil
+	default:
+		return "", fmt.Errorf("unsupported manifest media type: %s", m.MediaType)
+	}
+}
+
+// IsIndex reports whether a media type is an OCI index or a Docker
+// manifest list.
+func IsIndex(mediaType string) bool {
+	return mediaType == imgspecv1.MediaTypeImageIndex || mediaType == DockerV2ListMediaType
+}
+
+// ConfigMediaType is the media type of image configs in a format.
+func ConfigMediaType(format Format) string {
+	if format == FormatDocker {
+		return DockerV2Schema2ConfigMediaType
+	}
+	return imgspecv1.MediaTypeImageConfig
+}
+
+// MediaType is the media type of manifests in a format.
+func MediaType(format Format) string {
+	if format == FormatDocker {
+		return DockerV2Schema2MediaType
+	}
+	return imgspecv1.MediaTypeImageManifest
+}
+
+var (
+	ociToDockerLayers = map[string]string{
+		imgspecv1.MediaTypeImageLayerGzip:         DockerV2Schema2LayerMediaType,
+		imgspecv1.MediaTypeImageLayer:             DockerV2Schema2UncompressedLayerMediaType,
+		ociNondistributableLayerMediaType:         DockerV2Schema2ForeignLayerMediaType,
+		DockerV2Schema2LayerMediaType:             DockerV2Schema2LayerMediaType,
+		DockerV2Schema2UncompressedLayerMediaType: DockerV2Schema2UncompressedLayerMediaType,
+		DockerV2Schema2ForeignLayerMediaType:      DockerV2Schema2ForeignLayerMediaType,
+	}
+	dockerToOCILayers = map[string]string{
+		DockerV2Schema2LayerMediaType:             imgspecv1.MediaTypeImageLayerGzip,
+		DockerV2Schema2UncompressedLayerMediaType: imgspecv1.MediaTypeImageLayer,
+		DockerV2Schema2ForeignLayerMediaType:      ociNondistributableLayerMediaType,
+		imgspecv1.MediaTypeImageLayerGzip:         imgspecv1.MediaTypeImageLayerGzip,
+		imgspecv1.MediaTypeImageLayer:             imgspecv1.MediaTypeImageLayer,
+		imgspecv1.MediaTypeImageLayerZstd:         imgspecv1.MediaTypeImageLayerZstd,
+		ociNondistributableLayerMediaType:         ociNondistributableLayerMediaType,
+		ociNondistributableTarLayerMediaType:      ociNondistributableTarLayerMediaType,
+		ociNondistributableZstdLayerMediaType:     ociNondistributableZstdLayerMediaType,
+	}
+)
+
+// Convert returns a copy of an image manifest in the given format, with the
+// config and layer media types mapped. Fields the format can't hold, such
+// as annotations in Docker manifests, are an error rather than dropped.
+func Convert(m *imgspecv1.Manifest, format Format) (*imgspecv1.Manifest, error) {
+	if _, err := FormatOf(m); err != nil {
+		return nil, err
+	}
+
+	switch m.Config.MediaType {
+	case imgspecv1.MediaTypeImageConfig, DockerV2Schema2ConfigMediaType, "":
+	default:
+		return nil, fmt.Errorf("%s isn't an image config and can't be converted", m.Config.MediaType)
+	}
+
+	layerTypes := dockerToOCILayers
+	if format == FormatDocker {
+		if err := checkDocker(m); err != nil {
+			return nil, err
+		}
+		layerTypes = ociToDockerLayers
+	}
+
+	converted := *m
+	converted.MediaType = MediaType(format)
+	converted.Config.MediaType = ConfigMediaType(format)
+
+	converted.Layers = make([]imgspecv1.Descriptor, len(m.Layers))
+	for i, layer := range m.Layers {
+		mediaType, ok := layerTypes[layer.MediaType]
+		if !ok {
+			return nil, fmt.Errorf("layer %s of type %s can't be stored in a %s manifest", layer.Digest, layer.MediaType, format)
+		}
+		layer.MediaType = mediaType
+		converted.Layers[i] = layer
+	}
+
+	return &converted, nil
+}
+
+// checkDocker rejects what Docker v2 schema 2 manifests have no room for.
+func checkDocker(m *imgspecv1.Manifest) error {
+	if len(m.Annotations) > 0 {
+		return errors.New("Docker v2 manifests can't hold annotations")
+	}
+	if m.ArtifactType != "" || m.Subject != nil {
+		return errors.New("Docker v2 manifests can't hold an artifact type or subject")
+	}
+	for _, descriptor := range append([]imgspecv1.Descriptor{m.Config}, m.Layers...) {
+		if len(descriptor.Annotations) > 0 {
+			return fmt.Errorf("Docker v2 manifests can't hold annotations, found on %s", descriptor.Digest)
+		}
+		if len(descriptor.Data) > 0 || descriptor.Platform != nil || descriptor.ArtifactType != "" {
+			return fmt.Errorf("Docker v2 descriptors can't hold embedded data, a platform or an artifact type, found on %s", descriptor.Digest)
+		}
+	}
+	return nil
+}
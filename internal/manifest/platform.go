@@ -0,0 +1,117 @@
+package manifest
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultPlatform is the platform picked from multi-platform images when
+// none is given: linux, which container images are built for, on the
+// architecture and variant of the host.
+func DefaultPlatform() imgspecv1.Platform {
+	return imgspecv1.Platform{
+		OS:           "linux",
+		Architecture: runtime.GOARCH,
+		Variant:      hostVariant(),
+	}
+}
+
+func hostVariant() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "v8"
+	case "arm":
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "GOARM" && setting.Value != "" {
+					return "v" + setting.Value
+				}
+			}
+		}
+		return "v7"
+	default:
+		return ""
+	}
+}
+
+// ParsePlatform parses a platform written as os/arch[/variant].
+func ParsePlatform(s string) (imgspecv1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return imgspecv1.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return imgspecv1.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+		}
+	}
+
+	platform := imgspecv1.Platform{
+		OS:           strings.ToLower(parts[0]),
+		Architecture: strings.ToLower(parts[1]),
+	}
+	if len(parts) == 3 {
+		platform.Variant = strings.ToLower(parts[2])
+	}
+
+	return platform, nil
+}
+
+// FormatPlatform writes a platform as os/arch[/variant].
+func FormatPlatform(platform imgspecv1.Platform) string {
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+// MatchPlatform ranks how well an image for platform have runs on want,
+// higher being better, and reports whether it runs at all. A want without
+// variant takes any variant. ARM variants are backwards compatible, so a
+// v7 image is the best fit for a v8 machine when there's no v8 one.
+func MatchPlatform(want, have imgspecv1.Platform) (int, bool) {
+	if have.OS != want.OS || have.Architecture != want.Architecture {
+		return 0, false
+	}
+
+	wantVariant := normalizeVariant(want.Architecture, want.Variant)
+	haveVariant := normalizeVariant(have.Architecture, have.Variant)
+
+	switch {
+	case wantVariant == "":
+		return 0, true
+	case haveVariant == wantVariant:
+		return 100, true
+	case haveVariant == "":
+		return 0, true
+	}
+
+	if want.Architecture != "arm" && want.Architecture != "arm64" {
+		return 0, false
+	}
+
+	wantVersion, err := strconv.Atoi(strings.TrimPrefix(wantVariant, "v"))
+	if err != nil {
+		return 0, false
+	}
+	haveVersion, err := strconv.Atoi(strings.TrimPrefix(haveVariant, "v"))
+	if err != nil || haveVersion > wantVersion {
+		return 0, false
+	}
+
+	return haveVersion, true
+}
+
+// normalizeVariant fills in the variant arm64 images leave out.
+func normalizeVariant(architecture, variant string) string {
+	if architecture == "arm64" && variant == "" {
+		return "v8"
+	}
+	return variant
+}
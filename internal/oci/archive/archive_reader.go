@@ -1,92 +1,286 @@
 package archive
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/pkorzh/container-build-tool/internal/archive"
 	"github.com/pkorzh/container-build-tool/internal/oci/internal"
-	ocilayout "github.com/pkorzh/container-build-tool/internal/oci/layout"
-	"github.com/pkorzh/container-build-tool/internal/tmpdir"
 	"github.com/pkorzh/container-build-tool/internal/types"
 
-	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// Entries of compressed archives up to maxCachedEntrySize are kept in
+// memory when the archive is indexed, up to maxCachedSize in total. That
+// covers the index, manifests and configs, which are read again and again.
+const (
+	maxCachedEntrySize = 1 << 20
+	maxCachedSize      = 64 << 20
+)
+
+// ociArchiveImageReader reads blobs straight out of the archive. Entry
+// offsets of uncompressed archives are indexed in a single pass over the
+// tar stream. Compressed archives aren't seekable, so they're decompressed
+// once while indexing: small entries are kept in memory and larger ones
+// are spooled to a temporary file.
 type ociArchiveImageReader struct {
-	ref                  ociArchiveRef
-	ociLayoutImageReader types.ImageReader
-	tmpDir               internal.TmpDirOCIRef
+	ref        ociArchiveRef
+	file       *os.File
+	compressed bool
+	entries    map[string]tarEntry
+	cached     map[string][]byte
+	spool      *os.File
+	index      *imgspecv1.Index
+	descriptor imgspecv1.Descriptor
 }
 
 func (a ociArchiveImageReader) Close() error {
-	defer a.tmpDir.DeleteTmpDir()
-	return a.ociLayoutImageReader.Close()
+	if a.spool != nil {
+		a.spool.Close()
+		os.Remove(a.spool.Name())
+	}
+	return a.file.Close()
 }
 
-func (a ociArchiveImageReader) GetBlob(d digest.Digest) (io.ReadCloser, error) {
-	return a.ociLayoutImageReader.GetBlob(d)
+func (a ociArchiveImageReader) GetBlob(descriptor imgspecv1.Descriptor) (io.ReadCloser, error) {
+	d := descriptor.Digest
+	if err := d.Validate(); err != nil {
+		return nil, fmt.Errorf("unexpected digest reference %s: %w", d, err)
+	}
+
+	reader, err := a.entry(path.Join("blobs", d.Algorithm().String(), d.Hex()))
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.VerifyBlob(reader, descriptor)
 }
 
-func (a ociArchiveImageReader) GetManifest() (*imgspecv1.Manifest, error) {
-	return a.ociLayoutImageReader.GetManifest()
+func (a ociArchiveImageReader) ManifestDescriptor() imgspecv1.Descriptor {
+	return a.descriptor
 }
 
-func (a ociArchiveImageReader) GetImage() (*imgspecv1.Image, error) {
-	return a.ociLayoutImageReader.GetImage()
+func (a ociArchiveImageReader) Referrers(artifactType string) ([]imgspecv1.Descriptor, error) {
+	return internal.Referrers(a.index, a.descriptor.Digest, artifactType, a.GetBlob)
 }
 
-func newImageReader(ref ociArchiveRef) (types.ImageReader, error) {
-	tmpDirRef, err := untarIntoTmpDir(ref)
+func (a ociArchiveImageReader) GetManifest() (*imgspecv1.Manifest, error) {
+	manifest, err := internal.ParseBlob[imgspecv1.Manifest](a.descriptor, a.GetBlob)
 	if err != nil {
 		return nil, err
 	}
 
-	ociLayoutImageReader, err := tmpDirRef.OCILayoutRef.NewImageReader()
+	if err := internal.ValidateManifest(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (a ociArchiveImageReader) GetImage() (*imgspecv1.Image, error) {
+	manifest, err := a.GetManifest()
 	if err != nil {
-		if err := tmpDirRef.DeleteTmpDir(); err != nil {
-			return nil, err
-		}
 		return nil, err
 	}
 
-	return &ociArchiveImageReader{
-		ref:                  ref,
-		ociLayoutImageReader: ociLayoutImageReader,
-		tmpDir:               tmpDirRef,
-	}, nil
+	return internal.ParseBlob[imgspecv1.Image](manifest.Config, a.GetBlob)
 }
 
-func untarIntoTmpDir(ref ociArchiveRef) (internal.TmpDirOCIRef, error) {
-	src := ref.resolvedFile
+func (a ociArchiveImageReader) entry(name string) (io.ReadCloser, error) {
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in archive %s", name, a.ref.resolvedFile)
+	}
+
+	if contents, ok := a.cached[name]; ok {
+		return io.NopCloser(bytes.NewReader(contents)), nil
+	}
+
+	if a.compressed {
+		return io.NopCloser(io.NewSectionReader(a.spool, entry.offset, entry.size)), nil
+	}
+
+	return io.NopCloser(io.NewSectionReader(a.file, entry.offset, entry.size)), nil
+}
+
+func newImageReader(ref ociArchiveRef, options types.ImageReaderOptions) (types.ImageReader, error) {
+	file, err := os.Open(ref.resolvedFile)
+	if err != nil {
+		return nil, err
+	}
 
-	tmpdir, err := tmpdir.MkTmpDir("oci-archive")
+	reader := &ociArchiveImageReader{
+		ref:  ref,
+		file: file,
+	}
+
+	reader.compressed, err = isCompressed(file)
 	if err != nil {
-		return internal.TmpDirOCIRef{}, fmt.Errorf("create tmp dir: %w", err)
+		reader.Close()
+		return nil, err
 	}
 
-	arch, err := os.Open(src)
+	if reader.compressed {
+		reader.entries, reader.cached, reader.spool, err = scanEntries(file)
+	} else {
+		reader.entries, err = indexEntries(file)
+	}
 	if err != nil {
-		return internal.TmpDirOCIRef{}, err
+		reader.Close()
+		return nil, fmt.Errorf("indexing archive: %w", err)
 	}
-	defer arch.Close()
 
-	ociLayoutRef, err := ocilayout.NewReference(tmpdir, ref.image, ref.imageTag)
+	indexReader, err := reader.entry("index.json")
 	if err != nil {
-		return internal.TmpDirOCIRef{}, err
+		reader.Close()
+		return nil, err
 	}
+	defer indexReader.Close()
 
-	tempDirRef := internal.TmpDirOCIRef{TmpDir: tmpdir, OCILayoutRef: ociLayoutRef}
+	var index imgspecv1.Index
+	if err := json.NewDecoder(indexReader).Decode(&index); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("parsing index: %w", err)
+	}
 
-	err = archive.Untar(arch, tempDirRef.TmpDir)
+	reader.index = &index
+	descriptor, err := internal.FindManifestDescriptor(&index, ref.reference, reader.GetBlob)
 	if err != nil {
-		if err := tempDirRef.DeleteTmpDir(); err != nil {
-			return internal.TmpDirOCIRef{}, fmt.Errorf("deleting tmp dir: %w", err)
+		reader.Close()
+		return nil, err
+	}
+
+	reader.descriptor, err = internal.ResolveManifest(descriptor, options.Platform, reader.GetBlob)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func isCompressed(file *os.File) (bool, error) {
+	sig := make([]byte, 10)
+	n, err := file.ReadAt(sig, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return archive.DetectCompression(sig[:n]) != archive.Uncompressed, nil
+}
+
+// indexEntries records the offset and size of every regular file in the tar
+// stream. Entry contents are skipped with Seek rather than read.
+func indexEntries(file *os.File) (map[string]tarEntry, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]tarEntry)
+
+	tr := tar.NewReader(file)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("tar read: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
 		}
-		return internal.TmpDirOCIRef{}, fmt.Errorf("untar")
+
+		// After Next the file is positioned at the start of the entry data.
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[entryName(header.Name)] = tarEntry{offset: offset, size: header.Size}
 	}
 
-	return tempDirRef, nil
+	return entries, nil
+}
+
+// scanEntries records the regular files of a compressed archive in a single
+// pass over the decompressed stream, keeping the contents of small ones and
+// spooling the others to a temporary file, where their offsets point.
+func scanEntries(file *os.File) (map[string]tarEntry, map[string][]byte, *os.File, error) {
+	decompressed, _, err := archive.DecompressStream(io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer archive.CloseDecompressed(decompressed)
+
+	spool, err := os.CreateTemp("", "cbt-archive-")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	fail := func(err error) (map[string]tarEntry, map[string][]byte, *os.File, error) {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, nil, nil, err
+	}
+
+	entries := make(map[string]tarEntry)
+	cached := make(map[string][]byte)
+	var cachedSize, spooledSize int64
+
+	tr := tar.NewReader(decompressed)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Errorf("tar read: %w", err))
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := entryName(header.Name)
+
+		if header.Size <= maxCachedEntrySize && cachedSize+header.Size <= maxCachedSize {
+			contents, err := io.ReadAll(tr)
+			if err != nil {
+				return fail(fmt.Errorf("tar read: %w", err))
+			}
+			entries[name] = tarEntry{size: header.Size}
+			cached[name] = contents
+			cachedSize += header.Size
+			continue
+		}
+
+		n, err := io.Copy(spool, tr)
+		if err != nil {
+			return fail(fmt.Errorf("spooling %s: %w", name, err))
+		}
+		entries[name] = tarEntry{offset: spooledSize, size: n}
+		delete(cached, name)
+		spooledSize += n
+	}
+
+	return entries, cached, spool, nil
+}
+
+func entryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
 }
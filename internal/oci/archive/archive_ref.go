@@ -1,44 +1,51 @@
 package archive
 
 import (
+	"fmt"
+	"path"
 	"path/filepath"
 
 	internalfilepath "github.com/pkorzh/container-build-tool/internal/filepath"
-	"github.com/pkorzh/container-build-tool/internal/oci/internal"
+	"github.com/pkorzh/container-build-tool/internal/reference"
 	"github.com/pkorzh/container-build-tool/internal/types"
 )
 
 type ociArchiveRef struct {
 	file         string
 	resolvedFile string
-	image        string
-	imageTag     string
+	reference    reference.Reference
 }
 
-func (ref ociArchiveRef) NewImageReader() (types.ImageReader, error) {
-	return newImageReader(ref)
+func (ref ociArchiveRef) NewImageReader(options types.ImageReaderOptions) (types.ImageReader, error) {
+	return newImageReader(ref, options)
 }
 
-func (ref ociArchiveRef) NewImageWriter() (types.ImageWriter, error) {
-	return newImageWriter(ref)
+func (ref ociArchiveRef) NewImageWriter(options types.ImageWriterOptions) (types.ImageWriter, error) {
+	if ref.reference.Digest != "" {
+		return nil, fmt.Errorf("cannot write to %s: references with a digest are read-only", ref.reference)
+	}
+	return newImageWriter(ref, options)
 }
 
 func (ref ociArchiveRef) ImageName() string {
-	if ref.image == "" {
+	if ref.reference.Name == "" {
 		fileName := filepath.Base(ref.resolvedFile)
 		fileExt := filepath.Ext(fileName)
 		return fileName[:len(fileName)-len(fileExt)]
 	} else {
-		return ref.image
+		return path.Base(ref.reference.Name)
 	}
 }
 
 func ParseReference(ref string) (types.ImageRef, error) {
-	file, image, tag := internal.ExtractFileImageTag(ref)
-	return NewReference(file, image, tag)
+	file, reference, err := reference.SplitPath(ref)
+	if err != nil {
+		return nil, err
+	}
+	return NewReference(file, reference)
 }
 
-func NewReference(file, image, imageTag string) (types.ImageRef, error) {
+func NewReference(file string, reference reference.Reference) (types.ImageRef, error) {
 	resolved, err := internalfilepath.ResolvePath(file)
 	if err != nil {
 		return nil, err
@@ -46,7 +53,6 @@ func NewReference(file, image, imageTag string) (types.ImageRef, error) {
 	return ociArchiveRef{
 		file:         file,
 		resolvedFile: resolved,
-		image:        image,
-		imageTag:     imageTag,
+		reference:    reference,
 	}, nil
 }
@@ -1,13 +1,13 @@
 package archive
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
-	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkorzh/container-build-tool/internal/archive"
-	"github.com/pkorzh/container-build-tool/internal/oci/internal"
 	ocilayout "github.com/pkorzh/container-build-tool/internal/oci/layout"
 	"github.com/pkorzh/container-build-tool/internal/tmpdir"
 	"github.com/pkorzh/container-build-tool/internal/types"
@@ -16,11 +16,12 @@ import (
 type ociArchiveImageWriter struct {
 	ref                  ociArchiveRef
 	ociLayoutImageWriter types.ImageWriter
-	tmpDir               internal.TmpDirOCIRef
+	tmpDir               string
+	compression          archive.Compression
 }
 
 func (a ociArchiveImageWriter) Close() error {
-	defer a.tmpDir.DeleteTmpDir()
+	defer os.RemoveAll(a.tmpDir)
 	return a.ociLayoutImageWriter.Close()
 }
 
@@ -30,26 +31,43 @@ func (a ociArchiveImageWriter) Save() error {
 		return err
 	}
 
-	src := a.tmpDir.TmpDir
+	src := a.tmpDir
 	dst := a.ref.resolvedFile
 
-	file, err := os.Create(dst)
+	// The archive is written next to its destination and renamed into place
+	// so that a failed save never leaves a truncated archive behind.
+	file, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-")
 	if err != nil {
-		return nil
+		return fmt.Errorf("creating archive: %w", err)
 	}
-	defer file.Close()
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
 
-	reader, err := archive.Tar(src, archive.Gzip)
+	reader, err := archive.Tar(src, a.compression)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
 	if _, err := io.Copy(file, reader); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+
+	if err := file.Chmod(0644); err != nil {
 		return err
 	}
 
-	return nil
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), dst)
 }
 
 func (a ociArchiveImageWriter) PutImageBlob(i imgspecv1.Image, m *imgspecv1.Manifest) (imgspecv1.Descriptor, error) {
@@ -64,17 +82,24 @@ func (a ociArchiveImageWriter) PutBlob(r io.Reader, options types.PutBlobOptions
 	return a.ociLayoutImageWriter.PutBlob(r, options)
 }
 
-func (a ociArchiveImageWriter) GetBlob(digest digest.Digest) (io.ReadCloser, error) {
-	return a.ociLayoutImageWriter.GetBlob(digest)
+func (a ociArchiveImageWriter) GetBlob(descriptor imgspecv1.Descriptor) (io.ReadCloser, error) {
+	return a.ociLayoutImageWriter.GetBlob(descriptor)
 }
 
-func newImageWriter(ref ociArchiveRef) (types.ImageWriter, error) {
+func newImageWriter(ref ociArchiveRef, options types.ImageWriterOptions) (types.ImageWriter, error) {
 	tmpdir, err := tmpdir.MkTmpDir("oci-archive")
 	if err != nil {
 		return nil, err
 	}
 
-	ociLayoutRef, err := ocilayout.NewReference(tmpdir, ref.image, ref.imageTag)
+	if err := untarExisting(ref.resolvedFile, tmpdir); err != nil {
+		if err := os.RemoveAll(tmpdir); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+
+	ociLayoutRef, err := ocilayout.NewReference(tmpdir, ref.reference)
 	if err != nil {
 		if err := os.RemoveAll(tmpdir); err != nil {
 			return nil, err
@@ -82,7 +107,7 @@ func newImageWriter(ref ociArchiveRef) (types.ImageWriter, error) {
 		return nil, err
 	}
 
-	imageWriter, err := ociLayoutRef.NewImageWriter()
+	imageWriter, err := ociLayoutRef.NewImageWriter(options)
 	if err != nil {
 		if err := os.RemoveAll(tmpdir); err != nil {
 			return nil, err
@@ -93,8 +118,26 @@ func newImageWriter(ref ociArchiveRef) (types.ImageWriter, error) {
 	return &ociArchiveImageWriter{
 		ref:                  ref,
 		ociLayoutImageWriter: imageWriter,
-		tmpDir: internal.TmpDirOCIRef{
-			TmpDir: tmpdir,
-		},
+		tmpDir:               tmpdir,
+		compression:          options.ArchiveCompression,
 	}, nil
 }
+
+// untarExisting unpacks an existing archive at src into dst so that images
+// already stored in it are kept when the archive is written again.
+func untarExisting(src, dst string) error {
+	arch, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer arch.Close()
+
+	if err := archive.Untar(arch, dst, archive.UntarOptions{}); err != nil {
+		return fmt.Errorf("unpacking existing archive: %w", err)
+	}
+
+	return nil
+}
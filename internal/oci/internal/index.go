@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/reference"
+)
+
+// FindManifestDescriptor picks the manifest a reference addresses in an
+// index: by its ref.name annotation, by digest, or the only image when the
+// reference is empty. A reference with both checks that they agree.
+func FindManifestDescriptor(index *imgspecv1.Index, ref reference.Reference, getBlob func(imgspecv1.Descriptor) (io.ReadCloser, error)) (imgspecv1.Descriptor, error) {
+	if ref.IsZero() {
+		images, err := images(index, getBlob)
+		if err != nil {
+			return imgspecv1.Descriptor{}, err
+		}
+		if len(images) == 0 {
+			return imgspecv1.Descriptor{}, errors.New("no images found in index")
+		}
+		if len(images) > 1 {
+			return imgspecv1.Descriptor{}, errors.New("multiple images found in index, specify an image name or digest")
+		}
+		return images[0], nil
+	}
+
+	if ref.Name == "" {
+		for _, manifest := range index.Manifests {
+			if manifest.Digest == ref.Digest {
+				return manifest, nil
+			}
+		}
+		return imgspecv1.Descriptor{}, fmt.Errorf("image %s not found in index", ref.Digest)
+	}
+
+	for _, manifest := range index.Manifests {
+		if manifest.Annotations[imgspecv1.AnnotationRefName] != ref.RefName() {
+			continue
+		}
+		if ref.Digest != "" && manifest.Digest != ref.Digest {
+			return imgspecv1.Descriptor{}, fmt.Errorf("image %s has digest %s, not %s", ref.RefName(), manifest.Digest, ref.Digest)
+		}
+		return manifest, nil
+	}
+
+	return imgspecv1.Descriptor{}, fmt.Errorf("image %s not found in index", ref.RefName())
+}
+
+// images returns the manifests of an index other than referrers indexes and
+// the referrers listed in them, which describe images rather than being
+// images of their own.
+func images(index *imgspecv1.Index, getBlob func(imgspecv1.Descriptor) (io.ReadCloser, error)) ([]imgspecv1.Descriptor, error) {
+	referrersIndexes := make(map[string]imgspecv1.Descriptor)
+	for _, manifest := range index.Manifests {
+		if tag := manifest.Annotations[imgspecv1.AnnotationRefName]; tag != "" {
+			referrersIndexes[tag] = manifest
+		}
+	}
+
+	excluded := make(map[digest.Digest]bool)
+	for _, manifest := range index.Manifests {
+		if manifest.Digest.Validate() != nil {
+			continue
+		}
+		referrersIndex, ok := referrersIndexes[ReferrersTag(manifest.Digest)]
+		if !ok {
+			continue
+		}
+		excluded[referrersIndex.Digest] = true
+
+		referrers, err := ReadIndex(referrersIndex, getBlob)
+		if err != nil {
+			return nil, fmt.Errorf("reading referrers of %s: %w", manifest.Digest, err)
+		}
+		for _, referrer := range referrers.Manifests {
+			excluded[referrer.Digest] = true
+		}
+	}
+
+	var images []imgspecv1.Descriptor
+	for _, manifest := range index.Manifests {
+		if !excluded[manifest.Digest] {
+			images = append(images, manifest)
+		}
+	}
+
+	return images, nil
+}
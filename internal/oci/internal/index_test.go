@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/reference"
+)
+
+func TestFindManifestDescriptorSkipsReferrers(t *testing.T) {
+	blobs := make(map[digest.Digest][]byte)
+	put := func(mediaType string, v any) imgspecv1.Descriptor {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := digest.FromBytes(data)
+		blobs[d] = data
+		return imgspecv1.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+	}
+	getBlob := func(descriptor imgspecv1.Descriptor) (io.ReadCloser, error) {
+		data, ok := blobs[descriptor.Digest]
+		if !ok {
+			return nil, fmt.Errorf("blob %s not found", descriptor.Digest)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	image := put(imgspecv1.MediaTypeImageManifest, imgspecv1.Manifest{MediaType: imgspecv1.MediaTypeImageManifest})
+	referrer := put(imgspecv1.MediaTypeImageManifest, imgspecv1.Manifest{
+		MediaType:    imgspecv1.MediaTypeImageManifest,
+		ArtifactType: "application/x",
+		Subject:      &image,
+	})
+	referrersIndex := put(imgspecv1.MediaTypeImageIndex, imgspecv1.Index{
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{referrer},
+	})
+	referrersIndex.Annotations = map[string]string{imgspecv1.AnnotationRefName: ReferrersTag(image.Digest)}
+
+	index := &imgspecv1.Index{Manifests: []imgspecv1.Descriptor{image, referrer, referrersIndex}}
+
+	got, err := FindManifestDescriptor(index, reference.Reference{}, getBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Digest != image.Digest {
+		t.Errorf("found %s, want image %s", got.Digest, image.Digest)
+	}
+
+	other := put(imgspecv1.MediaTypeImageManifest, imgspecv1.Manifest{MediaType: imgspecv1.MediaTypeImageManifest, Annotations: map[string]string{"a": "b"}})
+	index.Manifests = append(index.Manifests, other)
+	if _, err := FindManifestDescriptor(index, reference.Reference{}, getBlob); err == nil {
+		t.Error("found a manifest in an index with two images, want error")
+	}
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/pkorzh/container-build-tool/internal/manifest"
+)
+
+// ResolveManifest follows an OCI index or Docker manifest list to the
+// manifest for a platform, the default one when it's nil. Other
+// descriptors are returned as is.
+func ResolveManifest(descriptor imgspecv1.Descriptor, platform *imgspecv1.Platform, getBlob func(imgspecv1.Descriptor) (io.ReadCloser, error)) (imgspecv1.Descriptor, error) {
+	want := manifest.DefaultPlatform()
+	if platform != nil {
+		want = *platform
+	}
+
+	// Nested indexes are followed a few levels deep at most.
+	for depth := 0; manifest.IsIndex(descriptor.MediaType); depth++ {
+		if depth == 4 {
+			return imgspecv1.Descriptor{}, errors.New("image indexes nested too deeply")
+		}
+
+		index, err := ReadIndex(descriptor, getBlob)
+		if err != nil {
+			return imgspecv1.Descriptor{}, fmt.Errorf("reading index %s: %w", descriptor.Digest, err)
+		}
+
+		platformDescriptor, err := platformManifest(index, want)
+		if err != nil {
+			return imgspecv1.Descriptor{}, fmt.Errorf("index %s: %w", descriptor.Digest, err)
+		}
+		descriptor = platformDescriptor
+	}
+
+	return descriptor, nil
+}
+
+// platformManifest picks the manifest of an index that fits the platform
+// best, the first one among equally good fits.
+func platformManifest(index *imgspecv1.Index, want imgspecv1.Platform) (imgspecv1.Descriptor, error) {
+	best := -1
+	bestRank := 0
+	for i, descriptor := range index.Manifests {
+		if descriptor.Platform == nil {
+			continue
+		}
+		rank, ok := manifest.MatchPlatform(want, *descriptor.Platform)
+		if ok && (best < 0 || rank > bestRank) {
+			best, bestRank = i, rank
+		}
+	}
+
+	if best < 0 {
+		return imgspecv1.Descriptor{}, fmt.Errorf("no image for %s", manifest.FormatPlatform(want))
+	}
+
+	return index.Manifests[best], nil
+}
+
+// ValidateManifest checks a manifest is an OCI or Docker v2 schema 2 image
+// manifest, the ones readers can make sense of.
+func ValidateManifest(m *imgspecv1.Manifest) error {
+	if m.SchemaVersion != 2 {
+		return fmt.Errorf("unsupported manifest schema version %d", m.SchemaVersion)
+	}
+
+	_, err := manifest.FormatOf(m)
+	return err
+}
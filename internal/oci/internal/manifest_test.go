@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"testing"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPlatformManifest(t *testing.T) {
+	index := &imgspecv1.Index{Manifests: []imgspecv1.Descriptor{
+		{Digest: "amd64", Platform: &imgspecv1.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "armv6", Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: "armv7", Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Digest: "arm64", Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm64"}},
+		{Digest: "windows", Platform: &imgspecv1.Platform{OS: "windows", Architecture: "amd64"}},
+	}}
+
+	tests := []struct {
+		want    imgspecv1.Platform
+		digest  string
+		wantErr bool
+	}{
+		{want: imgspecv1.Platform{OS: "linux", Architecture: "amd64"}, digest: "amd64"},
+		{want: imgspecv1.Platform{OS: "windows", Architecture: "amd64"}, digest: "windows"},
+		{want: imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, digest: "armv7"},
+		{want: imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, digest: "armv6"},
+		{want: imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v8"}, digest: "armv7"},
+		{want: imgspecv1.Platform{OS: "linux", Architecture: "arm", Variant: "v5"}, wantErr: true},
+		{want: imgspecv1.Platform{OS: "linux", Architecture: "arm"}, digest: "armv6"},
+		{want: imgspecv1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, digest: "arm64"},
+		{want: imgspecv1.Platform{OS: "darwin", Architecture: "arm64"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := platformManifest(index, test.want)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("platformManifest(%v) = %s, want error", test.want, got.Digest)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("platformManifest(%v): %v", test.want, err)
+			continue
+		}
+		if string(got.Digest) != test.digest {
+			t.Errorf("platformManifest(%v) = %s, want %s", test.want, got.Digest, test.digest)
+		}
+	}
+}
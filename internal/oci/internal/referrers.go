@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	imgspec "github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReferrersTag is the tag the referrers index of a subject is stored under
+// in the fallback tag schema of the distribution spec, <alg>-<hex>.
+func ReferrersTag(subject digest.Digest) string {
+	return subject.Algorithm().String() + "-" + subject.Encoded()
+}
+
+// FindReferrersIndex returns the descriptor of the referrers index of a
+// subject, if the index has one.
+func FindReferrersIndex(index *imgspecv1.Index, subject digest.Digest) (imgspecv1.Descriptor, bool) {
+	tag := ReferrersTag(subject)
+	for _, manifest := range index.Manifests {
+		if manifest.Annotations[imgspecv1.AnnotationRefName] == tag {
+			return manifest, true
+		}
+	}
+	return imgspecv1.Descriptor{}, false
+}
+
+// Referrers lists the manifests referring to a subject, read from its
+// referrers index, keeping those of the given artifact type if one is set.
+func Referrers(index *imgspecv1.Index, subject digest.Digest, artifactType string, getBlob func(imgspecv1.Descriptor) (io.ReadCloser, error)) ([]imgspecv1.Descriptor, error) {
+	descriptor, ok := FindReferrersIndex(index, subject)
+	if !ok {
+		return nil, nil
+	}
+
+	referrers, err := ReadIndex(descriptor, getBlob)
+	if err != nil {
+		return nil, fmt.Errorf("reading referrers of %s: %w", subject, err)
+	}
+
+	var filtered []imgspecv1.Descriptor
+	for _, referrer := range referrers.Manifests {
+		if artifactType == "" || referrer.ArtifactType == artifactType {
+			filtered = append(filtered, referrer)
+		}
+	}
+
+	return filtered, nil
+}
+
+// ReadIndex reads an index blob.
+func ReadIndex(descriptor imgspecv1.Descriptor, getBlob func(imgspecv1.Descriptor) (io.ReadCloser, error)) (*imgspecv1.Index, error) {
+	return ParseBlob[imgspecv1.Index](descriptor, getBlob)
+}
+
+// ReferrerDescriptor describes a manifest in the referrers index of its
+// subject. The artifact type falls back to the config media type.
+func ReferrerDescriptor(descriptor imgspecv1.Descriptor, manifest imgspecv1.Manifest) imgspecv1.Descriptor {
+	artifactType := manifest.ArtifactType
+	if artifactType == "" {
+		artifactType = manifest.Config.MediaType
+	}
+
+	return imgspecv1.Descriptor{
+		MediaType:    descriptor.MediaType,
+		Digest:       descriptor.Digest,
+		Size:         descriptor.Size,
+		ArtifactType: artifactType,
+		Annotations:  manifest.Annotations,
+	}
+}
+
+// AddReferrers adds referrers to a referrers index, replacing any with the
+// same digest.
+func AddReferrers(index *imgspecv1.Index, referrers []imgspecv1.Descriptor) *imgspecv1.Index {
+	if index == nil {
+		index = &imgspecv1.Index{
+			Versioned: imgspec.Versioned{
+				SchemaVersion: 2,
+			},
+			MediaType: imgspecv1.MediaTypeImageIndex,
+			Manifests: []imgspecv1.Descriptor{},
+		}
+	}
+
+	for _, referrer := range referrers {
+		replaced := false
+		for i, existing := range index.Manifests {
+			if existing.Digest == referrer.Digest {
+				index.Manifests[i] = referrer
+				replaced = true
+			}
+		}
+		if !replaced {
+			index.Manifests = append(index.Manifests, referrer)
+		}
+	}
+
+	return index
+}
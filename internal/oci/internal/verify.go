@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// verifyingReader checks a blob against its descriptor as it's read. A blob
+// larger than expected fails as soon as it's over; the size and digest are
+// checked at EOF.
+type verifyingReader struct {
+	blob       io.ReadCloser
+	descriptor imgspecv1.Descriptor
+	verifier   digest.Verifier
+	read       int64
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.blob.Read(p)
+	r.read += int64(n)
+	r.verifier.Write(p[:n])
+
+	if r.read > r.descriptor.Size {
+		return n, fmt.Errorf("blob %s is larger than the expected %d bytes", r.descriptor.Digest, r.descriptor.Size)
+	}
+
+	if err == io.EOF {
+		if r.read != r.descriptor.Size {
+			return n, fmt.Errorf("blob %s has %d bytes, expected %d", r.descriptor.Digest, r.read, r.descriptor.Size)
+		}
+		if !r.verifier.Verified() {
+			return n, fmt.Errorf("blob %s doesn't match its digest", r.descriptor.Digest)
+		}
+	}
+
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.blob.Close()
+}
+
+// VerifyBlob wraps a blob in a reader that fails the read at EOF if the
+// blob doesn't match the digest and size of its descriptor. Callers that
+// stop reading before EOF get no verification. The blob is closed if the
+// digest can't be verified.
+func VerifyBlob(blob io.ReadCloser, descriptor imgspecv1.Descriptor) (io.ReadCloser, error) {
+	if err := descriptor.Digest.Validate(); err != nil {
+		blob.Close()
+		return nil, fmt.Errorf("unexpected digest reference %s: %w", descriptor.Digest, err)
+	}
+
+	return &verifyingReader{
+		blob:       blob,
+		descriptor: descriptor,
+		verifier:   descriptor.Digest.Verifier(),
+	}, nil
+}
+
+// ParseBlob reads a JSON blob. It's read in full, so that it's verified
+// before being parsed.
+func ParseBlob[T any](descriptor imgspecv1.Descriptor, getBlob func(imgspecv1.Descriptor) (io.ReadCloser, error)) (*T, error) {
+	blob, err := getBlob(descriptor)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	contents, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	data := new(T)
+	if err := json.Unmarshal(contents, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
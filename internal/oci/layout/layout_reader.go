@@ -2,11 +2,9 @@ package layout
 
 import (
 	"io"
-	"os"
 
-	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/pkorzh/container-build-tool/internal/json"
+	"github.com/pkorzh/container-build-tool/internal/oci/internal"
 	"github.com/pkorzh/container-build-tool/internal/types"
 )
 
@@ -24,28 +22,25 @@ func (a ociLayoutImageReader) Index() *imgspecv1.Index {
 	return a.index
 }
 
-func (a ociLayoutImageReader) GetBlob(d digest.Digest) (io.ReadCloser, error) {
-	blobPath, err := a.ref.blobPath(d)
-	if err != nil {
-		return nil, err
-	}
+func (a ociLayoutImageReader) GetBlob(descriptor imgspecv1.Descriptor) (io.ReadCloser, error) {
+	return a.ref.openBlob(descriptor)
+}
 
-	contents, err := os.Open(blobPath)
-	if err != nil {
-		return nil, err
-	}
+func (a ociLayoutImageReader) ManifestDescriptor() imgspecv1.Descriptor {
+	return a.descriptor
+}
 
-	return contents, nil
+func (a ociLayoutImageReader) Referrers(artifactType string) ([]imgspecv1.Descriptor, error) {
+	return internal.Referrers(a.index, a.descriptor.Digest, artifactType, a.GetBlob)
 }
 
 func (a ociLayoutImageReader) GetManifest() (*imgspecv1.Manifest, error) {
-	manifestPath, err := a.ref.blobPath(a.descriptor.Digest)
+	manifest, err := internal.ParseBlob[imgspecv1.Manifest](a.descriptor, a.GetBlob)
 	if err != nil {
 		return nil, err
 	}
 
-	manifest, err := json.ParseJSON[imgspecv1.Manifest](manifestPath)
-	if err != nil {
+	if err := internal.ValidateManifest(manifest); err != nil {
 		return nil, err
 	}
 
@@ -58,33 +53,29 @@ func (a ociLayoutImageReader) GetImage() (*imgspecv1.Image, error) {
 		return nil, err
 	}
 
-	imagePath, err := a.ref.blobPath(manifest.Config.Digest)
+	return internal.ParseBlob[imgspecv1.Image](manifest.Config, a.GetBlob)
+}
+
+func newImageReader(ref ociLayoutRef, options types.ImageReaderOptions) (types.ImageReader, error) {
+	index, err := ref.index()
 	if err != nil {
 		return nil, err
 	}
 
-	image, err := json.ParseJSON[imgspecv1.Image](imagePath)
+	menifestDescriptor, err := ref.manifestDescriptor()
 	if err != nil {
 		return nil, err
 	}
 
-	return image, nil
-}
-
-func newImageReader(ref ociLayoutRef) (types.ImageReader, error) {
-	index, err := ref.index()
-	if err != nil {
-		return nil, err
+	reader := &ociLayoutImageReader{
+		ref:   ref,
+		index: index,
 	}
 
-	menifestDescriptor, err := ref.manifestDescriptor()
+	reader.descriptor, err = internal.ResolveManifest(menifestDescriptor, options.Platform, reader.GetBlob)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ociLayoutImageReader{
-		ref:        ref,
-		index:      index,
-		descriptor: menifestDescriptor,
-	}, nil
+	return reader, nil
 }
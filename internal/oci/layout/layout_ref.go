@@ -2,41 +2,48 @@ package layout
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path"
 	"path/filepath"
 
 	_ "crypto/sha256"
 	_ "crypto/sha512"
 
+	imgspec "github.com/opencontainers/image-spec/specs-go"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/opencontainers/go-digest"
 	ctbfilepath "github.com/pkorzh/container-build-tool/internal/filepath"
 	"github.com/pkorzh/container-build-tool/internal/json"
 	"github.com/pkorzh/container-build-tool/internal/oci/internal"
+	"github.com/pkorzh/container-build-tool/internal/reference"
 	"github.com/pkorzh/container-build-tool/internal/types"
 )
 
 type ociLayoutRef struct {
 	dir         string
 	resolvedDir string
-	image       string
-	imageTag    string
+	reference   reference.Reference
 }
 
-func (ref ociLayoutRef) NewImageReader() (types.ImageReader, error) {
-	return newImageReader(ref)
+func (ref ociLayoutRef) NewImageReader(options types.ImageReaderOptions) (types.ImageReader, error) {
+	return newImageReader(ref, options)
 }
 
-func (ref ociLayoutRef) NewImageWriter() (types.ImageWriter, error) {
+func (ref ociLayoutRef) NewImageWriter(options types.ImageWriterOptions) (types.ImageWriter, error) {
+	if ref.reference.Digest != "" {
+		return nil, fmt.Errorf("cannot write to %s: references with a digest are read-only", ref.reference)
+	}
 	return newImageWriter(ref)
 }
 
 func (ref ociLayoutRef) ImageName() string {
-	if ref.image == "" {
+	if ref.reference.Name == "" {
 		dir := filepath.Base(ref.resolvedDir)
 		return filepath.Base(dir)
 	} else {
-		return ref.image
+		return path.Base(ref.reference.Name)
 	}
 }
 
@@ -56,43 +63,55 @@ func (ref ociLayoutRef) blobPath(d digest.Digest) (string, error) {
 	return filepath.Join(blobDir, d.Algorithm().String(), d.Hex()), nil
 }
 
+// openBlob opens a blob for reading, verified against its descriptor.
+func (ref ociLayoutRef) openBlob(descriptor imgspecv1.Descriptor) (io.ReadCloser, error) {
+	blobPath, err := ref.blobPath(descriptor.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := os.Open(blobPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.VerifyBlob(contents, descriptor)
+}
+
 func (ref ociLayoutRef) index() (*imgspecv1.Index, error) {
 	return json.ParseJSON[imgspecv1.Index](ref.indexPath())
 }
 
+func (ref ociLayoutRef) indexOrEmpty() (*imgspecv1.Index, error) {
+	if _, err := os.Stat(ref.indexPath()); err != nil && os.IsNotExist(err) {
+		return &imgspecv1.Index{
+			Versioned: imgspec.Versioned{
+				SchemaVersion: 2,
+			},
+		}, nil
+	}
+
+	return ref.index()
+}
+
 func (ref ociLayoutRef) manifestDescriptor() (imgspecv1.Descriptor, error) {
 	imageIndex, err := ref.index()
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
 	}
 
-	var annotationRefName = ""
-	if ref.image != "" && ref.imageTag != "" {
-		annotationRefName = fmt.Sprintf("%s:%s", ref.image, ref.imageTag)
-	}
-
-	if annotationRefName == "" {
-		if len(imageIndex.Manifests) > 1 {
-			return imgspecv1.Descriptor{}, fmt.Errorf("multiple images found in index, specify image name")
-		}
-		return imageIndex.Manifests[0], nil
-	} else {
-		for _, manifest := range imageIndex.Manifests {
-			if v, ok := manifest.Annotations[imgspecv1.AnnotationRefName]; ok && v == annotationRefName {
-				return manifest, nil
-			}
-		}
-	}
-
-	return imgspecv1.Descriptor{}, fmt.Errorf("image %s not found in index", annotationRefName)
+	return internal.FindManifestDescriptor(imageIndex, ref.reference, ref.openBlob)
 }
 
 func ParseReference(ref string) (types.ImageRef, error) {
-	file, image, tag := internal.ExtractFileImageTag(ref)
-	return NewReference(file, image, tag)
+	file, reference, err := reference.SplitPath(ref)
+	if err != nil {
+		return nil, err
+	}
+	return NewReference(file, reference)
 }
 
-func NewReference(file, image, imageTag string) (types.ImageRef, error) {
+func NewReference(file string, reference reference.Reference) (types.ImageRef, error) {
 	resolved, err := ctbfilepath.ResolvePath(file)
 	if err != nil {
 		return nil, err
@@ -100,7 +119,6 @@ func NewReference(file, image, imageTag string) (types.ImageRef, error) {
 	return &ociLayoutRef{
 		dir:         file,
 		resolvedDir: resolved,
-		image:       image,
-		imageTag:    imageTag,
+		reference:   reference,
 	}, nil
 }
@@ -7,23 +7,40 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/opencontainers/go-digest"
-	imgspec "github.com/opencontainers/image-spec/specs-go"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkorzh/container-build-tool/internal/atomicfile"
+	"github.com/pkorzh/container-build-tool/internal/lockfile"
+	"github.com/pkorzh/container-build-tool/internal/manifest"
+	"github.com/pkorzh/container-build-tool/internal/oci/internal"
 	"github.com/pkorzh/container-build-tool/internal/types"
 )
 
 type ociLayoutImageWriter struct {
-	ref   ociLayoutRef
-	index *imgspecv1.Index
+	ref       ociLayoutRef
+	manifests []imgspecv1.Descriptor
+	// referrers holds the written manifests that have a subject, by
+	// subject digest.
+	referrers map[digest.Digest][]imgspecv1.Descriptor
 }
 
-func (a ociLayoutImageWriter) Close() error {
+func (a *ociLayoutImageWriter) Close() error {
 	return nil
 }
 
-func (a ociLayoutImageWriter) Save() error {
+func (a *ociLayoutImageWriter) Save() error {
+	if err := os.MkdirAll(a.ref.dir, 0755); err != nil {
+		return err
+	}
+
+	lock, err := lockfile.Lock(a.ref.dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	layoutBytes, err := json.Marshal(imgspecv1.ImageLayout{
 		Version: imgspecv1.ImageLayoutVersion,
 	})
@@ -31,15 +48,30 @@ func (a ociLayoutImageWriter) Save() error {
 		return err
 	}
 
-	if err := os.WriteFile(a.ref.ociLayoutPath(), layoutBytes, 0644); err != nil {
+	if err := atomicfile.WriteFile(a.ref.ociLayoutPath(), layoutBytes, 0644); err != nil {
+		return err
+	}
+
+	// The index is read under the lock so that manifests saved concurrently
+	// by other writers are kept.
+	index, err := a.ref.indexOrEmpty()
+	if err != nil {
 		return err
 	}
 
-	indexJSON, err := json.Marshal(a.index)
+	for _, descriptor := range a.manifests {
+		addManifest(index, descriptor)
+	}
+
+	if err := a.saveReferrers(index); err != nil {
+		return fmt.Errorf("saving referrers: %w", err)
+	}
+
+	indexJSON, err := json.Marshal(index)
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(a.ref.indexPath(), indexJSON, 0644)
+	err = atomicfile.WriteFile(a.ref.indexPath(), indexJSON, 0644)
 	if err != nil {
 		return err
 	}
@@ -54,14 +86,19 @@ func (a ociLayoutImageWriter) Save() error {
 	return nil
 }
 
-func (a ociLayoutImageWriter) PutImageBlob(i imgspecv1.Image, m *imgspecv1.Manifest) (imgspecv1.Descriptor, error) {
+func (a *ociLayoutImageWriter) PutImageBlob(i imgspecv1.Image, m *imgspecv1.Manifest) (imgspecv1.Descriptor, error) {
+	format, err := manifest.FormatOf(m)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+
 	jsonBytes, err := json.Marshal(i)
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
 	}
 
 	descriptor, err := a.PutBlob(bytes.NewReader(jsonBytes), types.PutBlobOptions{
-		MediaType: imgspecv1.MediaTypeImageConfig,
+		MediaType: manifest.ConfigMediaType(format),
 	})
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
@@ -72,36 +109,117 @@ func (a ociLayoutImageWriter) PutImageBlob(i imgspecv1.Image, m *imgspecv1.Manif
 	return descriptor, nil
 }
 
-func (a ociLayoutImageWriter) PutManifestBlob(m imgspecv1.Manifest) (imgspecv1.Descriptor, error) {
+func (a *ociLayoutImageWriter) PutManifestBlob(m imgspecv1.Manifest) (imgspecv1.Descriptor, error) {
+	format, err := manifest.FormatOf(&m)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+
 	jsonBytes, err := json.Marshal(m)
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
 	}
 
-	descriptor, err := a.PutBlob(bytes.NewReader(jsonBytes), types.PutBlobOptions{
-		MediaType: imgspecv1.MediaTypeImageManifest,
-	})
+	options := types.PutBlobOptions{
+		MediaType: manifest.MediaType(format),
+	}
+	if a.ref.reference.Name != "" {
+		options.Annotations = map[string]string{
+			imgspecv1.AnnotationRefName: a.ref.reference.RefName(),
+		}
+	}
+
+	descriptor, err := a.PutBlob(bytes.NewReader(jsonBytes), options)
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
 	}
+	descriptor.ArtifactType = m.ArtifactType
+
+	a.manifests = append(a.manifests, descriptor)
+
+	if m.Subject != nil {
+		if a.referrers == nil {
+			a.referrers = make(map[digest.Digest][]imgspecv1.Descriptor)
+		}
+		a.referrers[m.Subject.Digest] = append(a.referrers[m.Subject.Digest], internal.ReferrerDescriptor(descriptor, m))
+	}
+
+	return descriptor, nil
+}
+
+// saveReferrers adds the written manifests that have a subject to the
+// referrers index of their subject. Layouts have no referrers API, so the
+// index is tagged following the fallback tag schema.
+func (a *ociLayoutImageWriter) saveReferrers(index *imgspecv1.Index) error {
+	subjects := make([]digest.Digest, 0, len(a.referrers))
+	for subject := range a.referrers {
+		subjects = append(subjects, subject)
+	}
+	sort.Slice(subjects, func(i, j int) bool { return subjects[i] < subjects[j] })
+
+	for _, subject := range subjects {
+		referrers := a.referrers[subject]
+		var referrersIndex *imgspecv1.Index
+
+		existing, found := internal.FindReferrersIndex(index, subject)
+		if found {
+			var err error
+			referrersIndex, err = internal.ReadIndex(existing, a.GetBlob)
+			if err != nil {
+				return err
+			}
+		}
+		referrersIndex = internal.AddReferrers(referrersIndex, referrers)
+
+		indexJSON, err := json.Marshal(referrersIndex)
+		if err != nil {
+			return err
+		}
+
+		tag := internal.ReferrersTag(subject)
+		descriptor, err := a.PutBlob(bytes.NewReader(indexJSON), types.PutBlobOptions{
+			MediaType: imgspecv1.MediaTypeImageIndex,
+			Annotations: map[string]string{
+				imgspecv1.AnnotationRefName: tag,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		// The previous referrers index is replaced rather than untagged.
+		manifests := index.Manifests[:0]
+		for _, m := range index.Manifests {
+			if m.Annotations[imgspecv1.AnnotationRefName] != tag {
+				manifests = append(manifests, m)
+			}
+		}
+		index.Manifests = append(manifests, descriptor)
+	}
+
+	return nil
+}
 
+func addManifest(index *imgspecv1.Index, descriptor imgspecv1.Descriptor) {
 	if descriptor.Annotations != nil && descriptor.Annotations[imgspecv1.AnnotationRefName] != "" {
-		for i, m := range a.index.Manifests {
+		for i, m := range index.Manifests {
 			if m.Annotations[imgspecv1.AnnotationRefName] == descriptor.Annotations[imgspecv1.AnnotationRefName] {
-				delete(a.index.Manifests[i].Annotations, imgspecv1.AnnotationRefName)
+				delete(index.Manifests[i].Annotations, imgspecv1.AnnotationRefName)
 				break
 			}
 		}
 	}
 
-	a.index.Manifests = append(a.index.Manifests, descriptor)
-
-	return descriptor, nil
+	index.Manifests = append(index.Manifests, descriptor)
 }
 
-func (a ociLayoutImageWriter) PutBlob(blob io.Reader, options types.PutBlobOptions) (imgspecv1.Descriptor, error) {
+func (a *ociLayoutImageWriter) PutBlob(blob io.Reader, options types.PutBlobOptions) (imgspecv1.Descriptor, error) {
 	var tmpFileClosed bool
 
+	if err := os.MkdirAll(a.ref.dir, 0755); err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+
 	tmpFile, err := os.CreateTemp(a.ref.dir, "oci-layout-blob-")
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
@@ -128,6 +246,14 @@ func (a ociLayoutImageWriter) PutBlob(blob io.Reader, options types.PutBlobOptio
 
 	blobDigest := digester.Digest()
 
+	if options.Digest != "" && options.Digest != blobDigest {
+		return imgspecv1.Descriptor{}, fmt.Errorf("digest mismatch: expected %s, got %s", options.Digest, blobDigest)
+	}
+
+	if options.Size != 0 && options.Size != size {
+		return imgspecv1.Descriptor{}, fmt.Errorf("size mismatch for %s: expected %d, got %d", blobDigest, options.Size, size)
+	}
+
 	blobPath, err := a.ref.blobPath(blobDigest)
 	if err != nil {
 		return imgspecv1.Descriptor{}, err
@@ -155,38 +281,12 @@ func (a ociLayoutImageWriter) PutBlob(blob io.Reader, options types.PutBlobOptio
 	}, nil
 }
 
-func (a ociLayoutImageWriter) GetBlob(d digest.Digest) (io.ReadCloser, error) {
-	blobPath, err := a.ref.blobPath(d)
-	if err != nil {
-		return nil, err
-	}
-
-	contents, err := os.Open(blobPath)
-	if err != nil {
-		return nil, err
-	}
-
-	return contents, nil
+func (a *ociLayoutImageWriter) GetBlob(descriptor imgspecv1.Descriptor) (io.ReadCloser, error) {
+	return a.ref.openBlob(descriptor)
 }
 
 func newImageWriter(ref ociLayoutRef) (types.ImageWriter, error) {
-	var index *imgspecv1.Index
-
-	if _, err := os.Stat(ref.indexPath()); err != nil && os.IsNotExist(err) {
-		index = &imgspecv1.Index{
-			Versioned: imgspec.Versioned{
-				SchemaVersion: 2,
-			},
-		}
-	} else {
-		index, err = ref.index()
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	return &ociLayoutImageWriter{
-		ref:   ref,
-		index: index,
+		ref: ref,
 	}, nil
 }
@@ -0,0 +1,150 @@
+package reference
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const nameMaxLength = 255
+
+var (
+	// Per the distribution reference grammar: lowercase path components
+	// separated by slashes, optionally preceded by a registry domain.
+	domainRegexp    = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// Reference addresses an image inside a transport location as
+// name[:tag][@digest] or @digest.
+type Reference struct {
+	Name   string
+	Tag    string
+	Digest digest.Digest
+}
+
+// RefName is the name[:tag] part stored in the ref.name annotation.
+func (r Reference) RefName() string {
+	if r.Tag == "" {
+		return r.Name
+	}
+	return r.Name + ":" + r.Tag
+}
+
+func (r Reference) String() string {
+	s := r.RefName()
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+func (r Reference) IsZero() bool {
+	return r.Name == "" && r.Digest == ""
+}
+
+// Parse parses name[:tag][@digest] or @digest.
+func Parse(s string) (Reference, error) {
+	var ref Reference
+
+	if s == "" {
+		return ref, errors.New("empty image reference")
+	}
+
+	rest, dgst, found := strings.Cut(s, "@")
+	if found {
+		d, err := digest.Parse(dgst)
+		if err != nil {
+			return ref, fmt.Errorf("invalid digest %q in %q: %w", dgst, s, err)
+		}
+		ref.Digest = d
+		if rest == "" {
+			return ref, nil
+		}
+	}
+
+	// A colon after the last slash starts the tag; earlier ones belong to
+	// a registry port.
+	name := rest
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		name, ref.Tag = rest[:i], rest[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag %q in %q: tags are up to 128 word characters, dots and dashes, not starting with a dot or dash", ref.Tag, s)
+		}
+	}
+
+	if err := validateName(name); err != nil {
+		return ref, fmt.Errorf("invalid name in %q: %w", s, err)
+	}
+	ref.Name = name
+
+	return ref, nil
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("name is empty")
+	}
+	if len(name) > nameMaxLength {
+		return fmt.Errorf("name is longer than %d characters", nameMaxLength)
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) > 1 && (strings.ContainsAny(components[0], ".:") || components[0] == "localhost") {
+		if !domainRegexp.MatchString(components[0]) {
+			return fmt.Errorf("invalid domain %q", components[0])
+		}
+		components = components[1:]
+	}
+
+	for _, component := range components {
+		if !componentRegexp.MatchString(component) {
+			return fmt.Errorf("invalid path component %q: components are lowercase alphanumerics separated by '.', '_', '__' or dashes", component)
+		}
+	}
+
+	return nil
+}
+
+// SplitPath splits a transport location of the form path[:reference] or
+// path@digest. Colons, at signs and backslashes in the path are escaped with
+// a backslash.
+func SplitPath(s string) (string, Reference, error) {
+	var path strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 == len(s) || !strings.ContainsRune(`:@\`, rune(s[i+1])) {
+				return "", Reference{}, fmt.Errorf(`invalid escape in %q: only \:, \@ and \\ are allowed`, s)
+			}
+			i++
+			path.WriteByte(s[i])
+		case ':', '@':
+			rest := s[i:]
+			if s[i] == ':' {
+				rest = s[i+1:]
+			}
+			ref, err := Parse(rest)
+			if err != nil {
+				return "", Reference{}, err
+			}
+			if path.Len() == 0 {
+				return "", Reference{}, fmt.Errorf("missing path in %q", s)
+			}
+			return path.String(), ref, nil
+		default:
+			path.WriteByte(s[i])
+		}
+	}
+
+	if path.Len() == 0 {
+		return "", Reference{}, fmt.Errorf("missing path in %q", s)
+	}
+
+	return path.String(), Reference{}, nil
+}
@@ -0,0 +1,122 @@
+package reference
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var testDigest = digest.FromString("image")
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Reference
+		wantErr string
+	}{
+		{in: "app", want: Reference{Name: "app"}},
+		{in: "app:1.0", want: Reference{Name: "app", Tag: "1.0"}},
+		{in: "library/app:latest", want: Reference{Name: "library/app", Tag: "latest"}},
+		{in: "app/a.b__c-d/e--f", want: Reference{Name: "app/a.b__c-d/e--f"}},
+		{in: "a_b.example/app", wantErr: `invalid domain "a_b.example"`},
+		{in: "localhost/app", want: Reference{Name: "localhost/app"}},
+		{in: "registry.example.com:5000/app:v1", want: Reference{Name: "registry.example.com:5000/app", Tag: "v1"}},
+		{in: "registry:5000/app", want: Reference{Name: "registry:5000/app"}},
+		{in: "Registry.Example.com/app", want: Reference{Name: "Registry.Example.com/app"}},
+		{in: "app:_tag", want: Reference{Name: "app", Tag: "_tag"}},
+		{in: "app:" + strings.Repeat("t", 128), want: Reference{Name: "app", Tag: strings.Repeat("t", 128)}},
+		{in: "app@" + testDigest.String(), want: Reference{Name: "app", Digest: testDigest}},
+		{in: "app:1.0@" + testDigest.String(), want: Reference{Name: "app", Tag: "1.0", Digest: testDigest}},
+		{in: "registry:5000/app:1.0@" + testDigest.String(), want: Reference{Name: "registry:5000/app", Tag: "1.0", Digest: testDigest}},
+		{in: "@" + testDigest.String(), want: Reference{Digest: testDigest}},
+
+		{in: "", wantErr: `empty image reference`},
+		{in: "App", wantErr: `invalid name in "App": invalid path component "App": components are lowercase alphanumerics separated by '.', '_', '__' or dashes`},
+		{in: "app/", wantErr: `invalid name in "app/": invalid path component ""`},
+		{in: "-app", wantErr: `invalid path component "-app"`},
+		{in: "app..x", wantErr: `invalid path component "app..x"`},
+		{in: "app___x", wantErr: `invalid path component "app___x"`},
+		{in: "-bad.example.com/app", wantErr: `invalid name in "-bad.example.com/app": invalid domain "-bad.example.com"`},
+		{in: "registry:port/app", wantErr: `invalid domain "registry:port"`},
+		{in: strings.Repeat("a", 256), wantErr: `name is longer than 255 characters`},
+		{in: ":tag", wantErr: `invalid name in ":tag": name is empty`},
+		{in: "app:", wantErr: `invalid tag "" in "app:": tags are up to 128 word characters, dots and dashes, not starting with a dot or dash`},
+		{in: "app:.tag", wantErr: `invalid tag ".tag"`},
+		{in: "app:-tag", wantErr: `invalid tag "-tag"`},
+		{in: "app:" + strings.Repeat("t", 129), wantErr: `invalid tag`},
+		{in: "app@sha256:abc", wantErr: `invalid digest "sha256:abc" in "app@sha256:abc"`},
+		{in: "app@", wantErr: `invalid digest "" in "app@"`},
+		{in: "app:1.0@" + testDigest.String() + "@x", wantErr: `invalid digest`},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.wantErr != "" {
+			if err == nil {
+				t.Errorf("Parse(%q) = %+v, want error %q", tt.in, got, tt.wantErr)
+			} else if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse(%q) error %q, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if got.String() != tt.in {
+			t.Errorf("Parse(%q).String() = %q", tt.in, got.String())
+		}
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantPath string
+		wantRef  Reference
+		wantErr  string
+	}{
+		{in: "/tmp/layout", wantPath: "/tmp/layout"},
+		{in: "/tmp/layout:app", wantPath: "/tmp/layout", wantRef: Reference{Name: "app"}},
+		{in: "/tmp/layout:app:1.0", wantPath: "/tmp/layout", wantRef: Reference{Name: "app", Tag: "1.0"}},
+		{in: "/tmp/layout:registry:5000/app:1.0", wantPath: "/tmp/layout", wantRef: Reference{Name: "registry:5000/app", Tag: "1.0"}},
+		{in: "/tmp/layout:app:1.0@" + testDigest.String(), wantPath: "/tmp/layout", wantRef: Reference{Name: "app", Tag: "1.0", Digest: testDigest}},
+		{in: "/tmp/layout@" + testDigest.String(), wantPath: "/tmp/layout", wantRef: Reference{Digest: testDigest}},
+		{in: `/tmp/a\:b:app`, wantPath: "/tmp/a:b", wantRef: Reference{Name: "app"}},
+		{in: `/tmp/a\@b@` + testDigest.String(), wantPath: "/tmp/a@b", wantRef: Reference{Digest: testDigest}},
+		{in: `/tmp/a\\:app`, wantPath: `/tmp/a\`, wantRef: Reference{Name: "app"}},
+		{in: `C\:\\images\:x`, wantPath: `C:\images:x`},
+
+		{in: "", wantErr: `missing path in ""`},
+		{in: ":app", wantErr: `missing path in ":app"`},
+		{in: "@" + testDigest.String(), wantErr: `missing path in "@`},
+		{in: "/tmp/layout:", wantErr: `empty image reference`},
+		{in: "/tmp/layout:App", wantErr: `invalid name in "App"`},
+		{in: "/tmp/layout@sha256:abc", wantErr: `invalid digest "sha256:abc"`},
+		{in: `/tmp/a\b`, wantErr: `invalid escape in "/tmp/a\\b": only \:, \@ and \\ are allowed`},
+		{in: `/tmp/a\`, wantErr: `invalid escape`},
+	}
+
+	for _, tt := range tests {
+		path, ref, err := SplitPath(tt.in)
+		if tt.wantErr != "" {
+			if err == nil {
+				t.Errorf("SplitPath(%q) = %q, %+v, want error %q", tt.in, path, ref, tt.wantErr)
+			} else if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("SplitPath(%q) error %q, want %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SplitPath(%q): %v", tt.in, err)
+			continue
+		}
+		if path != tt.wantPath || ref != tt.wantRef {
+			t.Errorf("SplitPath(%q) = %q, %+v, want %q, %+v", tt.in, path, ref, tt.wantPath, tt.wantRef)
+		}
+	}
+}
@@ -16,3 +16,7 @@ func getTmpDir() string {
 func MkTmpDir(name string) (string, error) {
 	return os.MkdirTemp(getTmpDir(), "cbt-"+name)
 }
+
+func MkTmpFile(name string) (*os.File, error) {
+	return os.CreateTemp(getTmpDir(), "cbt-"+name)
+}
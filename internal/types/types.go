@@ -5,18 +5,39 @@ import (
 
 	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkorzh/container-build-tool/internal/archive"
 )
 
 type ImageReader interface {
 	Close() error
-	GetBlob(digest.Digest) (io.ReadCloser, error)
+	// GetBlob returns a reader that fails at EOF if the blob doesn't match
+	// the digest and size of the descriptor.
+	GetBlob(imgspecv1.Descriptor) (io.ReadCloser, error)
 	GetManifest() (*imgspecv1.Manifest, error)
 	GetImage() (*imgspecv1.Image, error)
+	// ManifestDescriptor describes the manifest of the image being read.
+	ManifestDescriptor() imgspecv1.Descriptor
+	// Referrers lists the manifests whose subject is the image, keeping
+	// those of the given artifact type if one is set.
+	Referrers(artifactType string) ([]imgspecv1.Descriptor, error)
 }
 
 type PutBlobOptions struct {
 	Annotations map[string]string
 	MediaType   string
+	// Digest and Size, when set, are verified against the written blob.
+	Digest digest.Digest
+	Size   int64
+}
+
+type ImageReaderOptions struct {
+	// Platform picks the image out of multi-platform images, the default
+	// platform when it's nil.
+	Platform *imgspecv1.Platform
+}
+
+type ImageWriterOptions struct {
+	ArchiveCompression archive.Compression
 }
 
 type ImageWriter interface {
@@ -25,11 +46,11 @@ type ImageWriter interface {
 	PutManifestBlob(imgspecv1.Manifest) (imgspecv1.Descriptor, error)
 	PutImageBlob(imgspecv1.Image, *imgspecv1.Manifest) (imgspecv1.Descriptor, error)
 	PutBlob(io.Reader, PutBlobOptions) (imgspecv1.Descriptor, error)
-	GetBlob(digest.Digest) (io.ReadCloser, error)
+	GetBlob(imgspecv1.Descriptor) (io.ReadCloser, error)
 }
 
 type ImageRef interface {
-	NewImageReader() (ImageReader, error)
-	NewImageWriter() (ImageWriter, error)
+	NewImageReader(ImageReaderOptions) (ImageReader, error)
+	NewImageWriter(ImageWriterOptions) (ImageWriter, error)
 	ImageName() string
 }
@@ -5,6 +5,8 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+
+	"github.com/pkorzh/container-build-tool/internal/lockfile"
 )
 
 func baseDir() (string, error) {
@@ -67,3 +69,48 @@ func GetWorkingContainerDir(name string) (string, error) {
 
 	return workingContainerDir, nil
 }
+
+// LockBaseDir serializes the creation, renaming and removal of working
+// containers.
+func LockBaseDir() (*lockfile.LockFile, error) {
+	baseDir, err := ensureWorkdirBaseExists()
+	if err != nil {
+		return nil, err
+	}
+
+	return lockfile.Lock(baseDir)
+}
+
+func WorkingContainerIDs() ([]string, error) {
+	baseDir, err := ensureWorkdirBaseExists()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(baseDir, entry.Name(), "builder.json")); err != nil {
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+
+	return ids, nil
+}
+
+func RemoveWorkingContainerDir(name string) error {
+	workingContainerDir, err := GetWorkingContainerDir(name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(workingContainerDir)
+}